@@ -0,0 +1,726 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+)
+
+// maxAlerts is the number of alerts we keep. Older ones are dropped, whether
+// they have been acknowledged or not.
+const maxAlerts = 100
+
+// probeAlertInterval is the shortest time between task probe alert writes for
+// a remote address. Probes from the address in between are counted and added
+// to its alert later, so that guessing task IDs can't cost us a storage write
+// per request.
+const probeAlertInterval = time.Minute
+
+// probeReason is the reason we give for task probe alerts.
+const probeReason = "task is unknown to Mesos"
+
+// These constants are the things we can do when a task that has already
+// logged in tries to log in again.
+const (
+	actionAlert          = "alert"
+	actionQuarantine     = "quarantine"
+	actionRevokeExisting = "revoke-existing"
+	actionKill           = "kill"
+)
+
+// duplicateLoginActions lists all valid duplicate login actions.
+var duplicateLoginActions = []string{actionAlert, actionQuarantine, actionRevokeExisting, actionKill}
+
+// These constants are the kinds of alert we record.
+const (
+	alertDuplicateLogin  = "duplicate-login"
+	alertTaskProbe       = "task-probe"
+	alertAddressMismatch = "address-mismatch"
+	alertDeadTaskRenewal = "dead-task-renewal"
+)
+
+// alertKinds lists all valid alert kinds.
+var alertKinds = []string{alertDuplicateLogin, alertTaskProbe, alertAddressMismatch, alertDeadTaskRenewal}
+
+// pathAlerts returns the "alerts" path struct. It is a function rather than a
+// method because we never call it once the backend struct is built and we
+// don't want name collisions with any request handler methods.
+func pathAlerts(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "alerts/?$",
+		Fields: map[string]*framework.FieldSchema{
+			"kind": {
+				Type:        framework.TypeString,
+				Description: "Only return alerts of this kind.",
+			},
+			"prefix": {
+				Type:        framework.TypeString,
+				Description: "Only return alerts for task IDs with this prefix.",
+			},
+			"task-id": {
+				Type:        framework.TypeString,
+				Description: "Only return alerts for this task ID.",
+			},
+			"acknowledged": {
+				Type:        framework.TypeBool,
+				Description: "Only return alerts that have (or haven't) been acknowledged.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathAlertsRead,
+			logical.ListOperation: b.pathAlertsList,
+		},
+	}
+}
+
+// pathAlert returns the "alerts/<id>" path struct. It is a function rather
+// than a method because we never call it once the backend struct is built and
+// we don't want name collisions with any request handler methods.
+func pathAlert(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "alerts/(?P<id>[0-9]+)$",
+		Fields: map[string]*framework.FieldSchema{
+			"id": {Type: framework.TypeString},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathAlertRead,
+		},
+	}
+}
+
+// pathAlertAck returns the "alerts/<id>/ack" path struct. It is a function
+// rather than a method because we never call it once the backend struct is
+// built and we don't want name collisions with any request handler methods.
+func pathAlertAck(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "alerts/(?P<id>[0-9]+)/ack$",
+		Fields: map[string]*framework.FieldSchema{
+			"id": {Type: framework.TypeString},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathAlertAck,
+		},
+	}
+}
+
+// alert is a security event that an operator should look at.
+type alert struct {
+	ID         int
+	Time       time.Time
+	Kind       string
+	TaskID     string
+	Prefix     string
+	RemoteAddr string
+	Reason     string
+	// Actions lists what we did about it, other than recording the alert.
+	Actions []string
+	// Count is the number of events the alert covers, and LastSeen is the
+	// time of the most recent one. Task probes from a remote address share
+	// an alert, and the others have zero values that mean a single event.
+	Count    int
+	LastSeen time.Time
+	// AcknowledgedAt is zero until an operator acknowledges the alert.
+	AcknowledgedAt time.Time
+	AcknowledgedBy string
+}
+
+// alerts is used to store the most recent alerts, oldest first, along with
+// the ID to give the next one.
+type alerts struct {
+	NextID int
+	Alerts []alert
+}
+
+// probeTracker counts task probes from each remote address between alert
+// writes.
+type probeTracker struct {
+	lock    sync.Mutex
+	now     func() time.Time
+	sources map[string]*probeSource
+}
+
+// probeSource holds the probes from a remote address that we haven't
+// recorded yet, and when we last recorded any.
+type probeSource struct {
+	recorded time.Time
+	pending  int
+	taskID   string
+	prefix   string
+}
+
+// newProbeTracker builds a probeTracker that uses the real clock.
+func newProbeTracker() *probeTracker {
+	return &probeTracker{now: time.Now, sources: map[string]*probeSource{}}
+}
+
+// record counts a probe. If we haven't recorded an alert for the probe's
+// remote address recently, it returns an alert covering all the probes we've
+// seen from there since the last one. Otherwise it returns nil, and the probe
+// will be recorded later.
+func (pt *probeTracker) record(a alert) *alert {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	ps := pt.sources[a.RemoteAddr]
+	if ps == nil {
+		ps = &probeSource{}
+		pt.sources[a.RemoteAddr] = ps
+	}
+	ps.pending++
+	ps.taskID, ps.prefix = a.TaskID, a.Prefix
+	now := pt.now()
+	if !ps.recorded.IsZero() && now.Sub(ps.recorded) < probeAlertInterval {
+		return nil
+	}
+	return ps.flush(a.RemoteAddr, now)
+}
+
+// due returns alerts for all the remote addresses with probes we haven't
+// recorded that we haven't recorded an alert for recently. It also drops
+// addresses with nothing left to record, so that we only remember addresses
+// that have probed us in the last interval.
+func (pt *probeTracker) due() []alert {
+	pt.lock.Lock()
+	defer pt.lock.Unlock()
+	now := pt.now()
+	alerts := []alert{}
+	for addr, ps := range pt.sources {
+		if now.Sub(ps.recorded) < probeAlertInterval {
+			continue
+		}
+		if ps.pending == 0 {
+			delete(pt.sources, addr)
+			continue
+		}
+		alerts = append(alerts, *ps.flush(addr, now))
+	}
+	return alerts
+}
+
+// flush returns an alert for the pending probes from a remote address and
+// marks them as recorded.
+func (ps *probeSource) flush(addr string, now time.Time) *alert {
+	a := &alert{
+		Time:       now,
+		Kind:       alertTaskProbe,
+		TaskID:     ps.taskID,
+		Prefix:     ps.prefix,
+		RemoteAddr: addr,
+		Reason:     probeReason,
+		Count:      ps.pending,
+	}
+	ps.recorded = now
+	ps.pending = 0
+	return a
+}
+
+// alertFilter selects alerts to return. Empty fields match everything.
+type alertFilter struct {
+	kind         string
+	prefix       string
+	taskID       string
+	acknowledged *bool
+}
+
+// quarantine is used to store a quarantined task ID. Tokens issued to a
+// quarantined task can't be renewed, and are revoked when they try to be if
+// Revoke is set.
+type quarantine struct {
+	Time   time.Time
+	Reason string
+	Revoke bool
+}
+
+// qtKey builds a quarantine storage key.
+func qtKey(taskID string) string {
+	return "quarantine/" + taskID
+}
+
+// validateDuplicateLoginActions checks that all the given actions are valid,
+// and that we have what we need to revoke tokens if we're asked to.
+func validateDuplicateLoginActions(cfg *config) error {
+	for _, action := range cfg.DuplicateLoginActions {
+		if !strutil.StrListContains(duplicateLoginActions, action) {
+			return fmt.Errorf("invalid duplicate-login-actions: %s", action)
+		}
+	}
+	revoke := strutil.StrListContains(cfg.DuplicateLoginActions, actionRevokeExisting)
+	if revoke && (cfg.VaultAddr == "" || cfg.VaultToken == "") {
+		return fmt.Errorf("duplicate-login-actions: revoke-existing requires vault-addr and vault-token")
+	}
+	return nil
+}
+
+// respondToDuplicateLogin does whatever the config says to when a task that
+// has already logged in tries to log in again. That usually means its task ID
+// has leaked, so if we're asked to we quarantine the task to stop anyone
+// renewing the tokens it already has (revoking them when they try, for
+// revoke-existing), and ask its scheduler to kill it.
+func (b *mesosBackend) respondToDuplicateLogin(rh *requestHelper, cfg *config, ld *loginDecision, remoteAddr string) error {
+	actions := []string{}
+	revoke := strutil.StrListContains(cfg.DuplicateLoginActions, actionRevokeExisting)
+	if revoke || strutil.StrListContains(cfg.DuplicateLoginActions, actionQuarantine) {
+		q := quarantine{Time: time.Now(), Reason: alertDuplicateLogin, Revoke: revoke}
+		if err := rh.store(qtKey(ld.taskID), q); err != nil {
+			return err
+		}
+		b.Logger().Warn("TASK QUARANTINED", "task-id", ld.taskID, "reason", q.Reason, "revoke", revoke)
+		actions = append(actions, actionQuarantine)
+		if revoke {
+			actions = append(actions, actionRevokeExisting)
+		}
+	}
+	if strutil.StrListContains(cfg.DuplicateLoginActions, actionKill) {
+		// The login is denied either way, so a failed kill is only logged
+		// (and left out of the alert's actions).
+		if err := b.killTask(rh.ctx, cfg, ld.taskID); err != nil {
+			b.Logger().Error("TASK NOT KILLED", "task-id", ld.taskID, "error", err)
+		} else {
+			b.Logger().Warn("TASK KILLED", "task-id", ld.taskID)
+			actions = append(actions, actionKill)
+		}
+	}
+	if strutil.StrListContains(cfg.DuplicateLoginActions, actionAlert) {
+		b.raiseAlert(rh, alert{
+			Kind:       alertDuplicateLogin,
+			TaskID:     ld.taskID,
+			Prefix:     ld.prefix,
+			RemoteAddr: remoteAddr,
+			Reason:     ld.denial.detail,
+			Actions:    actions,
+		})
+	}
+	return nil
+}
+
+// checkLoginAddress raises an alert if a task logged in from an address that
+// is neither its agent's nor one of its container's. We can only tell if the
+// remote address and at least one of the task's addresses are IPs, so we say
+// nothing if they aren't.
+func (b *mesosBackend) checkLoginAddress(rh *requestHelper, cfg *config, ld *loginDecision, remoteAddr string) {
+	remoteIP := net.ParseIP(remoteAddr)
+	if remoteIP == nil {
+		return
+	}
+	addrs := append(b.taskAgentIPs(rh.ctx, cfg, ld), taskAddresses(ld.task)...)
+	if len(addrs) == 0 {
+		return
+	}
+	for _, addr := range addrs {
+		if remoteIP.Equal(addr) {
+			return
+		}
+	}
+	known := []string{}
+	for _, addr := range addrs {
+		known = append(known, addr.String())
+	}
+	b.raiseAlert(rh, alert{
+		Kind:       alertAddressMismatch,
+		TaskID:     ld.taskID,
+		Prefix:     ld.prefix,
+		RemoteAddr: remoteAddr,
+		Reason:     "task addresses are " + strings.Join(known, ","),
+	})
+}
+
+// taskAgentIPs returns the IP addresses of a task's agent. Agent hostnames are
+// often DNS names, and tasks on bridge networks reach us through their agent's
+// address, so we also use the address in the agent's PID. We only know that
+// from the master's agent list, so we fall back to the hostname if we can't
+// find the agent in it.
+func (b *mesosBackend) taskAgentIPs(ctx context.Context, cfg *config, ld *loginDecision) []net.IP {
+	mc := b.mesosClient(cfg)
+	for _, refresh := range []bool{false, true} {
+		agents, err := b.agents.get(ctx, cfg.BaseURL, mc, refresh)
+		if err != nil {
+			break
+		}
+		for i, agent := range agents {
+			if agent.AgentInfo.ID != nil && agent.AgentInfo.ID.Value == ld.task.AgentID.Value {
+				return agentIPs(&agents[i])
+			}
+		}
+	}
+	ips := []net.IP{}
+	if ld.agent != nil {
+		if ip := net.ParseIP(ld.agent.Hostname); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// taskAddresses returns the IP addresses a task's container has been given.
+func taskAddresses(task *mesos.Task) []net.IP {
+	addrs := []net.IP{}
+	for _, status := range task.Statuses {
+		if status.ContainerStatus == nil {
+			continue
+		}
+		for _, ni := range status.ContainerStatus.NetworkInfos {
+			for _, ipa := range ni.IPAddresses {
+				if ipa.IPAddress == nil {
+					continue
+				}
+				if ip := net.ParseIP(*ipa.IPAddress); ip != nil {
+					addrs = append(addrs, ip)
+				}
+			}
+		}
+	}
+	return addrs
+}
+
+// raiseProbeAlert raises a task probe alert, unless we've recently raised one
+// for the same remote address. In that case we only count the probe, and it
+// is recorded by a later probe or by flushProbeAlerts.
+func (b *mesosBackend) raiseProbeAlert(rh *requestHelper, taskID, prefix, remoteAddr string) {
+	a := b.probes.record(alert{TaskID: taskID, Prefix: prefix, RemoteAddr: remoteAddr})
+	if a != nil {
+		b.raiseAlert(rh, *a)
+	}
+}
+
+// flushProbeAlerts records any task probes that we've counted but haven't
+// recorded yet.
+func (b *mesosBackend) flushProbeAlerts(rh *requestHelper) (int, error) {
+	alerts := b.probes.due()
+	for i, a := range alerts {
+		if err := b.recordAlert(rh, a); err != nil {
+			return i, err
+		}
+	}
+	return len(alerts), nil
+}
+
+// raiseAlert logs and records an alert. Alerts are a side effect of whatever
+// request we're handling, so we only log a failure to record one rather than
+// failing the request.
+func (b *mesosBackend) raiseAlert(rh *requestHelper, a alert) {
+	b.Logger().Warn("ALERT",
+		"kind", a.Kind,
+		"task-id", a.TaskID,
+		"remote-addr", a.RemoteAddr,
+		"reason", a.Reason,
+		"count", a.count())
+	if a.Time.IsZero() {
+		a.Time = time.Now()
+	}
+	err := b.recordAlert(rh, a)
+	b.status.recordBackgroundError("alert-record", err)
+	if err != nil {
+		b.Logger().Error("ALERT NOT RECORDED", "kind", a.Kind, "task-id", a.TaskID, "error", err.Error())
+	}
+}
+
+// recordAlert adds an alert to the stored list, dropping an old one if
+// necessary. A task probe is added to any unacknowledged task probe alert
+// from the same remote address instead. Each alert rewrites the whole list,
+// so we hold a lock while we do it. This doesn't help across nodes of a
+// cluster, but only the active node handles logins.
+func (b *mesosBackend) recordAlert(rh *requestHelper, a alert) error {
+	b.alertLock.Lock()
+	defer b.alertLock.Unlock()
+
+	as, err := rh.getAlerts()
+	if err != nil {
+		return err
+	}
+	if a.Kind == alertTaskProbe {
+		if probe := as.findProbe(a.RemoteAddr); probe != nil {
+			probe.Count = probe.count() + a.count()
+			probe.LastSeen = a.Time
+			probe.TaskID, probe.Prefix = a.TaskID, a.Prefix
+			return rh.store("alerts", as)
+		}
+	}
+	as.NextID++
+	a.ID = as.NextID
+	as.Alerts = append(as.Alerts, a)
+	for len(as.Alerts) > maxAlerts {
+		as.dropOldest()
+	}
+	return rh.store("alerts", as)
+}
+
+// count returns the number of events an alert covers.
+func (a *alert) count() int {
+	if a.Count == 0 {
+		return 1
+	}
+	return a.Count
+}
+
+// findProbe returns the unacknowledged task probe alert for a remote address,
+// or nil if there isn't one.
+func (as *alerts) findProbe(remoteAddr string) *alert {
+	for i, a := range as.Alerts {
+		if a.Kind == alertTaskProbe && a.RemoteAddr == remoteAddr && a.AcknowledgedAt.IsZero() {
+			return &as.Alerts[i]
+		}
+	}
+	return nil
+}
+
+// evictionOrder lists the kinds of alert we drop first when there are too
+// many, most expendable first. Task probes are the only alerts an
+// unauthenticated client can raise at will, so they mustn't push the others
+// out. Address mismatches come next, because unusual networking can raise them
+// for perfectly healthy tasks.
+var evictionOrder = []string{alertTaskProbe, alertAddressMismatch}
+
+// dropOldest drops the oldest alert of the first kind in evictionOrder that we
+// have any of, or the oldest alert if we have none of those.
+func (as *alerts) dropOldest() {
+	drop := 0
+	for _, kind := range evictionOrder {
+		if i := as.oldestOfKind(kind); i >= 0 {
+			drop = i
+			break
+		}
+	}
+	as.Alerts = append(as.Alerts[:drop], as.Alerts[drop+1:]...)
+}
+
+// oldestOfKind returns the index of the oldest alert of the given kind, or -1
+// if there aren't any.
+func (as *alerts) oldestOfKind(kind string) int {
+	for i, a := range as.Alerts {
+		if a.Kind == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+// getAlerts fetches the stored alerts.
+func (rh *requestHelper) getAlerts() (*alerts, error) {
+	as := &alerts{}
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			return nil
+		}
+		return se.DecodeJSON(as)
+	}
+	err := rh.fetch("alerts", decode)
+	return as, err
+}
+
+// find returns the alert with the given ID, or nil if we don't have it.
+func (as *alerts) find(id string) *alert {
+	for i, a := range as.Alerts {
+		if strconv.Itoa(a.ID) == id {
+			return &as.Alerts[i]
+		}
+	}
+	return nil
+}
+
+// tidyQuarantines deletes the quarantines of tasks that have finished for
+// good, or that Mesos has never heard of. Renewals for those tasks fail
+// anyway, and Mesos never reuses task IDs, so the quarantines have no further
+// effect. A task that isn't running right now (because its agent is
+// unreachable, for example) may come back, so we keep its quarantine. We only
+// ask Mesos if there is something to tidy.
+func (b *mesosBackend) tidyQuarantines(rh *requestHelper) (int, error) {
+	taskIDs, err := rh.storage.List(rh.ctx, qtKey(""))
+	if err != nil || len(taskIDs) == 0 {
+		return 0, err
+	}
+	cfg, err := rh.getConfigOrNil()
+	if err != nil || cfg == nil {
+		return 0, err
+	}
+	rgt, err := b.getTasks(rh.ctx, b.mesosClient(cfg))
+	if err != nil {
+		return 0, err
+	}
+	tidied := 0
+	for _, taskID := range taskIDs {
+		if taskKnown(taskID, rgt) && !taskTerminated(taskID, rgt) {
+			continue
+		}
+		if err := rh.delete(qtKey(taskID)); err != nil {
+			return tidied, err
+		}
+		tidied++
+	}
+	return tidied, nil
+}
+
+// getQuarantineOrNil fetches the quarantine for a task ID, returning nil if
+// the task isn't quarantined.
+func (rh *requestHelper) getQuarantineOrNil(taskID string) (*quarantine, error) {
+	var q *quarantine
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			return nil
+		}
+		q = &quarantine{}
+		return se.DecodeJSON(q)
+	}
+	err := rh.fetch(qtKey(taskID), decode)
+	return q, err
+}
+
+// data returns an alert in a form suitable for a read response.
+func (a *alert) data() jsonobj {
+	acknowledgedAt := ""
+	if !a.AcknowledgedAt.IsZero() {
+		acknowledgedAt = a.AcknowledgedAt.UTC().Format(time.RFC3339Nano)
+	}
+	actions := a.Actions
+	if actions == nil {
+		actions = []string{}
+	}
+	lastSeen := a.LastSeen
+	if lastSeen.IsZero() {
+		lastSeen = a.Time
+	}
+	return jsonobj{
+		"id":              a.ID,
+		"time":            a.Time.UTC().Format(time.RFC3339Nano),
+		"kind":            a.Kind,
+		"task-id":         a.TaskID,
+		"prefix":          a.Prefix,
+		"remote-addr":     a.RemoteAddr,
+		"reason":          a.Reason,
+		"actions":         actions,
+		"count":           a.count(),
+		"last-seen":       lastSeen.UTC().Format(time.RFC3339Nano),
+		"acknowledged":    !a.AcknowledgedAt.IsZero(),
+		"acknowledged-at": acknowledgedAt,
+		"acknowledged-by": a.AcknowledgedBy,
+	}
+}
+
+// alertFilterFromData builds an alert filter from a request.
+func alertFilterFromData(d *framework.FieldData) (*alertFilter, error) {
+	af := &alertFilter{
+		kind:   d.Get("kind").(string),
+		prefix: d.Get("prefix").(string),
+		taskID: d.Get("task-id").(string),
+	}
+	if af.kind != "" && !strutil.StrListContains(alertKinds, af.kind) {
+		return nil, fmt.Errorf("invalid kind: %s", af.kind)
+	}
+	if acknowledged, ok := d.GetOk("acknowledged"); ok {
+		ack := acknowledged.(bool)
+		af.acknowledged = &ack
+	}
+	return af, nil
+}
+
+// matches checks whether an alert matches the filter.
+func (af *alertFilter) matches(a *alert) bool {
+	switch {
+	case af.kind != "" && a.Kind != af.kind:
+		return false
+	case af.prefix != "" && a.Prefix != af.prefix:
+		return false
+	case af.taskID != "" && a.TaskID != af.taskID:
+		return false
+	case af.acknowledged != nil && *af.acknowledged == a.AcknowledgedAt.IsZero():
+		return false
+	}
+	return true
+}
+
+// pathAlertsRead is the "alerts" read request handler. It returns the alerts
+// that match the request's filters, oldest first.
+func (b *mesosBackend) pathAlertsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	af, err := alertFilterFromData(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	as, err := rh.getAlerts()
+	if err != nil {
+		return nil, err
+	}
+	data := []jsonobj{}
+	for i := range as.Alerts {
+		if af.matches(&as.Alerts[i]) {
+			data = append(data, as.Alerts[i].data())
+		}
+	}
+	return &logical.Response{Data: jsonobj{"alerts": data}}, nil
+}
+
+// pathAlertsList is the "alerts/" list request handler. Vault doesn't give
+// list requests any parameters, so this lists every alert we have and the
+// read handler does the filtering.
+func (b *mesosBackend) pathAlertsList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	as, err := rh.getAlerts()
+	if err != nil {
+		return nil, err
+	}
+	keys := []string{}
+	keyInfo := map[string]interface{}{}
+	for _, a := range as.Alerts {
+		key := strconv.Itoa(a.ID)
+		keys = append(keys, key)
+		keyInfo[key] = jsonobj{
+			"kind":         a.Kind,
+			"task-id":      a.TaskID,
+			"acknowledged": !a.AcknowledgedAt.IsZero(),
+		}
+	}
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// pathAlertRead is the "alerts/<id>" read request handler.
+func (b *mesosBackend) pathAlertRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	as, err := rh.getAlerts()
+	if err != nil {
+		return nil, err
+	}
+	a := as.find(d.Get("id").(string))
+	if a == nil {
+		return nil, nil
+	}
+	return &logical.Response{Data: a.data()}, nil
+}
+
+// pathAlertAck is the "alerts/<id>/ack" update request handler. It marks an
+// alert as acknowledged, so that on-call can filter out alerts they've
+// already dealt with. Acknowledging an alert again changes nothing.
+func (b *mesosBackend) pathAlertAck(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	b.alertLock.Lock()
+	defer b.alertLock.Unlock()
+
+	id := d.Get("id").(string)
+	as, err := rh.getAlerts()
+	if err != nil {
+		return nil, err
+	}
+	a := as.find(id)
+	if a == nil {
+		return logical.ErrorResponse("no such alert: " + id), nil
+	}
+	if !a.AcknowledgedAt.IsZero() {
+		return &logical.Response{Data: a.data()}, nil
+	}
+	a.AcknowledgedAt = time.Now()
+	a.AcknowledgedBy = req.DisplayName
+	b.Logger().Info("ALERT ACKNOWLEDGED", "id", id, "by", a.AcknowledgedBy)
+
+	err = rh.store("alerts", as)
+	return &logical.Response{Data: a.data()}, err
+}
@@ -0,0 +1,512 @@
+package mesosauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// AlertsTests is a testify test suite object that we can attach helper
+// methods to.
+type AlertsTests struct{ TestSuite }
+
+// Test_Alerts is a standard Go test function that runs our test suite's
+// tests.
+func Test_Alerts(t *testing.T) { suite.Run(t, new(AlertsTests)) }
+
+// setupDuplicateLogin sets up a backend with the given duplicate login
+// actions, logs a task in, and then tries to log it in again from another
+// address. It returns the auth from the first login.
+func (ts *AlertsTests) setupDuplicateLogin(actions string) *logical.Auth {
+	return ts.setupDuplicateLoginWith(
+		jsonobj{"duplicate-login-actions": actions},
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+}
+
+// setupDuplicateLoginWith is setupDuplicateLogin with the given config
+// settings and task.abc-123 task.
+func (ts *AlertsTests) setupDuplicateLoginWith(cfg jsonobj, task mesos.Task) *logical.Auth {
+	ts.SetupLoginTasks(cfg, task)
+
+	auth := ts.Login("task.abc-123")
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	req.Connection.RemoteAddr = "10.0.0.2"
+	ts.HandleRequestError(req, "permission denied: already-logged-in: task has already logged in")
+	return auth
+}
+
+// alertsData returns the alerts from an alerts read request with the given
+// filters, without their timestamps.
+func (ts *AlertsTests) alertsData(filters jsonobj) []jsonobj {
+	req := ts.mkReadReq("alerts")
+	req.Data = filters
+	alerts := ts.HandleRequest(req).Data["alerts"].([]jsonobj)
+	for _, a := range alerts {
+		ts.NotEmpty(a["time"])
+		ts.NotEmpty(a["last-seen"])
+		delete(a, "time")
+		delete(a, "last-seen")
+	}
+	return alerts
+}
+
+// mkAlertData builds the data we expect for an unacknowledged alert, without
+// its timestamp.
+func mkAlertData(id int, kind, taskID, remoteAddr, reason string, actions ...string) jsonobj {
+	prefix, _ := taskIDPrefix(taskID) // #nosec G104
+	if actions == nil {
+		actions = []string{}
+	}
+	return jsonobj{
+		"id":              id,
+		"kind":            kind,
+		"task-id":         taskID,
+		"prefix":          prefix,
+		"remote-addr":     remoteAddr,
+		"reason":          reason,
+		"actions":         actions,
+		"count":           1,
+		"acknowledged":    false,
+		"acknowledged-at": "",
+		"acknowledged-by": "",
+	}
+}
+
+// Duplicate login actions can be configured, and unsupported ones are
+// rejected.
+func (ts *AlertsTests) Test_config() {
+	ts.SetupBackend()
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":             true,
+		"base-url":                "http://master.mesos:5050",
+		"duplicate-login-actions": "alert,quarantine",
+	}))
+	data := ts.HandleRequest(ts.mkReadReq("config")).Data
+	ts.Equal(data["duplicate-login-actions"], []string{"alert", "quarantine"})
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "duplicate-login-actions": "panic"}))
+	ts.Equal(resp, logical.ErrorResponse("invalid duplicate-login-actions: panic"))
+
+	resp = ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "duplicate-login-actions": "revoke-existing"}))
+	ts.Equal(resp, logical.ErrorResponse("duplicate-login-actions: revoke-existing requires vault-addr and vault-token"))
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":             true,
+		"duplicate-login-actions": "kill,revoke-existing",
+		"vault-addr":              "https://vault.example.com:8200",
+		"vault-token":             "sekrit",
+	}))
+	data = ts.HandleRequest(ts.mkReadReq("config")).Data
+	ts.Equal(data["duplicate-login-actions"], []string{"kill", "revoke-existing"})
+	ts.Equal(data["vault-addr"], "https://vault.example.com:8200")
+	ts.Equal(data["vault-token"], "set")
+}
+
+// Without any actions, a duplicate login is only denied.
+func (ts *AlertsTests) Test_no_actions() {
+	auth := ts.setupDuplicateLogin("")
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{})
+	ts.Nil(ts.GetStored("quarantine/task.abc-123"))
+	ts.WithoutError(ts.HandleRequestRaw(ts.mkRenew(auth)))
+}
+
+// A duplicate login can record an alert.
+func (ts *AlertsTests) Test_alert() {
+	auth := ts.setupDuplicateLogin("alert")
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "duplicate-login", "task.abc-123", "10.0.0.2", "task has already logged in"),
+	})
+	ts.WithoutError(ts.HandleRequestRaw(ts.mkRenew(auth)))
+}
+
+// A duplicate login can quarantine the task, which stops the tokens it
+// already has from being renewed.
+func (ts *AlertsTests) Test_quarantine() {
+	auth := ts.setupDuplicateLogin("alert,quarantine")
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "duplicate-login", "task.abc-123", "10.0.0.2", "task has already logged in", "quarantine"),
+	})
+	ts.HandleRequestError(ts.mkRenew(auth), "task task.abc-123 is quarantined")
+}
+
+// fakeService starts an HTTP server that records the paths, tokens and bodies
+// of the requests it gets on the returned channel.
+func (ts *AlertsTests) fakeService() (*httptest.Server, chan jsonobj) {
+	requests := make(chan jsonobj, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := jsonobj{}
+		ts.NoError(json.NewDecoder(r.Body).Decode(&body))
+		requests <- jsonobj{"path": r.URL.Path, "token": r.Header.Get("X-Vault-Token"), "body": body}
+	}))
+	ts.AddCleanup(server.Close)
+	return server, requests
+}
+
+// receive returns the next request a fake service got, failing if there isn't
+// one soon.
+func (ts *AlertsTests) receive(requests chan jsonobj) jsonobj {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		ts.Fail("no request received")
+		return nil
+	}
+}
+
+// The revoke-existing action quarantines the task and revokes its tokens
+// when they try to renew.
+func (ts *AlertsTests) Test_revoke_existing() {
+	vault, requests := ts.fakeService()
+	auth := ts.setupDuplicateLoginWith(jsonobj{
+		"duplicate-login-actions": "alert,revoke-existing",
+		"vault-addr":              vault.URL,
+		"vault-token":             "sekrit",
+	}, mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "duplicate-login", "task.abc-123", "10.0.0.2", "task has already logged in",
+			"quarantine", "revoke-existing"),
+	})
+
+	auth.Accessor = "accessor-1"
+	ts.HandleRequestError(ts.mkRenew(auth), "task task.abc-123 is quarantined")
+	ts.Equal(ts.receive(requests), jsonobj{
+		"path":  "/v1/auth/token/revoke-accessor",
+		"token": "sekrit",
+		"body":  map[string]interface{}{"accessor": "accessor-1"},
+	})
+}
+
+// A plain quarantine doesn't revoke anything.
+func (ts *AlertsTests) Test_quarantine_no_revoke() {
+	vault, requests := ts.fakeService()
+	auth := ts.setupDuplicateLoginWith(jsonobj{
+		"duplicate-login-actions": "quarantine",
+		"vault-addr":              vault.URL,
+		"vault-token":             "sekrit",
+	}, mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+
+	auth.Accessor = "accessor-1"
+	ts.HandleRequestError(ts.mkRenew(auth), "task task.abc-123 is quarantined")
+	ts.Len(requests, 0)
+}
+
+// The kill action asks the task's Marathon to kill it.
+func (ts *AlertsTests) Test_kill() {
+	marathon, requests := ts.fakeService()
+	ts.SetupLoginTasks(jsonobj{"duplicate-login-actions": "alert,kill"}, mkFrameworkTasks("task.abc-123")...)
+	fw := mkFramework("marathon", "fw-1", "")
+	fw.WebUiURL = &marathon.URL
+	ts.AddFramework(fw)
+
+	ts.Login("task.abc-123")
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	req.Connection.RemoteAddr = "10.0.0.2"
+	ts.HandleRequestError(req, "permission denied: already-logged-in: task has already logged in")
+
+	ts.Equal(ts.receive(requests), jsonobj{
+		"path":  "/v2/tasks/delete",
+		"token": "",
+		"body":  map[string]interface{}{"ids": []interface{}{"task.abc-123"}},
+	})
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "duplicate-login", "task.abc-123", "10.0.0.2", "task has already logged in", "kill"),
+	})
+}
+
+// If we don't know how to ask a task's framework to kill it, the alert
+// doesn't claim we did.
+func (ts *AlertsTests) Test_kill_unknown_framework() {
+	ts.setupDuplicateLoginWith(jsonobj{"duplicate-login-actions": "alert,kill"}, mkFrameworkTasks("task.abc-123")[0])
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "duplicate-login", "task.abc-123", "10.0.0.2", "task has already logged in"),
+	})
+}
+
+// Quarantines are tidied up in the background once their tasks have stopped
+// running.
+func (ts *AlertsTests) Test_quarantine_periodic_tidy() {
+	ts.setupDuplicateLogin("quarantine")
+	req := &logical.Request{Storage: ts.storage}
+
+	ts.Require().NoError(ts.backend.periodic(context.Background(), req))
+	ts.NotNil(ts.GetStored("quarantine/task.abc-123"))
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_KILLED), "task.abc-123")
+	ts.PutStored(qtKey("task.abc-999"), quarantine{Reason: alertDuplicateLogin})
+	ts.Require().NoError(ts.backend.periodic(context.Background(), req))
+	ts.Nil(ts.GetStored("quarantine/task.abc-123"))
+	ts.Nil(ts.GetStored("quarantine/task.abc-999"))
+}
+
+// A task that isn't running but may come back keeps its quarantine, so its
+// tokens still can't be renewed when it does.
+func (ts *AlertsTests) Test_quarantine_unreachable_kept() {
+	auth := ts.setupDuplicateLogin("quarantine")
+	req := &logical.Request{Storage: ts.storage}
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_UNREACHABLE), "task.abc-123")
+	ts.Require().NoError(ts.backend.periodic(context.Background(), req))
+	ts.NotNil(ts.GetStored("quarantine/task.abc-123"))
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_RUNNING), "task.abc-123")
+	ts.HandleRequestError(ts.mkRenew(auth), "task task.abc-123 is quarantined")
+}
+
+// Logins denied for other reasons don't trigger duplicate login actions, and
+// neither do login checks for tasks that have already logged in.
+func (ts *AlertsTests) Test_other_denials() {
+	ts.SetupLoginTask("task.abc-123", jsonobj{"duplicate-login-actions": "alert,quarantine"})
+
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "bad.abc-123"}),
+		"permission denied: no-policy-mapping: no task-policies entry and no default policies")
+	ts.Login("task.abc-123")
+	ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"}))
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{})
+	ts.Nil(ts.GetStored("quarantine/task.abc-123"))
+}
+
+// A login for a task that Mesos has never heard of raises an alert, but one
+// for a task that has finished doesn't.
+func (ts *AlertsTests) Test_task_probe() {
+	ts.SetupLoginTasks(jsonobj{}, mkTask("task", "task.abc-123", mesos.TASK_FINISHED))
+
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-not-running: task is not running")
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-124"})
+	req.Connection.RemoteAddr = "10.0.0.2"
+	ts.HandleRequestError(req, "permission denied: task-not-running: task is not running")
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "task-probe", "task.abc-124", "10.0.0.2", "task is unknown to Mesos"),
+	})
+}
+
+// Task probes from a remote address share an alert, and we record them at
+// most once per interval. Probes in between are recorded by the next probe
+// after the interval, or by the periodic function.
+func (ts *AlertsTests) Test_task_probe_coalesced() {
+	ts.SetupLoginTasks(jsonobj{})
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	ts.backend.probes.now = func() time.Time { return now }
+	ts.SetTaskPolicies("task", "insurance")
+	probe := func(addr string, taskID string) {
+		req := ts.mkReq("login", jsonobj{"task-id": taskID})
+		req.Connection.RemoteAddr = addr
+		ts.HandleRequestError(req, "permission denied: task-not-running: task is not running")
+	}
+	withCount := func(count int, a jsonobj) jsonobj {
+		a["count"] = count
+		return a
+	}
+	periodic := func() {
+		ts.Require().NoError(ts.backend.periodic(context.Background(), &logical.Request{Storage: ts.storage}))
+	}
+
+	for i := 0; i < 5; i++ {
+		probe("10.0.0.2", fmt.Sprintf("task.abc-%d", i))
+	}
+	probe("10.0.0.3", "task.def-1")
+	periodic()
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "task-probe", "task.abc-0", "10.0.0.2", "task is unknown to Mesos"),
+		mkAlertData(2, "task-probe", "task.def-1", "10.0.0.3", "task is unknown to Mesos"),
+	})
+
+	now = now.Add(probeAlertInterval)
+	periodic()
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		withCount(5, mkAlertData(1, "task-probe", "task.abc-4", "10.0.0.2", "task is unknown to Mesos")),
+		mkAlertData(2, "task-probe", "task.def-1", "10.0.0.3", "task is unknown to Mesos"),
+	})
+	// Addresses with nothing left to record are forgotten.
+	ts.Len(ts.backend.probes.sources, 1)
+
+	now = now.Add(probeAlertInterval)
+	probe("10.0.0.2", "task.abc-5")
+	ts.Equal(ts.alertsData(jsonobj{"task-id": "task.abc-5"}), []jsonobj{
+		withCount(6, mkAlertData(1, "task-probe", "task.abc-5", "10.0.0.2", "task is unknown to Mesos")),
+	})
+}
+
+// A login from an address that isn't the task's agent's or container's
+// raises an alert, but still succeeds.
+func (ts *AlertsTests) Test_address_mismatch() {
+	tasks := []mesos.Task{}
+	containerIP := "192.168.0.5"
+	for _, id := range []string{"task.abc-123", "task.abc-124", "task.abc-125"} {
+		task := mkTask("task", id, mesos.TASK_RUNNING)
+		task.AgentID = mesos.AgentID{Value: "agent-1"}
+		task.Statuses = []mesos.TaskStatus{{
+			TaskID: task.TaskID,
+			State:  task.State,
+			ContainerStatus: &mesos.ContainerStatus{NetworkInfos: []mesos.NetworkInfo{{
+				IPAddresses: []mesos.NetworkInfo_IPAddress{{IPAddress: &containerIP}},
+			}}},
+		}}
+		tasks = append(tasks, task)
+	}
+	ts.SetupLoginTasks(jsonobj{}, tasks...)
+	ts.AddAgent(mesos.AgentInfo{Hostname: "10.0.0.1", ID: &mesos.AgentID{Value: "agent-1"}})
+
+	for id, addr := range map[string]string{"task.abc-123": "10.0.0.1", "task.abc-124": "192.168.0.5", "task.abc-125": "10.0.0.9"} {
+		req := ts.mkReq("login", jsonobj{"task-id": id})
+		req.Connection.RemoteAddr = addr
+		ts.WithoutError(ts.HandleRequestRaw(req))
+	}
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "address-mismatch", "task.abc-125", "10.0.0.9", "task addresses are 10.0.0.1,192.168.0.5"),
+	})
+}
+
+// Tasks on agents with DNS hostnames, and tasks whose traffic comes from
+// their agent's address (as it does with bridge networking), log in from the
+// address in their agent's PID without raising an alert.
+func (ts *AlertsTests) Test_address_agent_pid() {
+	tasks := []mesos.Task{}
+	for _, id := range []string{"task.abc-123", "task.abc-124"} {
+		task := mkTask("task", id, mesos.TASK_RUNNING)
+		task.AgentID = mesos.AgentID{Value: "agent-1"}
+		tasks = append(tasks, task)
+	}
+	ts.SetupLoginTasks(jsonobj{}, tasks...)
+	ts.AddAgent(mesos.AgentInfo{Hostname: "agent-1.example.com", ID: &mesos.AgentID{Value: "agent-1"}})
+	ts.SetAgentPID("agent-1", "slave(1)@10.0.0.1:5051")
+
+	for id, addr := range map[string]string{"task.abc-123": "10.0.0.1", "task.abc-124": "10.0.0.9"} {
+		req := ts.mkReq("login", jsonobj{"task-id": id})
+		req.Connection.RemoteAddr = addr
+		ts.WithoutError(ts.HandleRequestRaw(req))
+	}
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "address-mismatch", "task.abc-124", "10.0.0.9", "task addresses are 10.0.0.1"),
+	})
+}
+
+// Renewing a token for a task that is no longer running raises an alert.
+func (ts *AlertsTests) Test_dead_task_renewal() {
+	ts.SetupLoginTask("task.abc-123", jsonobj{})
+	auth := ts.Login("task.abc-123")
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_KILLED), "task.abc-123")
+	req := ts.mkRenew(auth)
+	req.Connection.RemoteAddr = "10.0.0.2"
+	ts.HandleRequestError(req, "task task.abc-123 not found during renewal")
+
+	ts.Equal(ts.alertsData(nil), []jsonobj{
+		mkAlertData(1, "dead-task-renewal", "task.abc-123", "10.0.0.2", "task not found during renewal"),
+	})
+}
+
+// Alerts can be filtered, listed, read individually and acknowledged.
+func (ts *AlertsTests) Test_list_read_ack() {
+	ts.SetupBackend()
+	rh := &requestHelper{ctx: context.Background(), storage: ts.storage, cache: ts.backend.cache}
+	ts.backend.raiseAlert(rh, alert{Kind: alertTaskProbe, TaskID: "task.abc-123", Prefix: "task", RemoteAddr: "10.0.0.1"})
+	ts.backend.raiseAlert(rh, alert{Kind: alertDuplicateLogin, TaskID: "task.abc-124", Prefix: "task"})
+	ts.backend.raiseAlert(rh, alert{Kind: alertTaskProbe, TaskID: "other.abc-123", Prefix: "other", RemoteAddr: "10.0.0.2"})
+
+	ts.Equal(ts.HandleRequest(ts.mkListReq("alerts/")).Data, jsonobj{
+		"keys": []string{"1", "2", "3"},
+		"key_info": map[string]interface{}{
+			"1": jsonobj{"kind": "task-probe", "task-id": "task.abc-123", "acknowledged": false},
+			"2": jsonobj{"kind": "duplicate-login", "task-id": "task.abc-124", "acknowledged": false},
+			"3": jsonobj{"kind": "task-probe", "task-id": "other.abc-123", "acknowledged": false},
+		},
+	})
+
+	ts.Equal(ts.alertsData(jsonobj{"kind": "task-probe", "prefix": "task"}), []jsonobj{
+		mkAlertData(1, "task-probe", "task.abc-123", "10.0.0.1", ""),
+	})
+	ts.Len(ts.alertsData(jsonobj{"task-id": "task.abc-124"}), 1)
+	req := ts.mkReadReq("alerts")
+	req.Data = jsonobj{"kind": "nonsense"}
+	ts.Equal(ts.HandleRequest(req), logical.ErrorResponse("invalid kind: nonsense"))
+
+	req = ts.mkReq("alerts/2/ack", jsonobj{})
+	req.DisplayName = "oncall"
+	data := ts.HandleRequestSuccess(req).Data
+	ts.Equal(data["acknowledged"], true)
+	ts.Equal(data["acknowledged-by"], "oncall")
+	ts.NotEmpty(data["acknowledged-at"])
+	ts.Equal(ts.HandleRequestSuccess(ts.mkReq("alerts/2/ack", jsonobj{})).Data, data)
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("alerts/2")).Data, data)
+
+	ts.Len(ts.alertsData(jsonobj{"acknowledged": false}), 2)
+	ts.Len(ts.alertsData(jsonobj{"acknowledged": true}), 1)
+
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("alerts/4")))
+	ts.Equal(ts.HandleRequest(ts.mkReq("alerts/4/ack", jsonobj{})), logical.ErrorResponse("no such alert: 4"))
+}
+
+// Only the most recent alerts are kept.
+func (ts *AlertsTests) Test_max_alerts() {
+	ts.SetupBackend()
+	rh := &requestHelper{ctx: context.Background(), storage: ts.storage, cache: ts.backend.cache}
+
+	for i := 0; i < maxAlerts+5; i++ {
+		ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: "test", TaskID: string('a' + rune(i%26))}))
+	}
+	alerts := ts.alertsData(nil)
+	ts.Len(alerts, maxAlerts)
+	ts.Equal(alerts[0]["id"], 6)
+	ts.Equal(alerts[0]["task-id"], "f")
+}
+
+// Task probes are dropped before other alerts, so probing can't push them
+// out.
+func (ts *AlertsTests) Test_max_alerts_probes_first() {
+	ts.SetupBackend()
+	rh := &requestHelper{ctx: context.Background(), storage: ts.storage, cache: ts.backend.cache}
+
+	ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertDuplicateLogin, TaskID: "first"}))
+	for i := 0; i < maxAlerts+5; i++ {
+		ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertTaskProbe, RemoteAddr: fmt.Sprint(i)}))
+	}
+	alerts := ts.alertsData(nil)
+	ts.Len(alerts, maxAlerts)
+	ts.Equal(alerts[0]["task-id"], "first")
+	ts.Equal(alerts[1]["id"], 8)
+}
+
+// Address mismatches are dropped before alerts other than task probes.
+func (ts *AlertsTests) Test_max_alerts_address_mismatches_next() {
+	ts.SetupBackend()
+	rh := &requestHelper{ctx: context.Background(), storage: ts.storage, cache: ts.backend.cache}
+
+	ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertDuplicateLogin, TaskID: "first"}))
+	ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertDeadTaskRenewal, TaskID: "second"}))
+	for i := 0; i < maxAlerts+5; i++ {
+		ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertAddressMismatch, RemoteAddr: fmt.Sprint(i)}))
+	}
+	ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertTaskProbe, TaskID: "probe"}))
+	ts.Require().NoError(ts.backend.recordAlert(rh, alert{Kind: alertDuplicateLogin, TaskID: "last"}))
+
+	alerts := ts.alertsData(nil)
+	ts.Len(alerts, maxAlerts)
+	ts.Equal(alerts[0]["task-id"], "first")
+	ts.Equal(alerts[1]["task-id"], "second")
+	ts.Equal(alerts[2]["id"], 11)
+	ts.Equal(alerts[maxAlerts-1]["task-id"], "last")
+}
@@ -4,7 +4,10 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
@@ -21,9 +24,18 @@ func pathLogin(b *mesosBackend) *framework.Path {
 		Pattern: "login",
 		Fields: map[string]*framework.FieldSchema{
 			"task-id": {Type: framework.TypeString},
+			"task-secret": {
+				Type:        framework.TypeString,
+				Description: "Secret derived from the task ID, required if the task's framework has a key.",
+			},
+			"secret-id": {
+				Type:        framework.TypeString,
+				Description: "Secret ID issued for the task ID, required if one has been issued or the task-policies entry says so.",
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
-			logical.UpdateOperation: b.pathLogin,
+			logical.UpdateOperation:         b.pathLogin,
+			logical.AliasLookaheadOperation: b.pathLoginAliasLookahead,
 		},
 	}
 }
@@ -40,7 +52,7 @@ func tiKey(taskPrefix string) string {
 
 // pathLogin (the method) is the "login" path request handler.
 func (b *mesosBackend) pathLogin(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	// Fetch the config first so we can return a configuration error before
 	// doing any other checks.
@@ -50,57 +62,86 @@ func (b *mesosBackend) pathLogin(ctx context.Context, req *logical.Request, d *f
 	}
 
 	taskID := d.Get("task-id").(string)
-	if taskID == "" {
-		return nil, logical.ErrPermissionDenied
-	}
 
-	prefix, err := taskIDPrefix(taskID)
-	if err != nil {
-		return nil, logical.ErrPermissionDenied
+	// A login without connection information is denied by evaluateLogin,
+	// but we still want to log and count it.
+	remoteAddr := ""
+	if req.Connection != nil {
+		remoteAddr = req.Connection.RemoteAddr
 	}
-
 	b.Logger().Info("LOGIN",
 		"task-id", taskID,
-		"prefix", prefix,
-		"RemoteAddr", req.Connection.RemoteAddr)
+		"RemoteAddr", remoteAddr)
+
+	defer b.measureSince(metricLogin, time.Now(), nil)
+	b.incrCounter(metricLoginAttempt, nil)
 
-	policies, err := rh.getTaskPolicies(prefix)
+	ld, err := b.limitLogin(cfg, taskID, remoteAddr)
+	if err == nil {
+		ld, err = b.evaluateLogin(ctx, &rh, cfg, taskID, req.Connection, loginSecretsFromData(d), false)
+	}
+	b.recordLoginResult(cfg, ld, remoteAddr)
 	if err != nil {
-		return nil, err
+		b.logDenial(ld, remoteAddr)
+		switch {
+		case ld.denial.reason == denyAlreadyLoggedIn:
+			if err := b.respondToDuplicateLogin(&rh, cfg, ld, remoteAddr); err != nil {
+				return nil, err
+			}
+		case ld.unknownTask:
+			b.raiseProbeAlert(&rh, taskID, ld.prefix, remoteAddr)
+		}
+		labels := append(ld.metricLabels(), metrics.Label{Name: "reason", Value: string(ld.denial.reason)})
+		b.incrCounter(metricLoginDenied, labels)
+		return nil, denialError(cfg, ld, err)
 	}
-
-	// TODO: Clean out stale entries.
-	if err := rh.verifyTaskNotLoggedIn(taskID, prefix); err != nil {
+	policies := ld.policies
+	b.checkLoginAddress(&rh, cfg, ld, remoteAddr)
+
+	ti := taskIdentity{prefix: ld.prefix, task: ld.task, framework: ld.framework, agent: ld.agent}
+	alias := ti.aliasName(cfg.AliasSource)
+
+	auth := &logical.Auth{
+		Policies:     policies,
+		DisplayName:  alias,
+		Alias:        &logical.Alias{Name: alias},
+		GroupAliases: ti.groupAliases(cfg.GroupAliasLabels),
+		Metadata:     ti.metadata(cfg.MetadataLabels),
+		// Stash task-id so we can check it again for renewals, along with
+		// what we granted so we can tell if it changes.
+		InternalData: jsonobj{
+			"task-id":       taskID,
+			"policies":      policies,
+			"policy-source": ld.policySource,
+		},
+	}
+	if err := ld.tp.tokenSettings.apply(auth, cfg.Period); err != nil {
 		return nil, err
 	}
 
-	// Calling Mesos is expensive, so only do it if everything else is okay.
-	mc := mesosclient.NewClient(cfg.BaseURL)
-	rgt, err := mc.GetTasks(ctx)
+	b.incrCounter(metricLoginSuccess, ld.metricLabels())
+	return &logical.Response{Auth: auth}, nil
+}
+
+// authRenew is the renew callback for tokens created by this plugin. It does
+// the renewal in renew and records metrics for it.
+func (b *mesosBackend) authRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	labels := renewalMetricLabels(req.Auth)
+	defer b.measureSince(metricRenew, time.Now(), labels)
+	b.incrCounter(metricRenewAttempt, labels)
+
+	resp, err := b.renew(ctx, req)
 	if err != nil {
+		b.incrCounter(metricRenewFailure, labels)
 		return nil, err
 	}
-
-	if !b.verifyTaskExists(taskID, rgt) {
-		return nil, logical.ErrPermissionDenied
-	}
-
-	return &logical.Response{
-		Auth: &logical.Auth{
-			Policies: policies,
-			Period:   cfg.Period,
-			LeaseOptions: logical.LeaseOptions{
-				Renewable: true,
-			},
-			// Stash task-id so we can check it again for renewals.
-			InternalData: jsonobj{"task-id": taskID},
-		},
-	}, nil
+	b.incrCounter(metricRenewSuccess, labels)
+	return resp, nil
 }
 
-// authRenew is the renew callback for tokens created by this plugin.
-func (b *mesosBackend) authRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+// renew checks that a token may be renewed and builds the renewed auth.
+func (b *mesosBackend) renew(ctx context.Context, req *logical.Request) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	// Fetch the config first so we can return a configuration error before
 	// doing any other checks.
@@ -122,72 +163,262 @@ func (b *mesosBackend) authRenew(ctx context.Context, req *logical.Request, d *f
 		"RemoteAddr", req.Connection.RemoteAddr,
 		"auth", fmt.Sprintf("%#v", req.Auth))
 
-	// TODO: Fail the renewal if the policy config has been removed or updated?
+	// Renewals are only frozen if the freeze says so. A malformed task ID
+	// can't have been issued a token, so we don't care about the error.
+	frozen := cfg.Freeze != nil && cfg.Freeze.Renewals
+	prefix, _ := taskIDPrefix(taskID) // #nosec G104
+	if frozen && cfg.Freeze.blocksPrefix(prefix) {
+		return nil, b.denyFrozenRenewal(taskID, cfg.Freeze)
+	}
 
-	mc := mesosclient.NewClient(cfg.BaseURL)
-	rgt, err := mc.GetTasks(ctx)
+	q, err := rh.getQuarantineOrNil(taskID)
+	if err != nil {
+		return nil, err
+	}
+	if q != nil {
+		b.Logger().Warn("RENEW DENIED", "task-id", taskID, "reason", "quarantined: "+q.Reason)
+		if q.Revoke && req.Auth.Accessor != "" {
+			b.revokeQuarantinedToken(cfg, taskID, req.Auth.Accessor)
+		}
+		return nil, fmt.Errorf("task %s is quarantined", taskID)
+	}
+
+	tp, err := rh.getRenewalTaskPolicies(cfg, req.Auth, taskID)
+	if err != nil {
+		b.Logger().Info("RENEW DENIED", "task-id", taskID, "reason", err.Error())
+		return nil, err
+	}
+
+	if err := tp.tokenSettings.verifyMaxTTL(req.Auth); err != nil {
+		return nil, err
+	}
+
+	src, err := b.taskSource(ctx, cfg, b.mesosClient(cfg), req.Connection.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	if src == nil {
+		b.Logger().Warn("RENEW DENIED", "task-id", taskID, "reason", "no Mesos agent at remote address")
+		return nil, fmt.Errorf("no Mesos agent at address %q", req.Connection.RemoteAddr)
+	}
+	rgt, err := src.getTasks(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	if !b.verifyTaskExists(taskID, rgt) {
+	task := b.findRunningTask(taskID, rgt)
+	if task == nil {
+		// A token outliving its task is expected now and then, but it may
+		// also have been stolen, so it's worth a look.
+		b.raiseAlert(&rh, alert{
+			Kind:       alertDeadTaskRenewal,
+			TaskID:     taskID,
+			Prefix:     prefix,
+			RemoteAddr: req.Connection.RemoteAddr,
+			Reason:     "task not found during renewal",
+		})
 		return nil, fmt.Errorf("task %s not found during renewal", taskID)
 	}
 
+	fw, err := src.getFramework(ctx, task.FrameworkID.Value)
+	if err != nil {
+		return nil, err
+	}
+	if frozen && cfg.Freeze.blocksFramework(fw) {
+		return nil, b.denyFrozenRenewal(taskID, cfg.Freeze)
+	}
+	ti := taskIdentity{task: task, framework: fw}
+
+	policies, err := rh.grantedPolicies(tp, task, fw)
+	if err != nil {
+		return nil, err
+	}
+	decision, err := checkPolicyChange(cfg.RenewalPolicyChange, issuedPolicies(req.Auth), policies)
+	if err != nil {
+		b.Logger().Info("RENEW DENIED", "task-id", taskID, "reason", err.Error())
+		return nil, err
+	}
+
 	// We make a (shallow) copy of the Auth struct from the request so that we
-	// can update the renewal period (in case the config has changed since last
-	// time) without modifying the request data.
+	// can update the token settings and group aliases (in case the config has
+	// changed since last time) without modifying the request data. The
+	// internal data gets a copy of its own so we can record the policy check.
 	auth := *req.Auth
-	auth.Period = cfg.Period
+	if err := tp.tokenSettings.apply(&auth, cfg.Period); err != nil {
+		return nil, err
+	}
+	auth.GroupAliases = ti.groupAliases(cfg.GroupAliasLabels)
+	auth.InternalData = jsonobj{}
+	for k, v := range req.Auth.InternalData {
+		auth.InternalData[k] = v
+	}
+	auth.InternalData["policy-check"] = decision
 
 	return &logical.Response{Auth: &auth}, nil
 }
 
-// verifyTaskExists checks that a taskID is valid and identifies an existing
-// task.
-func (b *mesosBackend) verifyTaskExists(taskID string, rgt *master.Response_GetTasks) bool {
+// findRunningTask returns the running task identified by taskID, or nil if
+// there is no such task.
+func (b *mesosBackend) findRunningTask(taskID string, rgt *master.Response_GetTasks) *mesos.Task {
 	// For our purposes, any running task will be in the TASK_RUNNING state or
 	// one of the unreachable states. We start with the most likely case.
-	for _, task := range rgt.Tasks {
+	for i, task := range rgt.Tasks {
 		if *task.State == mesos.TASK_RUNNING && task.TaskID.Value == taskID {
-			return true
+			return &rgt.Tasks[i]
 		}
 	}
 
 	// TODO: Check unreachable tasks. Do we want to do this differently for
 	// login vs renewal?
 
+	return nil
+}
+
+// taskKnown checks whether Mesos knows about a task in any state.
+func taskKnown(taskID string, rgt *master.Response_GetTasks) bool {
+	for _, tasks := range [][]mesos.Task{rgt.Tasks, rgt.PendingTasks, rgt.CompletedTasks, rgt.OrphanTasks, rgt.UnreachableTasks} {
+		for _, task := range tasks {
+			if task.TaskID.Value == taskID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// terminalTaskStates lists the states a task never leaves.
+var terminalTaskStates = []mesos.TaskState{
+	mesos.TASK_FINISHED,
+	mesos.TASK_FAILED,
+	mesos.TASK_KILLED,
+	mesos.TASK_ERROR,
+	mesos.TASK_LOST,
+	mesos.TASK_DROPPED,
+	mesos.TASK_GONE,
+	mesos.TASK_GONE_BY_OPERATOR,
+}
+
+// taskTerminated checks whether Mesos knows a task has finished for good.
+func taskTerminated(taskID string, rgt *master.Response_GetTasks) bool {
+	for _, task := range rgt.CompletedTasks {
+		if task.TaskID.Value != taskID || task.State == nil {
+			continue
+		}
+		for _, state := range terminalTaskStates {
+			if *task.State == state {
+				return true
+			}
+		}
+	}
 	return false
 }
 
 // verifyTaskNotLoggedIn checks that a taskID is not already logged in and
-// marks it as logged in for next time.
-func (rh *requestHelper) verifyTaskNotLoggedIn(taskID string, prefix string) error {
+// marks it as logged in for next time. It returns the number of taskIDs now
+// recorded for the prefix.
+func (rh *requestHelper) verifyTaskNotLoggedIn(taskID string, prefix string) (int, error) {
 	instances, err := rh.getTaskInstances(prefix)
 	if err != nil {
 		// noqa: (Not actually a tag that does anything, sadly.)
-		return err
+		return 0, err
 	}
 	if instances[taskID] {
 		// This task has already logged in.
-		return logical.ErrPermissionDenied
+		return len(instances), logical.ErrPermissionDenied
 	}
 
 	instances[taskID] = true
-	return rh.store(tiKey(prefix), taskInstances{TaskIDs: instances})
+	return len(instances), rh.store(tiKey(prefix), taskInstances{TaskIDs: instances})
 }
 
-// getTaskPolicies fetches the policies for a taskID prefix.
-func (rh *requestHelper) getTaskPolicies(taskPrefix string) ([]string, error) {
-	var tp taskPolicies
+// getTaskPoliciesOrNil fetches the policies for a taskID prefix, returning nil
+// if there are none.
+func (rh *requestHelper) getTaskPoliciesOrNil(taskPrefix string) (*taskPolicies, error) {
+	var tp *taskPolicies
 	decode := func(se *logical.StorageEntry) error {
 		if se == nil {
-			return logical.ErrPermissionDenied
+			return nil
 		}
-		return se.DecodeJSON(&tp)
+		tp = &taskPolicies{}
+		return se.DecodeJSON(tp)
 	}
 	err := rh.fetch(tpKey(taskPrefix), decode)
-	return tp.Policies, err
+	return tp, err
+}
+
+// getRenewalTaskPolicies fetches the current policy mapping for a task being
+// renewed. If the token was issued the default policies, those are used
+// instead when there is still no mapping. A mapping that has been removed
+// since login is an error.
+func (rh *requestHelper) getRenewalTaskPolicies(cfg *config, auth *logical.Auth, taskID string) (*taskPolicies, error) {
+	prefix, err := taskIDPrefix(taskID)
+	if err != nil {
+		return nil, err
+	}
+	tp, err := rh.getTaskPoliciesOrNil(prefix)
+	if err != nil || tp != nil {
+		return tp, err
+	}
+	if auth.InternalData["policy-source"] == policySourceDefaultPolicies && len(cfg.DefaultPolicies) > 0 {
+		return &taskPolicies{Policies: cfg.DefaultPolicies}, nil
+	}
+	return nil, fmt.Errorf("task-policies for %s have been removed", prefix)
+}
+
+// grantedPolicies combines the policies from a task's policy mapping with any
+// mapped to its Mesos roles and framework principal.
+func (rh *requestHelper) grantedPolicies(tp *taskPolicies, task *mesos.Task, fw *mesos.FrameworkInfo) ([]string, error) {
+	mesosPolicies, err := rh.getMesosPolicies(task, fw)
+	if err != nil {
+		return nil, err
+	}
+	if len(mesosPolicies) == 0 {
+		return tp.Policies, nil
+	}
+	// RemoveDuplicates sorts in place, so we mustn't let it near tp.Policies.
+	policies := append(append([]string{}, tp.Policies...), mesosPolicies...)
+	return strutil.RemoveDuplicates(policies, false), nil
+}
+
+// getFramework fetches the framework with the given ID from Mesos, returning
+// nil if Mesos doesn't know about it.
+func (b *mesosBackend) getFramework(ctx context.Context, mc *mesosclient.Client, frameworkID string) (*mesos.FrameworkInfo, error) {
+	rgf, err := mc.GetFrameworks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return findFramework(frameworkID, rgf), nil
+}
+
+// getAgent fetches the agent with the given ID from Mesos, returning nil if
+// Mesos doesn't know about it.
+func (b *mesosBackend) getAgent(ctx context.Context, mc *mesosclient.Client, agentID string) (*mesos.AgentInfo, error) {
+	rga, err := mc.GetAgents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i, agent := range rga.Agents {
+		if agent.AgentInfo.ID != nil && agent.AgentInfo.ID.Value == agentID {
+			return &rga.Agents[i].AgentInfo, nil
+		}
+	}
+	return nil, nil
+}
+
+// taskImage returns the container image a task is running, whether it uses
+// the Docker containerizer or the Mesos containerizer with a Docker image. A
+// task without a container image gets an empty string.
+func taskImage(task *mesos.Task) string {
+	container := task.Container
+	switch {
+	case container == nil:
+		return ""
+	case container.Docker != nil:
+		return container.Docker.Image
+	case container.Mesos != nil && container.Mesos.Image != nil && container.Mesos.Image.Docker != nil:
+		return container.Mesos.Image.Docker.Name
+	}
+	return ""
 }
 
 // getTaskInstances fetches the policies for a taskID prefix.
@@ -1,9 +1,11 @@
 package mesosauth
 
 import (
+	"net/http"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/vault/helper/parseutil"
 	"github.com/hashicorp/vault/logical"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
 	"github.com/stretchr/testify/suite"
@@ -56,6 +58,66 @@ func (ts *AuthTests) Test_login_unregistered_taskID() {
 	ts.HandleRequestError(req, "permission denied")
 }
 
+// A task with no policies configured for its prefix gets the default policies
+// if its framework is allowed them.
+func (ts *AuthTests) Test_login_default_policies() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"default-policies":   "read-own-namespace",
+		"default-frameworks": "marathon",
+	}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("unregistered", "unregistered-task.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+
+	auth := ts.Login("unregistered-task.abc-123")
+	ts.Equal(auth.Policies, []string{"read-own-namespace"})
+
+	// Replay protection still applies.
+	req := ts.mkReq("login", jsonobj{"task-id": "unregistered-task.abc-123"})
+	ts.HandleRequestError(req, "permission denied")
+}
+
+// A task with policies configured for its prefix doesn't get the default
+// policies.
+func (ts *AuthTests) Test_login_default_policies_not_used() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"default-policies":   "read-own-namespace",
+		"default-frameworks": "marathon",
+	}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("registered", "registered-task.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("registered-task", "insurance")
+
+	auth := ts.Login("registered-task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+}
+
+// A task can't get the default policies if its framework isn't allowed them
+// or is unknown.
+func (ts *AuthTests) Test_login_default_policies_bad_framework() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"default-policies":   "read-own-namespace",
+		"default-frameworks": "marathon",
+	}))
+	ts.AddFramework(mkFramework("chronos", "fw-2", ""))
+	task1 := mkTask("unregistered", "unregistered-task.abc-123", mesos.TASK_RUNNING)
+	task1.FrameworkID = mesos.FrameworkID{Value: "fw-2"}
+	task2 := mkTask("unregistered", "unregistered-task.abc-124", mesos.TASK_RUNNING)
+	task2.FrameworkID = mesos.FrameworkID{Value: "fw-3"}
+	ts.AddTask(task1, task2)
+
+	req := ts.mkReq("login", jsonobj{"task-id": "unregistered-task.abc-123"})
+	ts.HandleRequestError(req, "permission denied")
+	req = ts.mkReq("login", jsonobj{"task-id": "unregistered-task.abc-124"})
+	ts.HandleRequestError(req, "permission denied")
+}
+
 // Can log in with a taskID that exists and has policies configured for its
 // prefix.
 func (ts *AuthTests) Test_login_good_taskID() {
@@ -70,12 +132,178 @@ func (ts *AuthTests) Test_login_good_taskID() {
 	ts.Nil(resp.Secret)
 	ts.Equal(resp.Auth, &logical.Auth{
 		Policies:     []string{"insurance"},
+		DisplayName:  "task-that-exists",
+		Alias:        &logical.Alias{Name: "task-that-exists"},
+		Metadata:     mkMetadata("task-that-exists.abc-123", "existing"),
 		Period:       10 * time.Minute,
 		LeaseOptions: logical.LeaseOptions{Renewable: true},
-		InternalData: jsonobj{"task-id": "task-that-exists.abc-123"},
+		InternalData: mkInternalData("task-that-exists.abc-123", "insurance"),
+	})
+}
+
+// Login metadata includes details about the task's framework and agent and
+// any configured labels.
+func (ts *AuthTests) Test_login_metadata() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"metadata-labels": "team,env,missing"}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	ts.AddAgent(mesos.AgentInfo{Hostname: "agent1.example.com", ID: &mesos.AgentID{Value: "agent-1"}})
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	task.AgentID = mesos.AgentID{Value: "agent-1"}
+	task.Labels = &mesos.Labels{Labels: []mesos.Label{
+		{Key: "team", Value: strptr("platform")},
+		{Key: "env"},
+		{Key: "secret", Value: strptr("hunter2")},
+	}}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("team_web", "insurance")
+
+	auth := ts.Login("team_web.abc-123")
+	ts.Equal(auth.Metadata, map[string]string{
+		"task-id":        "team_web.abc-123",
+		"task-name":      "web",
+		"task-prefix":    "team_web",
+		"framework-id":   "fw-1",
+		"framework-name": "marathon",
+		"agent-id":       "agent-1",
+		"agent-hostname": "agent1.example.com",
+		"label-team":     "platform",
+		"label-env":      "",
+	})
+}
+
+// Login emits group aliases for the framework, roles and configured labels.
+func (ts *AuthTests) Test_login_group_aliases() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"group-alias-labels": "team"}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	task.Resources = []mesos.Resource{mkResource("cpus", "web")}
+	task.Labels = &mesos.Labels{Labels: []mesos.Label{{Key: "team", Value: strptr("platform")}}}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("team_web", "insurance")
+
+	auth := ts.Login("team_web.abc-123")
+	ts.Equal(auth.GroupAliases, []*logical.Alias{
+		{Name: "framework:marathon"},
+		{Name: "role:web"},
+		{Name: "label:team=platform"},
 	})
 }
 
+// The identity alias can be built from different task details.
+func (ts *AuthTests) Test_login_alias_sources() {
+	ts.SetupBackendWithMesos()
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("team_web", "insurance")
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"alias-source": "app-id"}))
+	auth := ts.Login("team_web.abc-123")
+	ts.Equal(auth.Alias, &logical.Alias{Name: "/team/web"})
+	ts.Equal(auth.DisplayName, "/team/web")
+
+	// We have to clear the task instances so we can log in again.
+	ts.DeleteStored(tiKey("team_web"))
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"alias-source": "framework-task-name"}))
+	auth = ts.Login("team_web.abc-123")
+	ts.Equal(auth.Alias, &logical.Alias{Name: "marathon/web"})
+}
+
+// Policies mapped to the task's Mesos roles are added to the prefix policies.
+func (ts *AuthTests) Test_login_role_policies() {
+	ts.SetupBackendWithMesos()
+	task := mkTask("web", "web-task.abc-123", mesos.TASK_RUNNING)
+	task.Resources = []mesos.Resource{mkResource("cpus", "web"), mkResource("mem", "eng/web")}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("web-task", "insurance")
+	ts.SetRolePolicies("web", "foreign", "insurance")
+	ts.SetRolePolicies("eng/web", "domestic")
+	ts.SetRolePolicies("batch", "wheel")
+
+	auth := ts.Login("web-task.abc-123")
+	ts.Equal(auth.Policies, []string{"domestic", "foreign", "insurance"})
+}
+
+// Policies mapped to the task's framework principal are added to the prefix
+// policies.
+func (ts *AuthTests) Test_login_principal_policies() {
+	ts.SetupBackendWithMesos()
+	ts.AddFramework(mkFramework("marathon", "fw-1", "marathon-principal"))
+	task := mkTask("web", "web-task.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("web-task", "insurance")
+	ts.SetPrincipalPolicies("marathon-principal", "foreign")
+	ts.SetPrincipalPolicies("chronos-principal", "wheel")
+
+	auth := ts.Login("web-task.abc-123")
+	ts.Equal(auth.Policies, []string{"foreign", "insurance"})
+}
+
+// A task whose framework is unknown to Mesos gets no principal policies.
+func (ts *AuthTests) Test_login_principal_policies_unknown_framework() {
+	ts.SetupBackendWithMesos()
+	task := mkTask("web", "web-task.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("web-task", "insurance")
+	ts.SetPrincipalPolicies("marathon-principal", "foreign")
+
+	auth := ts.Login("web-task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+}
+
+// A task running an allowed Docker image can log in.
+func (ts *AuthTests) Test_login_allowed_docker_image() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkDockerTask("web", "web-task.abc-123", "nginx:1.15"))
+	ts.SetTaskImagePolicies("web-task", "nginx:*", "insurance")
+
+	auth := ts.Login("web-task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+}
+
+// A task running an allowed image with the Mesos containerizer can log in.
+func (ts *AuthTests) Test_login_allowed_mesos_image() {
+	ts.SetupBackendWithMesos()
+	task := mkTask("web", "web-task.abc-123", mesos.TASK_RUNNING)
+	mesosType := mesos.ContainerInfo_MESOS
+	dockerType := mesos.Image_DOCKER
+	task.Container = &mesos.ContainerInfo{
+		Type: &mesosType,
+		Mesos: &mesos.ContainerInfo_MesosInfo{
+			Image: &mesos.Image{
+				Type:   &dockerType,
+				Docker: &mesos.Image_Docker{Name: "nginx@sha256:0123abcd"},
+			},
+		},
+	}
+	ts.AddTask(task)
+	ts.SetTaskImagePolicies("web-task", "sha256:0123abcd", "insurance")
+
+	auth := ts.Login("web-task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+}
+
+// A task running a disallowed image (or no image at all) can't log in.
+func (ts *AuthTests) Test_login_disallowed_image() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(
+		mkDockerTask("web", "web-task.abc-123", "evil/miner:latest"),
+		mkTask("web", "web-task.abc-124", mesos.TASK_RUNNING))
+	ts.SetTaskImagePolicies("web-task", "nginx:*", "insurance")
+
+	req := ts.mkReq("login", jsonobj{"task-id": "web-task.abc-123"})
+	ts.HandleRequestError(req, "permission denied")
+	req = ts.mkReq("login", jsonobj{"task-id": "web-task.abc-124"})
+	ts.HandleRequestError(req, "permission denied")
+}
+
 // Can't log in more than once with the same taskID.
 func (ts *AuthTests) Test_login_only_once() {
 	ts.SetupBackendWithMesos()
@@ -89,6 +317,28 @@ func (ts *AuthTests) Test_login_only_once() {
 	ts.HandleRequestError(req, "permission denied")
 }
 
+// Denied logins don't say why unless the config tells us to expose denial
+// reasons, in which case they're still permission denied errors.
+func (ts *AuthTests) Test_login_expose_denial_reasons() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(
+		mkDockerTask("web", "web-task.abc-123", "evil/miner:latest"),
+		mkDockerTask("web", "web-task.abc-124", "evil/miner:latest"))
+	ts.SetTaskImagePolicies("web-task", "nginx:*", "insurance")
+
+	req := ts.mkReq("login", jsonobj{"task-id": "web-task.abc-123"})
+	ts.HandleRequestError(req, "permission denied")
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"expose-denial-reasons": true}))
+	_, err := ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": "web-task.abc-124"}))
+	ts.Equal(logical.CodedError(http.StatusForbidden,
+		`permission denied: image-not-allowed: image "evil/miner:latest" not allowed`), err)
+
+	_, err = ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": "no-prefix"}))
+	ts.Equal(logical.CodedError(http.StatusForbidden,
+		`permission denied: malformed-task-id: malformed task-id: "no-prefix"`), err)
+}
+
 // A task that is not yet running can't log in.
 func (ts *AuthTests) Test_login_staging_task() {
 	ts.SetupBackendWithMesos()
@@ -98,6 +348,24 @@ func (ts *AuthTests) Test_login_staging_task() {
 	ts.HandleRequestError(req, "permission denied")
 }
 
+// A task that tries to log in before it's running isn't recorded as logged
+// in, so it can log in once it is running.
+func (ts *AuthTests) Test_login_before_running() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("early", "early-task.abc-123", mesos.TASK_STAGING))
+	ts.SetTaskPolicies("early-task", "insurance")
+
+	req := ts.mkReq("login", jsonobj{"task-id": "early-task.abc-123"})
+	ts.HandleRequestError(req, "permission denied")
+
+	ts.UpdateTask(func(task *mesos.Task) {
+		state := mesos.TASK_RUNNING
+		task.State = &state
+	}, "early-task.abc-123")
+	auth := ts.Login("early-task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+}
+
 // A failed task can't log in.
 func (ts *AuthTests) Test_login_failed_task() {
 	ts.SetupBackendWithMesos()
@@ -117,12 +385,84 @@ func (ts *AuthTests) Test_login_period_configurable() {
 	resp := ts.HandleRequest(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}))
 	ts.Equal(resp.Auth, &logical.Auth{
 		Policies:     []string{"insurance"},
+		DisplayName:  "task",
+		Alias:        &logical.Alias{Name: "task"},
+		Metadata:     mkMetadata("task.abc-123", "task"),
 		Period:       7 * time.Minute,
 		LeaseOptions: logical.LeaseOptions{Renewable: true},
-		InternalData: jsonobj{"task-id": "task.abc-123"},
+		InternalData: mkInternalData("task.abc-123", "insurance"),
+	})
+}
+
+// Token settings for a task prefix override the default period.
+func (ts *AuthTests) Test_login_token_settings() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskTokenPolicies("task", jsonobj{
+		"period":           "5m",
+		"explicit-max-ttl": "2h",
+		"num-uses":         3,
+		"bound-cidrs":      "10.0.0.0/8",
+	}, "insurance")
+
+	boundCIDRs, err := parseutil.ParseAddrs([]string{"10.0.0.0/8"})
+	ts.Require().NoError(err)
+
+	resp := ts.HandleRequest(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}))
+	ts.Equal(resp.Auth, &logical.Auth{
+		Policies:       []string{"insurance"},
+		DisplayName:    "task",
+		Alias:          &logical.Alias{Name: "task"},
+		Metadata:       mkMetadata("task.abc-123", "task"),
+		Period:         5 * time.Minute,
+		ExplicitMaxTTL: 2 * time.Hour,
+		NumUses:        3,
+		BoundCIDRs:     boundCIDRs,
+		LeaseOptions:   logical.LeaseOptions{Renewable: true},
+		InternalData:   mkInternalData("task.abc-123", "insurance"),
 	})
 }
 
+// A task prefix with a TTL and no period gets non-periodic tokens.
+func (ts *AuthTests) Test_login_token_ttl() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskTokenPolicies("task", jsonobj{"ttl": "10m", "max-ttl": "1h"}, "insurance")
+
+	auth := ts.Login("task.abc-123")
+	ts.Equal(auth.Period, time.Duration(0))
+	ts.Equal(auth.LeaseOptions, logical.LeaseOptions{
+		TTL:       10 * time.Minute,
+		MaxTTL:    time.Hour,
+		Renewable: true,
+	})
+}
+
+// Batch tokens can't be renewed.
+func (ts *AuthTests) Test_login_token_batch() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskTokenPolicies("task", jsonobj{"ttl": "10m", "token-type": "batch"}, "insurance")
+
+	auth := ts.Login("task.abc-123")
+	ts.Equal(auth.Period, time.Duration(0))
+	ts.Equal(auth.LeaseOptions, logical.LeaseOptions{TTL: 10 * time.Minute})
+}
+
+// Batch tokens must have a TTL of their own, so that they don't silently get
+// the mount's default TTL instead.
+func (ts *AuthTests) Test_login_token_batch_without_ttl() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	params := tpParams("task", []string{"insurance"})
+	params["token-type"] = "batch"
+	resp := ts.HandleRequest(ts.mkReq("task-policies", params))
+	ts.EqualError(resp.Error(), "batch tokens require a ttl")
+
+	_, err := ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}))
+	ts.EqualError(err, "permission denied")
+}
+
 // Can't log in with an unconfigured backend or bad Mesos.
 func (ts *AuthTests) Test_login_unconfigured_or_bad() {
 	ts.SetupBackend()
@@ -134,22 +474,57 @@ func (ts *AuthTests) Test_login_unconfigured_or_bad() {
 	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}), errmsg)
 }
 
+////////////////////////////////
+// Tests for alias lookahead. //
+////////////////////////////////
+
+// mkLookahead builds an alias lookahead request.
+func (ts *AuthTests) mkLookahead(taskID string) *logical.Request {
+	req := ts.mkReq("login", jsonobj{"task-id": taskID})
+	req.Operation = logical.AliasLookaheadOperation
+	return req
+}
+
+// Alias lookahead returns the alias without logging in.
+func (ts *AuthTests) Test_lookahead_task_prefix() {
+	ts.SetupBackendWithMesos()
+	ts.SetTaskPolicies("team_web", "insurance")
+
+	// There is no such task, but we don't need to ask Mesos for the default
+	// alias source.
+	resp := ts.HandleRequest(ts.mkLookahead("team_web.abc-123"))
+	ts.Equal(resp.Auth, &logical.Auth{Alias: &logical.Alias{Name: "team_web"}})
+	ts.Nil(ts.GetStored(tiKey("team_web")))
+
+	ts.HandleRequestError(ts.mkLookahead("abc-123"), "permission denied")
+	ts.HandleRequestError(ts.mkLookahead(""), "permission denied")
+}
+
+// Alias lookahead asks Mesos for the task details if it needs them.
+func (ts *AuthTests) Test_lookahead_framework_task_name() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"alias-source": "framework-task-name"}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+
+	resp := ts.HandleRequest(ts.mkLookahead("team_web.abc-123"))
+	ts.Equal(resp.Auth, &logical.Auth{Alias: &logical.Alias{Name: "marathon/web"}})
+
+	ts.HandleRequestError(ts.mkLookahead("team_web.abc-124"), "permission denied")
+}
+
+// Alias lookahead requires a configured backend.
+func (ts *AuthTests) Test_lookahead_unconfigured() {
+	ts.SetupBackend()
+	ts.HandleRequestError(ts.mkLookahead("task.abc-123"), "backend not configured")
+}
+
 ////////////////////////
 // Tests for renewal. //
 ////////////////////////
 
-// mkRenew builds a renewal request.
-func (ts *AuthTests) mkRenew(auth *logical.Auth) *logical.Request {
-	return &logical.Request{
-		Operation:       "renew",
-		Path:            "login",
-		Auth:            auth,
-		Unauthenticated: false,
-		Storage:         ts.storage,
-		Connection:      &logical.Connection{},
-	}
-}
-
 // Can't renew if you're not logged in.
 func (ts *AuthTests) Test_renewal_not_logged_in() {
 	ts.SetupBackendWithMesos()
@@ -178,7 +553,33 @@ func (ts *AuthTests) Test_renewal_logged_in() {
 	auth := ts.Login("logged-in-task.abc-123")
 
 	resp := ts.HandleRequest(ts.mkRenew(auth))
-	ts.Equal(auth, resp.Auth)
+	ts.Equal(resp.Auth.Policies, auth.Policies)
+	ts.Equal(resp.Auth.InternalData["policy-check"], "unchanged")
+	// The original login auth is unmodified.
+	ts.Nil(auth.InternalData["policy-check"])
+}
+
+// Renewal refreshes the group aliases.
+func (ts *AuthTests) Test_renewal_group_aliases() {
+	ts.SetupBackendWithMesos()
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	task.Labels = &mesos.Labels{Labels: []mesos.Label{{Key: "team", Value: strptr("platform")}}}
+	ts.AddTask(task)
+	ts.SetTaskPolicies("team_web", "insurance")
+	auth := ts.Login("team_web.abc-123")
+	ts.Equal(auth.GroupAliases, []*logical.Alias{{Name: "framework:marathon"}})
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"group-alias-labels": "team"}))
+
+	resp := ts.HandleRequest(ts.mkRenew(auth))
+	ts.Equal(resp.Auth.GroupAliases, []*logical.Alias{
+		{Name: "framework:marathon"},
+		{Name: "label:team=platform"},
+	})
+	// The original login auth is unmodified.
+	ts.Equal(auth.GroupAliases, []*logical.Alias{{Name: "framework:marathon"}})
 }
 
 // Can't renew if your task is finished.
@@ -209,6 +610,111 @@ func (ts *AuthTests) Test_renewal_period_configurable() {
 	ts.Equal(auth.Period, 10*time.Minute)
 }
 
+// Can't renew if the task-policies entry has been removed.
+func (ts *AuthTests) Test_renewal_task_policies_removed() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	auth := ts.Login("task.abc-123")
+
+	ts.DeleteStored(tpKey("task"))
+
+	ts.HandleRequestError(ts.mkRenew(auth), "task-policies for task have been removed")
+}
+
+// By default, can't renew if the task-policies entry has changed.
+func (ts *AuthTests) Test_renewal_task_policies_changed() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	auth := ts.Login("task.abc-123")
+
+	ts.SetTaskPolicies("task", "insurance", "foreign")
+
+	ts.HandleRequestError(ts.mkRenew(auth), "policies have changed since login: [foreign] added")
+}
+
+// With reject-removed, can renew if the task-policies entry now grants more,
+// and the decision is recorded.
+func (ts *AuthTests) Test_renewal_reject_removed_gained() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"renewal-policy-change": "reject-removed"}))
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	auth := ts.Login("task.abc-123")
+
+	ts.SetTaskPolicies("task", "insurance", "foreign")
+
+	resp := ts.HandleRequest(ts.mkRenew(auth))
+	// The token keeps the policies it was issued with.
+	ts.Equal(resp.Auth.Policies, []string{"insurance"})
+	ts.Equal(resp.Auth.InternalData["policy-check"], policyCheckGained)
+}
+
+// With reject-removed, can't renew a token that has policies we no longer
+// grant.
+func (ts *AuthTests) Test_renewal_reject_removed_lost() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"renewal-policy-change": "reject-removed"}))
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance", "foreign")
+	auth := ts.Login("task.abc-123")
+
+	ts.SetTaskPolicies("task", "insurance")
+
+	ts.HandleRequestError(ts.mkRenew(auth), "token has policies that are no longer granted: [foreign]")
+}
+
+// A token issued the default policies can be renewed while the prefix still
+// has no task-policies entry.
+func (ts *AuthTests) Test_renewal_default_policies() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"default-policies":   "read-own-namespace",
+		"default-frameworks": "marathon",
+	}))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	task := mkTask("unregistered", "unregistered-task.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	ts.AddTask(task)
+	auth := ts.Login("unregistered-task.abc-123")
+
+	resp := ts.HandleRequest(ts.mkRenew(auth))
+	ts.Equal(resp.Auth.InternalData["policy-check"], policyCheckUnchanged)
+}
+
+// Renewal applies the current token settings for the task prefix.
+func (ts *AuthTests) Test_renewal_token_settings() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	auth := ts.Login("task.abc-123")
+	ts.Equal(auth.Period, 10*time.Minute)
+
+	ts.SetTaskTokenPolicies("task", jsonobj{"period": "5m", "num-uses": 3}, "insurance")
+
+	resp := ts.HandleRequest(ts.mkRenew(auth))
+	ts.Equal(resp.Auth.Period, 5*time.Minute)
+	ts.Equal(resp.Auth.NumUses, 3)
+	// The original login auth is unmodified.
+	ts.Equal(auth.Period, 10*time.Minute)
+	ts.Equal(auth.NumUses, 0)
+}
+
+// Can't renew a token that has outlived its max TTL.
+func (ts *AuthTests) Test_renewal_max_ttl_exceeded() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskTokenPolicies("task", jsonobj{"ttl": "10m", "max-ttl": "1h"}, "insurance")
+	auth := ts.Login("task.abc-123")
+
+	auth.IssueTime = time.Now().Add(-30 * time.Minute)
+	ts.HandleRequestSuccess(ts.mkRenew(auth))
+
+	auth.IssueTime = time.Now().Add(-2 * time.Hour)
+	ts.HandleRequestError(ts.mkRenew(auth), "max-ttl of 1h0m0s exceeded")
+}
+
 // Can't renew with an unconfigured backend or bad Mesos.
 func (ts *AuthTests) Test_renewal_unconfigured_or_bad() {
 	ts.SetupBackendWithMesos()
@@ -232,3 +738,63 @@ func mkTask(name, id string, state mesos.TaskState) mesos.Task {
 		State:  &state,
 	}
 }
+
+// mkDockerTask builds a simple running task value with a Docker container.
+func mkDockerTask(name, id, image string) mesos.Task {
+	task := mkTask(name, id, mesos.TASK_RUNNING)
+	dockerType := mesos.ContainerInfo_DOCKER
+	task.Container = &mesos.ContainerInfo{
+		Type:   &dockerType,
+		Docker: &mesos.ContainerInfo_DockerInfo{Image: image},
+	}
+	return task
+}
+
+// mkMetadata builds the auth metadata for a task created by mkTask.
+func mkMetadata(id, name string) map[string]string {
+	prefix, _ := taskIDPrefix(id) // #nosec G104
+	return map[string]string{
+		"task-id":      id,
+		"task-name":    name,
+		"task-prefix":  prefix,
+		"framework-id": "",
+		"agent-id":     "",
+	}
+}
+
+// mkResource builds a simple scalar resource value allocated to a role.
+func mkResource(name, role string) mesos.Resource {
+	scalar := mesos.SCALAR
+	return mesos.Resource{
+		Name:   name,
+		Type:   &scalar,
+		Scalar: &mesos.Value_Scalar{Value: 1},
+		Role:   &role,
+	}
+}
+
+// mkFramework builds a simple framework value. An empty principal is omitted.
+func mkFramework(name, id, principal string) mesos.FrameworkInfo {
+	fw := mesos.FrameworkInfo{
+		Name: name,
+		ID:   &mesos.FrameworkID{Value: id},
+	}
+	if principal != "" {
+		fw.Principal = &principal
+	}
+	return fw
+}
+
+// strptr returns a pointer to a copy of a string, because Go won't let us take
+// the address of a literal.
+// mkInternalData builds the internal data we expect for a task that logged in
+// with policies from its task-policies entry.
+func mkInternalData(taskID string, policies ...string) jsonobj {
+	return jsonobj{
+		"task-id":       taskID,
+		"policies":      policies,
+		"policy-source": policySourceTaskPolicies,
+	}
+}
+
+func strptr(s string) *string { return &s }
@@ -2,33 +2,84 @@ package mesosauth
 
 import (
 	"context"
+	"net/http"
+	"sync"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
+
+	"github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient"
 )
 
 // mesosBackend is our plugin backend object.
 type mesosBackend struct {
 	*framework.Backend
+	// cache holds storage entries we read often and write rarely.
+	cache *storageCache
+	// status records what we've seen of Mesos for status requests.
+	status *mesosStatus
+	// limiter keeps track of login attempts to enforce the login limits.
+	limiter *loginLimiter
+	// transport is shared by all our Mesos clients so that we can reuse
+	// connections and close them when we're done.
+	transport *http.Transport
+	// metrics is where we emit metrics. If it's nil, we use the global
+	// metrics object, as Vault does.
+	metrics *metrics.Metrics
+	// alertLock serialises alert writes.
+	alertLock sync.Mutex
+	// probes counts task probes so we can record them in batches.
+	probes *probeTracker
+	// agents remembers the master's agents for agent verification.
+	agents *agentCache
+	// runningPollInterval is how often we ask Mesos about a task we're
+	// waiting for during login.
+	runningPollInterval time.Duration
 }
 
 // Factory builds a plugin backend.
 func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
-	var b mesosBackend
+	status := newMesosStatus()
+	b := mesosBackend{
+		cache:     newStorageCache(),
+		status:    status,
+		limiter:   newLoginLimiter(),
+		transport: mesosclient.NewTransport(),
+		agents:    &agentCache{status: status},
+		probes:    newProbeTracker(),
+
+		runningPollInterval: defaultRunningPollInterval,
+	}
 
 	b.Backend = &framework.Backend{
 		BackendType: logical.TypeCredential,
 		AuthRenew:   b.authRenew,
 		PathsSpecial: &logical.Paths{
 			Unauthenticated: []string{"login"},
+			SealWrapStorage: []string{"config", "framework-keys/"},
 		},
 		Paths: []*framework.Path{
 			pathLogin(&b),
+			pathLoginCheck(&b),
 			pathTaskPolicies(&b),
+			pathMesosRolePolicies(&b),
+			pathPrincipalPolicies(&b),
 			pathConfig(&b),
+			pathConfigFreeze(&b),
+			pathStatus(&b),
+			pathLockouts(&b),
+			pathPreauth(&b),
+			pathFrameworkKeys(&b),
+			pathIssue(&b),
+			pathAlerts(&b),
+			pathAlert(&b),
+			pathAlertAck(&b),
 		},
-		Invalidate: b.invalidate,
-		Clean:      b.cleanup,
+		Invalidate:   b.invalidate,
+		Clean:        b.cleanup,
+		PeriodicFunc: b.periodic,
 	}
 
 	// We unconditionally return &b and whatever error we got from the setup
@@ -39,12 +90,71 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 	return &b, err
 }
 
-// TODO: Make this useful or get rid of it.
-func (b *mesosBackend) invalidate(_ context.Context, wtf string) {
-	b.Logger().Info("INVALIDATE", "wtf", wtf)
+// invalidate is called when a storage key is written somewhere other than
+// this backend (on another node of a replicated or HA cluster, for example) so
+// that we can drop any cached copy.
+func (b *mesosBackend) invalidate(_ context.Context, key string) {
+	b.Logger().Debug("INVALIDATE", "key", key)
+	b.cache.invalidate(key)
 }
 
-// TODO: Make this useful or get rid of it.
+// cleanup is called when the backend is being unmounted or shut down. We
+// don't have any background goroutines, so all we need to do is drop our
+// cached data and close any idle Mesos connections.
 func (b *mesosBackend) cleanup(_ context.Context) {
 	b.Logger().Info("CLEANUP")
+	b.cache.clear()
+	b.transport.CloseIdleConnections()
+}
+
+// periodic is called by Vault every so often to let us do housekeeping. We
+// carry on tidying after a failure, because the other kinds of entry are
+// stored separately and may be fine.
+func (b *mesosBackend) periodic(ctx context.Context, req *logical.Request) error {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	tidiedPreauths, preauthErr := rh.tidyPreauths()
+	b.status.recordBackgroundError("preauth-tidy", preauthErr)
+	if tidiedPreauths > 0 {
+		b.Logger().Debug("PREAUTH TIDY", "tidied", tidiedPreauths)
+	}
+
+	tidiedSecretIDs, secretIDErr := rh.tidySecretIDs()
+	b.status.recordBackgroundError("secret-id-tidy", secretIDErr)
+	if tidiedSecretIDs > 0 {
+		b.Logger().Debug("SECRET ID TIDY", "tidied", tidiedSecretIDs)
+	}
+
+	tidiedQuarantines, quarantineErr := b.tidyQuarantines(&rh)
+	b.status.recordBackgroundError("quarantine-tidy", quarantineErr)
+	if tidiedQuarantines > 0 {
+		b.Logger().Debug("QUARANTINE TIDY", "tidied", tidiedQuarantines)
+	}
+
+	flushedProbes, probeErr := b.flushProbeAlerts(&rh)
+	b.status.recordBackgroundError("probe-alert-flush", probeErr)
+	if flushedProbes > 0 {
+		b.Logger().Debug("PROBE ALERT FLUSH", "flushed", flushedProbes)
+	}
+
+	switch {
+	case preauthErr != nil:
+		return preauthErr
+	case secretIDErr != nil:
+		return secretIDErr
+	case quarantineErr != nil:
+		return quarantineErr
+	}
+	return probeErr
+}
+
+// mesosClient builds a Mesos client for the given config that uses our shared
+// transport.
+func (b *mesosBackend) mesosClient(cfg *config) *mesosclient.Client {
+	mc := mesosclient.NewClientWithTransport(cfg.BaseURL, b.transport)
+	if cfg.MesosPrincipal != "" {
+		mc.SetBasicAuth(cfg.MesosPrincipal, cfg.MesosSecret)
+	}
+	mc.SetMetrics(b.metrics)
+	return mc
 }
@@ -15,5 +15,6 @@ func (ts *TestSuite) Test_Factory_builds_backend() {
 	ts.Equal(b.Type(), logical.TypeCredential)
 	ts.Equal(b.SpecialPaths(), &logical.Paths{
 		Unauthenticated: []string{"login"},
+		SealWrapStorage: []string{"config", "framework-keys/"},
 	})
 }
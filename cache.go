@@ -0,0 +1,116 @@
+package mesosauth
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// cachedPrefixes lists the storage key prefixes whose entries we cache. These
+// are all written rarely (by operators) and read on every login or renewal.
+// Task instances change with every login, so we always read them from storage.
+var cachedPrefixes = []string{
+	"config",
+	"task-policies/",
+	"mesos-role-policies/",
+	"principal-policies/",
+	"framework-keys/",
+}
+
+// missCachedPrefixes lists the cached prefixes whose missing entries we also
+// cache. We only look these up for tasks Mesos knows about, so there are only
+// as many of them as there are roles, principals and frameworks in the
+// cluster. Task prefixes come straight from unauthenticated login requests, so
+// caching missing task-policies entries would let anyone fill our memory with
+// made-up prefixes.
+var missCachedPrefixes = []string{
+	"config",
+	"mesos-role-policies/",
+	"principal-policies/",
+	"framework-keys/",
+}
+
+// storageCache is an in-memory cache of storage entries, shared by all
+// requests to a backend. Vault tells us about writes on other nodes (via the
+// backend's Invalidate callback), so we can keep the cache correct on
+// replicated and HA clusters. Missing entries are cached as nil if their keys
+// are in missCachedPrefixes.
+type storageCache struct {
+	lock    sync.RWMutex
+	entries map[string]*logical.StorageEntry
+	// generation is incremented every time anything is invalidated. A fetch
+	// only populates the cache if nothing was invalidated while it was
+	// reading from storage, so we never cache stale data.
+	generation uint64
+}
+
+// newStorageCache builds an empty storageCache.
+func newStorageCache() *storageCache {
+	return &storageCache{entries: map[string]*logical.StorageEntry{}}
+}
+
+// cacheable checks whether we cache the storage entry with the given key.
+func cacheable(key string) bool {
+	return hasAnyPrefix(key, cachedPrefixes)
+}
+
+// missCacheable checks whether we cache the absence of a storage entry with
+// the given key.
+func missCacheable(key string) bool {
+	return hasAnyPrefix(key, missCachedPrefixes)
+}
+
+// hasAnyPrefix checks whether a key starts with any of the given prefixes.
+func hasAnyPrefix(key string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns the cached entry for a key (which may be nil for a missing
+// entry) and whether there was one, along with the current generation to pass
+// to put.
+func (c *storageCache) get(key string) (*logical.StorageEntry, bool, uint64) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	se, ok := c.entries[key]
+	return se, ok, c.generation
+}
+
+// put caches the entry for a key, unless anything has been invalidated since
+// the given generation.
+func (c *storageCache) put(key string, se *logical.StorageEntry, generation uint64) {
+	if !cacheable(key) || (se == nil && !missCacheable(key)) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.generation == generation {
+		c.entries[key] = se
+	}
+}
+
+// invalidate removes the entry for a key from the cache. Keys we never cache
+// (task instances, for example, which are written on every login) are
+// ignored, so that they don't throw away fetches of keys we do cache.
+func (c *storageCache) invalidate(key string) {
+	if !cacheable(key) {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	delete(c.entries, key)
+}
+
+// clear removes all entries from the cache.
+func (c *storageCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.generation++
+	c.entries = map[string]*logical.StorageEntry{}
+}
@@ -0,0 +1,140 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// CacheTests is a testify test suite object that we can attach helper methods
+// to.
+type CacheTests struct{ TestSuite }
+
+// Test_Cache is a standard Go test function that runs our test suite's tests.
+func Test_Cache(t *testing.T) { suite.Run(t, new(CacheTests)) }
+
+// putQuietly writes a value to storage without telling the backend, so we can
+// see whether it reads from storage or its cache.
+func (ts *CacheTests) putQuietly(key string, value interface{}) {
+	ts.Require().NoError(
+		ts.storage.Put(context.Background(), ts.mkStorageEntry(key, value)))
+}
+
+// readPolicies reads the policies for a task prefix through the API.
+func (ts *CacheTests) readPolicies(taskPrefix string) interface{} {
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": taskPrefix}
+	return ts.HandleRequest(req).Data["policies"]
+}
+
+// Only the keys we read often and write rarely are cacheable.
+func (ts *CacheTests) Test_cacheable() {
+	ts.True(cacheable("config"))
+	ts.True(cacheable(tpKey("my-task")))
+	ts.True(cacheable(rpKey("my-role")))
+	ts.True(cacheable(ppKey("my-principal")))
+	ts.False(cacheable(tiKey("my-task")))
+
+	ts.True(missCacheable("config"))
+	ts.True(missCacheable(rpKey("my-role")))
+	ts.False(missCacheable(tpKey("my-task")))
+}
+
+// Once we've read an entry, we don't read it from storage again until it is
+// invalidated.
+func (ts *CacheTests) Test_cached_until_invalidated() {
+	ts.SetupBackend()
+	ts.SetTaskPolicies("my-task", "insurance")
+	ts.Equal(ts.readPolicies("my-task"), []string{"insurance"})
+
+	ts.putQuietly(tpKey("my-task"), taskPolicies{Policies: []string{"foreign"}})
+	ts.Equal(ts.readPolicies("my-task"), []string{"insurance"})
+
+	ts.backend.InvalidateKey(context.Background(), tpKey("my-task"))
+	ts.Equal(ts.readPolicies("my-task"), []string{"foreign"})
+}
+
+// Missing entries are cached too, for keys we only look up for known tasks.
+func (ts *CacheTests) Test_missing_cached() {
+	ts.SetupBackend()
+	readRolePolicies := func() interface{} {
+		return ts.HandleRequest(ts.mkReadReq(rpKey("my-role"))).Data["policies"]
+	}
+	ts.Nil(readRolePolicies())
+
+	ts.putQuietly(rpKey("my-role"), policyMapping{Policies: []string{"foreign"}})
+	ts.Nil(readRolePolicies())
+
+	ts.backend.InvalidateKey(context.Background(), rpKey("my-role"))
+	ts.Equal(readRolePolicies(), []string{"foreign"})
+}
+
+// Missing task-policies entries aren't cached, so logins with made-up task
+// prefixes don't grow the cache.
+func (ts *CacheTests) Test_missing_task_policies_not_cached() {
+	ts.SetupBackendWithMesos()
+	ts.Nil(ts.readPolicies("my-task"))
+	ts.putQuietly(tpKey("my-task"), taskPolicies{Policies: []string{"foreign"}})
+	ts.Equal(ts.readPolicies("my-task"), []string{"foreign"})
+
+	login := func(i int) {
+		req := ts.mkReq("login", jsonobj{"task-id": fmt.Sprintf("made-up-%d.abc-123", i)})
+		ts.HandleRequestError(req, "permission denied")
+	}
+	// The first login caches the config.
+	login(0)
+	before := len(ts.backend.cache.entries)
+	for i := 1; i < 50; i++ {
+		login(i)
+	}
+	ts.Equal(before, len(ts.backend.cache.entries))
+}
+
+// Our own writes update what we read.
+func (ts *CacheTests) Test_write_invalidates() {
+	ts.SetupBackend()
+	ts.SetTaskPolicies("my-task", "insurance")
+	ts.Equal(ts.readPolicies("my-task"), []string{"insurance"})
+
+	ts.SetTaskPolicies("my-task", "foreign")
+	ts.Equal(ts.readPolicies("my-task"), []string{"foreign"})
+}
+
+// Cleanup empties the cache.
+func (ts *CacheTests) Test_cleanup_clears() {
+	ts.SetupBackend()
+	ts.SetTaskPolicies("my-task", "insurance")
+	ts.Equal(ts.readPolicies("my-task"), []string{"insurance"})
+
+	ts.putQuietly(tpKey("my-task"), taskPolicies{Policies: []string{"foreign"}})
+	ts.backend.Cleanup(context.Background())
+	ts.Equal(ts.readPolicies("my-task"), []string{"foreign"})
+}
+
+// A fetch that raced with an invalidation doesn't populate the cache.
+func (ts *CacheTests) Test_stale_put_ignored() {
+	c := newStorageCache()
+	_, ok, generation := c.get("config")
+	ts.False(ok)
+
+	c.invalidate("config")
+	c.put("config", &logical.StorageEntry{Key: "config"}, generation)
+	_, ok, _ = c.get("config")
+	ts.False(ok)
+}
+
+// Writes to keys we don't cache don't throw away fetches that raced with them.
+func (ts *CacheTests) Test_uncached_write_keeps_generation() {
+	c := newStorageCache()
+	_, _, generation := c.get("config")
+
+	c.invalidate(tiKey("task.abc-123"))
+	c.put("config", &logical.StorageEntry{Key: "config"}, generation)
+	_, ok, _ := c.get("config")
+	ts.True(ok)
+}
@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/hashicorp/vault/helper/pluginutil"
 	"github.com/hashicorp/vault/logical/plugin"
 
@@ -16,6 +17,8 @@ func main() {
 	apiClientMeta := &pluginutil.APIClientMeta{}
 	flags := apiClientMeta.FlagSet()
 	versionFlag := flags.Bool("version", false, "Print version information and exit.")
+	metricsSink := flags.String("metrics-sink", "",
+		"Where to send metrics, as a URL like statsd://127.0.0.1:8125 or statsite://127.0.0.1:8125. Metrics are discarded if this isn't set.")
 
 	if err := flags.Parse(os.Args[1:]); err != nil {
 		log.Fatal(err)
@@ -26,6 +29,18 @@ func main() {
 		return
 	}
 
+	// The plugin runs in its own process, so it doesn't share Vault's
+	// metrics configuration and has to be told where to send them.
+	if *metricsSink != "" {
+		sink, err := metrics.NewMetricSinkFromURL(*metricsSink)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err := metrics.NewGlobal(metrics.DefaultConfig("vault"), sink); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	tlsConfig := apiClientMeta.GetTLSConfig()
 	tlsProviderFunc := pluginutil.VaultPluginTLSProvider(tlsConfig)
 
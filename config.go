@@ -2,8 +2,10 @@ package mesosauth
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/hashicorp/vault/helper/strutil"
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
 )
@@ -14,22 +16,96 @@ const defaultPeriod = 10 * time.Minute
 // method because we never call it once the backend struct is built and we
 // don't want name collisions with any request handler methods.
 func pathConfig(b *mesosBackend) *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"base-url": {
+			Type:        framework.TypeString,
+			Description: "Mesos API base URL.",
+		},
+		"period": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Duration after which authentication will be expired",
+		},
+		"default-policies": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Policies for tasks whose prefix has no task-policies entry.",
+		},
+		"default-frameworks": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Names of frameworks whose tasks may receive the default policies.",
+		},
+		"alias-source": {
+			Type:        framework.TypeString,
+			Description: "What to name identity aliases after: task-prefix, app-id or framework-task-name.",
+		},
+		"metadata-labels": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Task label keys to include in auth metadata.",
+		},
+		"group-alias-labels": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Task label keys to build identity group aliases from.",
+		},
+		"renewal-policy-change": {
+			Type:        framework.TypeString,
+			Description: "What to do on renewal if a task's policies have changed: fail (any change fails the renewal) or reject-removed (only removed policies fail it; added ones are allowed).",
+		},
+		"mesos-principal": {
+			Type:        framework.TypeString,
+			Description: "Principal for HTTP basic authentication to Mesos.",
+		},
+		"mesos-secret": {
+			Type:        framework.TypeString,
+			Description: "Secret for HTTP basic authentication to Mesos. Write-only.",
+		},
+		"vault-addr": {
+			Type:        framework.TypeString,
+			Description: "Address of Vault's API, for revoking quarantined tokens.",
+		},
+		"vault-token": {
+			Type:        framework.TypeString,
+			Description: "Token allowed to revoke tokens by accessor, for revoking quarantined tokens. Write-only.",
+		},
+		"expose-denial-reasons": {
+			Type:        framework.TypeBool,
+			Description: "Tell clients why their logins were denied. Only for debugging non-production mounts.",
+		},
+		"login-cidrs": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "CIDRs that logins must come from. If empty, logins may come from anywhere.",
+		},
+		"duplicate-login-actions": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "What to do when a task that has already logged in tries again: any of alert, quarantine, revoke-existing and kill. Quarantine stops the task's existing tokens from being renewed, revoke-existing also revokes them when they try to renew (and needs vault-addr and vault-token), and kill asks the task's Marathon to kill it.",
+		},
+		"verification-mode": {
+			Type:        framework.TypeString,
+			Description: "Whom to ask about tasks: master, or agent to ask only the agent a request comes from.",
+		},
+		"running-wait": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long a login waits for a staging or starting task to start running, up to 5m. Zero means no wait.",
+		},
+		"skip-verify": {
+			Type:        framework.TypeBool,
+			Description: "Store the config without checking that Mesos is reachable and healthy.",
+		},
+		"force": {
+			Type:        framework.TypeBool,
+			Description: "Delete the config even if task-policies exist.",
+		},
+	}
+	for name, schema := range loginLimitsFields() {
+		fields[name] = schema
+	}
+
 	return &framework.Path{
 		Pattern: "config",
-		Fields: map[string]*framework.FieldSchema{
-			"base-url": {
-				Type:        framework.TypeString,
-				Description: "Mesos API base URL.",
-			},
-			"period": {
-				Type:        framework.TypeDurationSecond,
-				Description: "Duration after which authentication will be expired",
-			},
-		},
+		Fields:  fields,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.CreateOperation: b.pathConfigWrite,
 			logical.UpdateOperation: b.pathConfigWrite,
 			logical.ReadOperation:   b.pathConfigRead,
+			logical.DeleteOperation: b.pathConfigDelete,
 		},
 	}
 }
@@ -38,18 +114,62 @@ func pathConfig(b *mesosBackend) *framework.Path {
 type config struct {
 	BaseURL string
 	Period  time.Duration
+	// DefaultPolicies are granted to tasks with no task-policies entry for
+	// their prefix, but only if the task belongs to one of the
+	// DefaultFrameworks. If either is empty, there are no default policies.
+	DefaultPolicies   []string
+	DefaultFrameworks []string
+	AliasSource       string
+	MetadataLabels    []string
+	GroupAliasLabels  []string
+	// RenewalPolicyChange determines whether renewals fail when the policies
+	// a task would be granted have changed since login.
+	RenewalPolicyChange string
+	// ExposeDenialReasons makes denied logins tell the client why, which is
+	// useful for debugging but tells attackers more than we'd like.
+	ExposeDenialReasons bool
+	// LoginCIDRs, if not empty, restricts the remote addresses that any
+	// task may log in from.
+	LoginCIDRs []string
+	// DuplicateLoginActions lists what to do when a task that has already
+	// logged in tries to log in again, beyond denying the login.
+	DuplicateLoginActions []string
+	// MesosPrincipal and MesosSecret are credentials for Mesos HTTP basic
+	// authentication. If MesosPrincipal is empty, we don't authenticate.
+	// MesosSecret is sensitive, so we never return it in read responses.
+	MesosPrincipal string
+	MesosSecret    string
+	// VaultAddr and VaultToken let us ask Vault to revoke the tokens of
+	// quarantined tasks. VaultToken is sensitive, like MesosSecret.
+	VaultAddr  string
+	VaultToken string
+	// MesosVersion is the version the Mesos master reported when we last
+	// verified the config. It is empty if verification was skipped.
+	MesosVersion string
+	// VerificationMode is whom we ask about tasks: the master, or the agent
+	// a request comes from.
+	VerificationMode string
+	// RunningWait is how long a login waits for a task that Mesos is still
+	// starting to reach TASK_RUNNING.
+	RunningWait time.Duration
+	// Freeze, if set, stops some or all tasks from logging in.
+	Freeze *freeze
+	loginLimits
 }
 
 // configDefault returns a new config containing default settings.
 func configDefault() *config {
 	return &config{
-		Period: defaultPeriod,
+		Period:              defaultPeriod,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	}
 }
 
 // pathConfigWrite is the "config" create/update request handler.
 func (b *mesosBackend) pathConfigWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	// TODO: Decide if we want to allow invalid configs to be overwritten.
 	cfg, err := rh.getConfigOrNil()
@@ -63,6 +183,7 @@ func (b *mesosBackend) pathConfigWrite(ctx context.Context, req *logical.Request
 		cfg = configDefault()
 	}
 
+	oldBaseURL := cfg.BaseURL
 	if baseURL, ok := d.GetOk("base-url"); ok {
 		cfg.BaseURL = baseURL.(string)
 	}
@@ -71,17 +192,116 @@ func (b *mesosBackend) pathConfigWrite(ctx context.Context, req *logical.Request
 		cfg.Period = time.Duration(period.(int)) * time.Second
 	}
 
+	if defaultPolicies, ok := d.GetOk("default-policies"); ok {
+		cfg.DefaultPolicies = defaultPolicies.([]string)
+	}
+
+	if defaultFrameworks, ok := d.GetOk("default-frameworks"); ok {
+		cfg.DefaultFrameworks = defaultFrameworks.([]string)
+	}
+
+	if aliasSource, ok := d.GetOk("alias-source"); ok {
+		cfg.AliasSource = aliasSource.(string)
+		if !strutil.StrListContains(aliasSources, cfg.AliasSource) {
+			return logical.ErrorResponse("invalid alias-source: " + cfg.AliasSource), nil
+		}
+	}
+
+	if metadataLabels, ok := d.GetOk("metadata-labels"); ok {
+		cfg.MetadataLabels = metadataLabels.([]string)
+	}
+
+	if groupAliasLabels, ok := d.GetOk("group-alias-labels"); ok {
+		cfg.GroupAliasLabels = groupAliasLabels.([]string)
+	}
+
+	if renewalPolicyChange, ok := d.GetOk("renewal-policy-change"); ok {
+		cfg.RenewalPolicyChange = renewalPolicyChange.(string)
+		if !strutil.StrListContains(policyChanges, cfg.RenewalPolicyChange) {
+			return logical.ErrorResponse("invalid renewal-policy-change: " + cfg.RenewalPolicyChange), nil
+		}
+	}
+
+	if exposeDenialReasons, ok := d.GetOk("expose-denial-reasons"); ok {
+		cfg.ExposeDenialReasons = exposeDenialReasons.(bool)
+	}
+
+	if loginCIDRs, ok := d.GetOk("login-cidrs"); ok {
+		cfg.LoginCIDRs, err = normaliseCIDRs(loginCIDRs.([]string))
+		if err != nil {
+			return logical.ErrorResponse("login-cidrs: " + err.Error()), nil
+		}
+	}
+
+	if duplicateLoginActions, ok := d.GetOk("duplicate-login-actions"); ok {
+		cfg.DuplicateLoginActions = duplicateLoginActions.([]string)
+	}
+
+	if vaultAddr, ok := d.GetOk("vault-addr"); ok {
+		cfg.VaultAddr = vaultAddr.(string)
+	}
+
+	if vaultToken, ok := d.GetOk("vault-token"); ok {
+		cfg.VaultToken = vaultToken.(string)
+	}
+
+	if err := validateDuplicateLoginActions(cfg); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if verificationMode, ok := d.GetOk("verification-mode"); ok {
+		cfg.VerificationMode = verificationMode.(string)
+		if !strutil.StrListContains(verificationModes, cfg.VerificationMode) {
+			return logical.ErrorResponse("invalid verification-mode: " + cfg.VerificationMode), nil
+		}
+	}
+
+	if runningWait, ok := d.GetOk("running-wait"); ok {
+		cfg.RunningWait = time.Duration(runningWait.(int)) * time.Second
+		if cfg.RunningWait < 0 {
+			return logical.ErrorResponse("running-wait must not be negative"), nil
+		}
+		if cfg.RunningWait > maxRunningWait {
+			return logical.ErrorResponse(fmt.Sprintf("running-wait must not exceed %s", maxRunningWait)), nil
+		}
+	}
+
+	if err := cfg.loginLimits.update(d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if mesosPrincipal, ok := d.GetOk("mesos-principal"); ok {
+		cfg.MesosPrincipal = mesosPrincipal.(string)
+	}
+
+	if mesosSecret, ok := d.GetOk("mesos-secret"); ok {
+		cfg.MesosSecret = mesosSecret.(string)
+	}
+
 	if cfg.BaseURL == "" {
 		return logical.ErrorResponse("base-url not configured"), nil
 	}
 
+	if d.Get("skip-verify").(bool) {
+		// Whatever we knew about the old Mesos doesn't apply to a new one.
+		if cfg.BaseURL != oldBaseURL {
+			cfg.MesosVersion = ""
+		}
+	} else {
+		version, err := b.verifyMesos(ctx, cfg)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("unable to verify Mesos at %s: %s", cfg.BaseURL, err)), nil
+		}
+		cfg.MesosVersion = version
+	}
+
 	err = rh.store("config", cfg)
 	return &logical.Response{}, err
 }
 
 // pathConfigRead is the "config" read request handler.
 func (b *mesosBackend) pathConfigRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	cfg, err := rh.getConfigOrNil()
 	if cfg == nil || err != nil {
@@ -90,9 +310,77 @@ func (b *mesosBackend) pathConfigRead(ctx context.Context, req *logical.Request,
 
 	resp := &logical.Response{
 		Data: jsonobj{
-			"base-url": cfg.BaseURL,
-			"period":   cfg.Period.String(),
+			"base-url":                cfg.BaseURL,
+			"period":                  cfg.Period.String(),
+			"default-policies":        cfg.DefaultPolicies,
+			"default-frameworks":      cfg.DefaultFrameworks,
+			"alias-source":            cfg.AliasSource,
+			"metadata-labels":         cfg.MetadataLabels,
+			"group-alias-labels":      cfg.GroupAliasLabels,
+			"renewal-policy-change":   cfg.RenewalPolicyChange,
+			"expose-denial-reasons":   cfg.ExposeDenialReasons,
+			"login-cidrs":             cfg.LoginCIDRs,
+			"duplicate-login-actions": cfg.DuplicateLoginActions,
+			"verification-mode":       cfg.VerificationMode,
+			"running-wait":            cfg.RunningWait.String(),
+			"mesos-version":           cfg.MesosVersion,
+			"mesos-principal":         cfg.MesosPrincipal,
+			"mesos-secret":            redacted(cfg.MesosSecret),
+			"vault-addr":              cfg.VaultAddr,
+			"vault-token":             redacted(cfg.VaultToken),
+			"freeze":                  cfg.Freeze.data(),
 		},
 	}
+	for k, v := range cfg.loginLimits.data() {
+		resp.Data[k] = v
+	}
 	return resp, nil
 }
+
+// pathConfigDelete is the "config" delete request handler. Without a config,
+// nobody can log in, so we refuse to delete it while there are task-policies
+// entries unless the request forces us to.
+func (b *mesosBackend) pathConfigDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	if !d.Get("force").(bool) {
+		prefixes, err := req.Storage.List(ctx, tpKey(""))
+		if err != nil {
+			return nil, err
+		}
+		if len(prefixes) > 0 {
+			return logical.ErrorResponse(fmt.Sprintf(
+				"task-policies exist for %d prefixes, use force to delete anyway", len(prefixes))), nil
+		}
+	}
+
+	b.Logger().Info("CONFIG DELETED")
+	return nil, rh.delete("config")
+}
+
+// redacted returns what we show in place of a sensitive config value: whether
+// it is set, but not what it is.
+func redacted(value string) string {
+	if value == "" {
+		return "unset"
+	}
+	return "set"
+}
+
+// verifyMesos checks that there is a healthy Mesos master for the given config
+// and returns its version.
+func (b *mesosBackend) verifyMesos(ctx context.Context, cfg *config) (string, error) {
+	mc := b.mesosClient(cfg)
+	rgv, err := mc.GetVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	rgh, err := mc.GetHealth(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !rgh.Healthy {
+		return "", fmt.Errorf("master reports itself unhealthy")
+	}
+	return rgv.VersionInfo.Version, nil
+}
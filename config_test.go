@@ -1,11 +1,14 @@
 package mesosauth
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
 )
 
 // See helper_for_test.go for common infrastructure and tools.
@@ -36,14 +39,18 @@ func (ts *ConfigTests) Test_create_full() {
 	ts.Nil(ts.GetStored("config"))
 
 	req := ts.mkReq("config", jsonobj{
-		"base-url": "http://master.mesos:5050",
-		"period":   "42s",
+		"skip-verify": true,
+		"base-url":    "http://master.mesos:5050",
+		"period":      "42s",
 	})
 	ts.Equal(ts.HandleRequest(req), &logical.Response{})
 
 	ts.StoredEqual("config", config{
-		BaseURL: "http://master.mesos:5050",
-		Period:  42 * time.Second,
+		BaseURL:             "http://master.mesos:5050",
+		Period:              42 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 }
 
@@ -51,23 +58,31 @@ func (ts *ConfigTests) Test_create_full() {
 func (ts *ConfigTests) Test_update_full() {
 	ts.SetupBackend()
 	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
-		"base-url": "http://master.mesos:5050",
-		"period":   "42s",
+		"skip-verify": true,
+		"base-url":    "http://master.mesos:5050",
+		"period":      "42s",
 	}))
 	ts.StoredEqual("config", config{
-		BaseURL: "http://master.mesos:5050",
-		Period:  42 * time.Second,
+		BaseURL:             "http://master.mesos:5050",
+		Period:              42 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 
 	req := ts.mkReq("config", jsonobj{
-		"base-url": "http://localhost:5050",
-		"period":   "7m",
+		"skip-verify": true,
+		"base-url":    "http://localhost:5050",
+		"period":      "7m",
 	})
 	ts.Equal(ts.HandleRequest(req), &logical.Response{})
 
 	ts.StoredEqual("config", config{
-		BaseURL: "http://localhost:5050",
-		Period:  420 * time.Second,
+		BaseURL:             "http://localhost:5050",
+		Period:              420 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 }
 
@@ -75,30 +90,40 @@ func (ts *ConfigTests) Test_update_full() {
 func (ts *ConfigTests) Test_update_partial() {
 	ts.SetupBackend()
 	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
-		"base-url": "http://master.mesos:5050",
-		"period":   "42s",
+		"skip-verify": true,
+		"base-url":    "http://master.mesos:5050",
+		"period":      "42s",
 	}))
 	ts.StoredEqual("config", config{
-		BaseURL: "http://master.mesos:5050",
-		Period:  42 * time.Second,
+		BaseURL:             "http://master.mesos:5050",
+		Period:              42 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 
 	// Update just the Period.
-	req1 := ts.mkReq("config", jsonobj{"period": "7m"})
+	req1 := ts.mkReq("config", jsonobj{"skip-verify": true, "period": "7m"})
 	ts.Equal(ts.HandleRequest(req1), &logical.Response{})
 
 	ts.StoredEqual("config", config{
-		BaseURL: "http://master.mesos:5050",
-		Period:  420 * time.Second,
+		BaseURL:             "http://master.mesos:5050",
+		Period:              420 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 
 	// Update just the base URL.
-	req2 := ts.mkReq("config", jsonobj{"base-url": "http://localhost:5050"})
+	req2 := ts.mkReq("config", jsonobj{"skip-verify": true, "base-url": "http://localhost:5050"})
 	ts.Equal(ts.HandleRequest(req2), &logical.Response{})
 
 	ts.StoredEqual("config", config{
-		BaseURL: "http://localhost:5050",
-		Period:  420 * time.Second,
+		BaseURL:             "http://localhost:5050",
+		Period:              420 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
 	})
 }
 
@@ -115,17 +140,233 @@ func (ts *ConfigTests) Test_read_no_config() {
 func (ts *ConfigTests) Test_read_existing_config() {
 	ts.SetupBackend()
 	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
-		"base-url": "http://master.mesos:5050",
-		"period":   "420s",
+		"skip-verify": true,
+		"base-url":    "http://master.mesos:5050",
+		"period":      "420s",
+	}))
+
+	req := ts.mkReadReq("config")
+	ts.Equal(ts.HandleRequest(req), &logical.Response{
+		Data: cfgReadData(loginLimits{}, jsonobj{
+			"base-url":                "http://master.mesos:5050",
+			"period":                  "7m0s",
+			"default-policies":        ([]string)(nil),
+			"default-frameworks":      ([]string)(nil),
+			"alias-source":            "task-prefix",
+			"metadata-labels":         ([]string)(nil),
+			"group-alias-labels":      ([]string)(nil),
+			"renewal-policy-change":   "fail",
+			"expose-denial-reasons":   false,
+			"login-cidrs":             ([]string)(nil),
+			"duplicate-login-actions": ([]string)(nil),
+			"verification-mode":       "master",
+			"running-wait":            "0s",
+			"mesos-version":           "",
+			"mesos-principal":         "",
+			"mesos-secret":            "unset",
+			"vault-addr":              "",
+			"vault-token":             "unset",
+			"freeze":                  (jsonobj)(nil),
+		}),
+	})
+}
+
+// We can configure default policies for tasks with no explicit mapping.
+func (ts *ConfigTests) Test_default_policies() {
+	ts.SetupBackend()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":        true,
+		"base-url":           "http://master.mesos:5050",
+		"default-policies":   "read-own-namespace",
+		"default-frameworks": "marathon,chronos",
 	}))
 
+	ts.StoredEqual("config", config{
+		BaseURL:             "http://master.mesos:5050",
+		Period:              defaultPeriod,
+		DefaultPolicies:     []string{"read-own-namespace"},
+		DefaultFrameworks:   []string{"marathon", "chronos"},
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
+	})
+
 	req := ts.mkReadReq("config")
 	ts.Equal(ts.HandleRequest(req), &logical.Response{
-		Data: jsonobj{
-			"base-url": "http://master.mesos:5050",
-			"period":   "7m0s",
-		},
+		Data: cfgReadData(loginLimits{}, jsonobj{
+			"base-url":                "http://master.mesos:5050",
+			"period":                  "10m0s",
+			"default-policies":        []string{"read-own-namespace"},
+			"default-frameworks":      []string{"marathon", "chronos"},
+			"alias-source":            "task-prefix",
+			"metadata-labels":         ([]string)(nil),
+			"group-alias-labels":      ([]string)(nil),
+			"renewal-policy-change":   "fail",
+			"expose-denial-reasons":   false,
+			"login-cidrs":             ([]string)(nil),
+			"duplicate-login-actions": ([]string)(nil),
+			"verification-mode":       "master",
+			"running-wait":            "0s",
+			"mesos-version":           "",
+			"mesos-principal":         "",
+			"mesos-secret":            "unset",
+			"vault-addr":              "",
+			"vault-token":             "unset",
+			"freeze":                  (jsonobj)(nil),
+		}),
+	})
+}
+
+// We can configure identity alias and metadata settings.
+func (ts *ConfigTests) Test_identity_settings() {
+	ts.SetupBackend()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":        true,
+		"base-url":           "http://master.mesos:5050",
+		"alias-source":       "app-id",
+		"metadata-labels":    "team,env",
+		"group-alias-labels": "team",
+	}))
+
+	ts.StoredEqual("config", config{
+		BaseURL:             "http://master.mesos:5050",
+		Period:              defaultPeriod,
+		AliasSource:         aliasAppID,
+		MetadataLabels:      []string{"team", "env"},
+		GroupAliasLabels:    []string{"team"},
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
+	})
+}
+
+// We cannot configure an unknown alias source.
+func (ts *ConfigTests) Test_invalid_alias_source() {
+	ts.SetupBackend()
+	req := ts.mkReq("config", jsonobj{
+		"base-url":     "http://master.mesos:5050",
+		"alias-source": "horoscope",
+	})
+	ts.EqualError(ts.HandleRequest(req).Error(), "invalid alias-source: horoscope")
+	ts.Nil(ts.GetStored("config"))
+}
+
+// We can configure what happens on renewal when policies have changed.
+func (ts *ConfigTests) Test_renewal_policy_change() {
+	ts.SetupBackend()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":           true,
+		"base-url":              "http://master.mesos:5050",
+		"renewal-policy-change": "reject-removed",
+	}))
+
+	ts.StoredEqual("config", config{
+		BaseURL:             "http://master.mesos:5050",
+		Period:              defaultPeriod,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeRejectRemoved,
+		VerificationMode:    verifyMaster,
 	})
+
+	req := ts.mkReq("config", jsonobj{"renewal-policy-change": "shrug"})
+	ts.EqualError(ts.HandleRequest(req).Error(), "invalid renewal-policy-change: shrug")
+}
+
+// A config write checks that Mesos is there and records its version.
+func (ts *ConfigTests) Test_verify_mesos() {
+	ts.SetupBackendWithMesos()
+	ts.fakeMesos.SetVersion("1.6.1")
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"period": "42s"}))
+
+	ts.StoredEqual("config", config{
+		BaseURL:             ts.fakeMesos.GetBaseURL(),
+		Period:              42 * time.Second,
+		AliasSource:         aliasTaskPrefix,
+		RenewalPolicyChange: policyChangeFail,
+		VerificationMode:    verifyMaster,
+		MesosVersion:        "1.6.1",
+	})
+	resp := ts.HandleRequest(ts.mkReadReq("config"))
+	ts.Equal(resp.Data["mesos-version"], "1.6.1")
+}
+
+// A config write fails if Mesos is unhealthy.
+func (ts *ConfigTests) Test_verify_mesos_unhealthy() {
+	ts.SetupBackendWithMesos()
+	ts.fakeMesos.SetHealthy(false)
+
+	req := ts.mkReq("config", jsonobj{"period": "42s"})
+	ts.EqualError(ts.HandleRequest(req).Error(), fmt.Sprintf(
+		"unable to verify Mesos at %s: master reports itself unhealthy", ts.fakeMesos.GetBaseURL()))
+	ts.Equal(ts.getStoredConfig().Period, defaultPeriod)
+}
+
+// A config write fails if Mesos isn't there, unless we skip verification.
+func (ts *ConfigTests) Test_verify_mesos_unreachable() {
+	ts.SetupBackendWithMesos()
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{}))
+	ts.Equal(ts.getStoredConfig().MesosVersion, mctesting.DefaultVersion)
+	badURL := ts.fakeMesos.GetBaseURL() + "/bad"
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"base-url": badURL}))
+	ts.Contains(resp.Error().Error(), "unable to verify Mesos at "+badURL+": ")
+	ts.Equal(ts.getStoredConfig().BaseURL, ts.fakeMesos.GetBaseURL())
+
+	// Skipping verification for a new base URL forgets the old version.
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"base-url": badURL, "skip-verify": true}))
+	ts.Equal(ts.getStoredConfig().BaseURL, badURL)
+	ts.Equal(ts.getStoredConfig().MesosVersion, "")
+}
+
+// Mesos credentials are used for verification and never read back.
+func (ts *ConfigTests) Test_mesos_credentials() {
+	ts.SetupBackendWithMesos()
+	ts.fakeMesos.SetCredentials("vault", "sekrit")
+
+	req := ts.mkReq("config", jsonobj{"mesos-principal": "vault", "mesos-secret": "wrong"})
+	ts.Contains(ts.HandleRequest(req).Error().Error(), "unable to verify Mesos")
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"mesos-principal": "vault",
+		"mesos-secret":    "sekrit",
+	}))
+	ts.Equal(ts.getStoredConfig().MesosSecret, "sekrit")
+
+	data := ts.HandleRequest(ts.mkReadReq("config")).Data
+	ts.Equal(data["mesos-principal"], "vault")
+	ts.Equal(data["mesos-secret"], "set")
+}
+
+// We can delete the config if there are no task-policies.
+func (ts *ConfigTests) Test_delete() {
+	ts.SetupBackendWithMesos()
+	ts.NotNil(ts.GetStored("config"))
+
+	ts.Nil(ts.HandleRequest(ts.mkDeleteReq("config")))
+	ts.Nil(ts.GetStored("config"))
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("config")))
+}
+
+// We can't delete the config while task-policies exist, unless we force it.
+func (ts *ConfigTests) Test_delete_with_task_policies() {
+	ts.SetupBackendWithMesos()
+	ts.SetTaskPolicies("my-task", "insurance")
+
+	resp := ts.HandleRequest(ts.mkDeleteReq("config"))
+	ts.EqualError(resp.Error(), "task-policies exist for 1 prefixes, use force to delete anyway")
+	ts.NotNil(ts.GetStored("config"))
+
+	req := ts.mkDeleteReq("config")
+	req.Data = jsonobj{"force": true}
+	ts.Nil(ts.HandleRequest(req))
+	ts.Nil(ts.GetStored("config"))
+}
+
+// getStoredConfig fetches and decodes the stored config.
+func (ts *ConfigTests) getStoredConfig() *config {
+	var cfg config
+	ts.Require().NoError(ts.GetStored("config").DecodeJSON(&cfg))
+	return &cfg
 }
 
 // We cannot read or update a broken config.
@@ -138,3 +379,12 @@ func (ts *ConfigTests) Test_broken_config() {
 	ts.HandleRequestError(ts.mkReadReq("config"), errmsg)
 	ts.HandleRequestError(ts.mkReq("config", jsonobj{"period": "42s"}), errmsg)
 }
+
+// cfgReadData builds the data we expect in a config read response from the
+// login limits and the rest of the config data.
+func cfgReadData(limits loginLimits, data jsonobj) jsonobj {
+	for k, v := range limits.data() {
+		data[k] = v
+	}
+	return data
+}
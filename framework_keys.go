@@ -0,0 +1,208 @@
+package mesosauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	// frameworkKeySize is the size of a framework HMAC key in bytes.
+	frameworkKeySize = 32
+	// defaultKeyOverlap is how long a framework key remains valid after it
+	// has been replaced, if the rotation request doesn't say.
+	defaultKeyOverlap = time.Hour
+)
+
+// pathFrameworkKeys returns the "framework-keys/<framework-id>" path struct.
+// It is a function rather than a method because we never call it once the
+// backend struct is built and we don't want name collisions with any request
+// handler methods.
+//
+// Keys belong to framework IDs rather than names, because a framework chooses
+// its own name (so two frameworks can share one, or a framework can change
+// it) but the master assigns its ID. A framework that re-registers with a new
+// ID needs a new key.
+func pathFrameworkKeys(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		// Framework IDs are arbitrary strings, so we match everything after
+		// the prefix.
+		Pattern: "framework-keys/(?P<framework_id>.+)",
+		Fields: map[string]*framework.FieldSchema{
+			"framework_id": {Type: framework.TypeString},
+			"overlap": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the previous key remains valid after rotation. Defaults to an hour.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathFrameworkKeysRotate,
+			logical.ReadOperation:   b.pathFrameworkKeysRead,
+			logical.DeleteOperation: b.pathFrameworkKeysDelete,
+		},
+	}
+}
+
+// frameworkKey is an HMAC key for deriving task secrets.
+type frameworkKey struct {
+	Key     []byte
+	Created time.Time
+	// Expires is zero for the current key, and set when a key is replaced.
+	Expires time.Time
+}
+
+// frameworkKeys is used to store the HMAC keys for a framework. The last key
+// is the current one, and any others are previous keys that are still valid.
+type frameworkKeys struct {
+	Keys []frameworkKey
+}
+
+// fkKey builds a framework keys storage key.
+func fkKey(frameworkID string) string {
+	return "framework-keys/" + frameworkID
+}
+
+// valid checks whether a key may be used at the given time.
+func (fk *frameworkKey) valid(now time.Time) bool {
+	return fk.Expires.IsZero() || now.Before(fk.Expires)
+}
+
+// current returns the current key.
+func (fks *frameworkKeys) current() *frameworkKey {
+	return &fks.Keys[len(fks.Keys)-1]
+}
+
+// rotate replaces the current key (if any) with a new one, letting the old
+// one remain valid for the given overlap. Keys that have expired are dropped.
+func (fks *frameworkKeys) rotate(now time.Time, overlap time.Duration) error {
+	key := make([]byte, frameworkKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	keys := []frameworkKey{}
+	for _, fk := range fks.Keys {
+		if fk.Expires.IsZero() {
+			fk.Expires = now.Add(overlap)
+		}
+		if fk.valid(now) {
+			keys = append(keys, fk)
+		}
+	}
+	fks.Keys = append(keys, frameworkKey{Key: key, Created: now})
+	return nil
+}
+
+// taskSecret derives the login secret for a task ID from a key.
+func taskSecret(key []byte, taskID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(taskID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyTaskSecret checks a task secret against all the keys that are valid
+// now. We compare in constant time and check every key, so the time taken
+// doesn't tell anyone how close they were or which key matched.
+func (fks *frameworkKeys) verifyTaskSecret(taskID string, secret string, now time.Time) bool {
+	matched := false
+	for _, fk := range fks.Keys {
+		expected := taskSecret(fk.Key, taskID)
+		if hmac.Equal([]byte(expected), []byte(secret)) && fk.valid(now) {
+			matched = true
+		}
+	}
+	return matched
+}
+
+// getFrameworkKeysOrNil fetches the keys for a framework, returning nil if
+// there are none.
+func (rh *requestHelper) getFrameworkKeysOrNil(frameworkID string) (*frameworkKeys, error) {
+	var fks *frameworkKeys
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			return nil
+		}
+		fks = &frameworkKeys{}
+		return se.DecodeJSON(fks)
+	}
+	err := rh.fetch(fkKey(frameworkID), decode)
+	return fks, err
+}
+
+// pathFrameworkKeysRotate is the "framework-keys/<framework-id>" update request
+// handler. It creates a key for a framework or rotates the existing one. Once
+// a framework has a key, its tasks need a task secret to log in.
+func (b *mesosBackend) pathFrameworkKeysRotate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	frameworkID := d.Get("framework_id").(string)
+	overlap := defaultKeyOverlap
+	if overlapSeconds, ok := d.GetOk("overlap"); ok {
+		overlap = time.Duration(overlapSeconds.(int)) * time.Second
+	}
+	if overlap < 0 {
+		return logical.ErrorResponse("overlap must not be negative"), nil
+	}
+
+	fks, err := rh.getFrameworkKeysOrNil(frameworkID)
+	if err != nil {
+		return nil, err
+	}
+	if fks == nil {
+		fks = &frameworkKeys{}
+	}
+	if err := fks.rotate(time.Now(), overlap); err != nil {
+		return nil, err
+	}
+
+	b.Logger().Info("FRAMEWORK KEY ROTATED", "framework-id", frameworkID, "overlap", overlap.String())
+
+	err = rh.store(fkKey(frameworkID), fks)
+	return &logical.Response{}, err
+}
+
+// pathFrameworkKeysRead is the "framework-keys/<framework-id>" read request
+// handler. It returns the current key for the scheduler to derive task
+// secrets with, and when the previous keys stop being valid.
+func (b *mesosBackend) pathFrameworkKeysRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	fks, err := rh.getFrameworkKeysOrNil(d.Get("framework_id").(string))
+	if fks == nil || err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	previous := []jsonobj{}
+	for _, fk := range fks.Keys[:len(fks.Keys)-1] {
+		if fk.valid(now) {
+			previous = append(previous, jsonobj{
+				"created": fk.Created.UTC().Format(time.RFC3339Nano),
+				"expires": fk.Expires.UTC().Format(time.RFC3339Nano),
+			})
+		}
+	}
+	current := fks.current()
+	return &logical.Response{
+		Data: jsonobj{
+			"key":           hex.EncodeToString(current.Key),
+			"created":       current.Created.UTC().Format(time.RFC3339Nano),
+			"previous-keys": previous,
+		},
+	}, nil
+}
+
+// pathFrameworkKeysDelete is the "framework-keys/<framework-id>" delete request
+// handler. Without keys, the framework's tasks no longer need task secrets.
+func (b *mesosBackend) pathFrameworkKeysDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	frameworkID := d.Get("framework_id").(string)
+	b.Logger().Info("FRAMEWORK KEYS DELETED", "framework-id", frameworkID)
+	return nil, rh.delete(fkKey(frameworkID))
+}
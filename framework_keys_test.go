@@ -0,0 +1,185 @@
+package mesosauth
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// FrameworkKeysTests is a testify test suite object that we can attach helper
+// methods to.
+type FrameworkKeysTests struct{ TestSuite }
+
+// Test_FrameworkKeys is a standard Go test function that runs our test suite's
+// tests.
+func Test_FrameworkKeys(t *testing.T) { suite.Run(t, new(FrameworkKeysTests)) }
+
+// mkFrameworkTasks builds running tasks on framework fw-1.
+func mkFrameworkTasks(taskIDs ...string) []mesos.Task {
+	tasks := []mesos.Task{}
+	for _, taskID := range taskIDs {
+		task := mkTask("task", taskID, mesos.TASK_RUNNING)
+		task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+		tasks = append(tasks, task)
+	}
+	return tasks
+}
+
+// setupFrameworkTask sets up a backend with running marathon tasks that have
+// a policy mapping.
+func (ts *FrameworkKeysTests) setupFrameworkTask(taskIDs ...string) {
+	ts.SetupLoginTasks(jsonobj{}, mkFrameworkTasks(taskIDs...)...)
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+}
+
+// currentKey reads the current key for a framework.
+func (ts *FrameworkKeysTests) currentKey(frameworkID string) []byte {
+	data := ts.HandleRequest(ts.mkReadReq(fkKey(frameworkID))).Data
+	return ts.WithoutError(hex.DecodeString(data["key"].(string))).([]byte)
+}
+
+// loginWithSecret makes a login request with a task secret.
+func (ts *FrameworkKeysTests) loginWithSecret(taskID string, secret string) error {
+	_, err := ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": taskID, "task-secret": secret}))
+	return err
+}
+
+// A key can be created and read, and rotating it keeps the old key around for
+// the overlap period.
+func (ts *FrameworkKeysTests) Test_rotate_and_read() {
+	ts.SetupBackend()
+	ts.Nil(ts.HandleRequest(ts.mkReadReq(fkKey("fw-1"))))
+
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	data := ts.HandleRequest(ts.mkReadReq(fkKey("fw-1"))).Data
+	ts.Len(data["key"], 2*frameworkKeySize)
+	ts.Equal(data["previous-keys"], []jsonobj{})
+	first := data["key"]
+
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{"overlap": "10m"}))
+	data = ts.HandleRequest(ts.mkReadReq(fkKey("fw-1"))).Data
+	ts.NotEqual(data["key"], first)
+	previous := data["previous-keys"].([]jsonobj)
+	ts.Require().Len(previous, 1)
+	expires, err := time.Parse(time.RFC3339Nano, previous[0]["expires"].(string))
+	ts.Require().NoError(err)
+	ts.WithinDuration(time.Now().Add(10*time.Minute), expires, 5*time.Second)
+}
+
+// Rotating without any overlap invalidates the old key immediately, and it is
+// dropped at the next rotation.
+func (ts *FrameworkKeysTests) Test_rotate_no_overlap() {
+	ts.SetupBackend()
+
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{"overlap": "0s"}))
+	ts.Equal(ts.HandleRequest(ts.mkReadReq(fkKey("fw-1"))).Data["previous-keys"], []jsonobj{})
+
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	var fks frameworkKeys
+	ts.Require().NoError(ts.GetStored(fkKey("fw-1")).DecodeJSON(&fks))
+	ts.Len(fks.Keys, 2)
+}
+
+// A task whose framework has a key needs the right task secret to log in.
+func (ts *FrameworkKeysTests) Test_login_task_secret() {
+	ts.setupFrameworkTask("task.abc-123")
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	key := ts.currentKey("fw-1")
+
+	err := ts.loginWithSecret("task.abc-123", "")
+	ts.EqualError(err, "permission denied: bad-task-secret: missing or invalid task secret for framework fw-1")
+	err = ts.loginWithSecret("task.abc-123", taskSecret(key, "task.abc-124"))
+	ts.EqualError(err, "permission denied: bad-task-secret: missing or invalid task secret for framework fw-1")
+
+	ts.NoError(ts.loginWithSecret("task.abc-123", taskSecret(key, "task.abc-123")))
+}
+
+// Secrets derived from the previous key work until the overlap ends.
+func (ts *FrameworkKeysTests) Test_login_previous_key() {
+	ts.setupFrameworkTask("task.abc-123", "task.abc-124")
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	oldKey := ts.currentKey("fw-1")
+
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{"overlap": "10m"}))
+	ts.NoError(ts.loginWithSecret("task.abc-123", taskSecret(oldKey, "task.abc-123")))
+
+	// The overlap only applies to the key being replaced, so we need a fresh
+	// one to see a key stop working immediately.
+	replacedKey := ts.currentKey("fw-1")
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{"overlap": "0s"}))
+	err := ts.loginWithSecret("task.abc-124", taskSecret(replacedKey, "task.abc-124"))
+	ts.EqualError(err, "permission denied: bad-task-secret: missing or invalid task secret for framework fw-1")
+}
+
+// Tasks whose frameworks have no key don't need task secrets, including after
+// the key has been deleted.
+func (ts *FrameworkKeysTests) Test_login_no_key() {
+	ts.setupFrameworkTask("task.abc-123")
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-2"), jsonobj{}))
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	ts.HandleRequestSuccess(ts.mkDeleteReq(fkKey("fw-1")))
+
+	ts.NoError(ts.loginWithSecret("task.abc-123", ""))
+}
+
+// A login check explains the task secret step.
+func (ts *FrameworkKeysTests) Test_login_check() {
+	ts.setupFrameworkTask("task.abc-123")
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	key := ts.currentKey("fw-1")
+
+	req := ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "task-secret": taskSecret(key, "task.abc-123")})
+	data := ts.HandleRequest(req).Data
+	ts.Equal(data["allowed"], true)
+	ts.Contains(data["steps"], jsonobj{"step": "task-secret", "result": "ok", "detail": "task secret is valid"})
+}
+
+// A task whose framework the master can't tell us about still needs a task
+// secret if its framework ID has a key.
+func (ts *FrameworkKeysTests) Test_login_unknown_framework() {
+	ts.SetupLoginTasks(jsonobj{}, mkFrameworkTasks("task.abc-123", "task.abc-124")...)
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	key := ts.currentKey("fw-1")
+
+	err := ts.loginWithSecret("task.abc-123", "")
+	ts.EqualError(err, "permission denied: bad-task-secret: missing or invalid task secret for framework fw-1")
+	ts.NoError(ts.loginWithSecret("task.abc-124", taskSecret(key, "task.abc-124")))
+}
+
+// Keys belong to framework IDs, so another framework with the same name
+// doesn't share them.
+func (ts *FrameworkKeysTests) Test_login_same_name() {
+	ts.setupFrameworkTask("task.abc-123")
+	ts.AddFramework(mkFramework("marathon", "fw-2", ""))
+	task := mkTask("task", "task.abc-124", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-2"}
+	ts.AddTask(task)
+	ts.HandleRequestSuccess(ts.mkReq(fkKey("fw-1"), jsonobj{}))
+	key := ts.currentKey("fw-1")
+
+	err := ts.loginWithSecret("task.abc-123", "")
+	ts.EqualError(err, "permission denied: bad-task-secret: missing or invalid task secret for framework fw-1")
+	ts.NoError(ts.loginWithSecret("task.abc-123", taskSecret(key, "task.abc-123")))
+	ts.NoError(ts.loginWithSecret("task.abc-124", ""))
+}
+
+// Task secrets are only valid for keys that haven't expired.
+func (ts *FrameworkKeysTests) Test_verifyTaskSecret() {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	fks := frameworkKeys{Keys: []frameworkKey{
+		{Key: []byte("old"), Expires: now.Add(time.Minute)},
+		{Key: []byte("new")},
+	}}
+
+	ts.True(fks.verifyTaskSecret("task.abc-123", taskSecret([]byte("new"), "task.abc-123"), now))
+	ts.True(fks.verifyTaskSecret("task.abc-123", taskSecret([]byte("old"), "task.abc-123"), now))
+	ts.False(fks.verifyTaskSecret("task.abc-123", taskSecret([]byte("old"), "task.abc-123"), now.Add(time.Minute)))
+	ts.False(fks.verifyTaskSecret("task.abc-123", taskSecret([]byte("other"), "task.abc-123"), now))
+	ts.False(fks.verifyTaskSecret("task.abc-123", "", now))
+}
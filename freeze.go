@@ -0,0 +1,157 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+)
+
+// pathConfigFreeze returns the "config/freeze" path struct. It is a function
+// rather than a method because we never call it once the backend struct is
+// built and we don't want name collisions with any request handler methods.
+func pathConfigFreeze(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "config/freeze",
+		Fields: map[string]*framework.FieldSchema{
+			"reason": {
+				Type:        framework.TypeString,
+				Description: "Why logins are frozen. This is logged with every denied login.",
+			},
+			"prefixes": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Task ID prefixes to freeze. If neither prefixes nor frameworks are given, all logins are frozen.",
+			},
+			"frameworks": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: "Names of frameworks whose tasks are frozen.",
+			},
+			"renewals": {
+				Type:        framework.TypeBool,
+				Description: "Also refuse to renew tokens for frozen tasks.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathConfigFreezeUpdate,
+			logical.ReadOperation:   b.pathConfigFreezeRead,
+			logical.DeleteOperation: b.pathConfigFreezeDelete,
+		},
+	}
+}
+
+// freeze describes which logins (and possibly renewals) we refuse during an
+// incident. A freeze with no prefixes or frameworks applies to everything.
+type freeze struct {
+	Reason     string
+	Prefixes   []string
+	Frameworks []string
+	Renewals   bool
+	Since      time.Time
+}
+
+// global checks whether the freeze applies to all tasks.
+func (fr *freeze) global() bool {
+	return len(fr.Prefixes) == 0 && len(fr.Frameworks) == 0
+}
+
+// blocksPrefix checks whether the freeze applies to tasks with the given
+// prefix, regardless of their framework.
+func (fr *freeze) blocksPrefix(prefix string) bool {
+	return fr.global() || strutil.StrListContains(fr.Prefixes, prefix)
+}
+
+// blocksFramework checks whether the freeze applies to tasks belonging to the
+// given framework, which may be nil if Mesos doesn't know it.
+func (fr *freeze) blocksFramework(fw *mesos.FrameworkInfo) bool {
+	return fw != nil && strutil.StrListContains(fr.Frameworks, fw.Name)
+}
+
+// detail describes the freeze for denial messages.
+func (fr *freeze) detail() string {
+	return "logins are frozen: " + fr.Reason
+}
+
+// denyFrozenRenewal logs a renewal denied by a freeze and returns the error
+// to deny it with.
+func (b *mesosBackend) denyFrozenRenewal(taskID string, fr *freeze) error {
+	b.Logger().Info("RENEW DENIED", "task-id", taskID, "reason", "renewals are frozen: "+fr.Reason)
+	return fmt.Errorf("renewals are frozen: %s", fr.Reason)
+}
+
+// data returns the freeze in a form suitable for a read response. A nil
+// freeze has no data.
+func (fr *freeze) data() jsonobj {
+	if fr == nil {
+		return nil
+	}
+	return jsonobj{
+		"reason":     fr.Reason,
+		"prefixes":   fr.Prefixes,
+		"frameworks": fr.Frameworks,
+		"renewals":   fr.Renewals,
+		"since":      fr.Since.UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// pathConfigFreezeUpdate is the "config/freeze" update request handler. It
+// replaces any existing freeze. The freeze is stored in the config so that we
+// see it on every login without any extra storage reads.
+func (b *mesosBackend) pathConfigFreezeUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	reason := d.Get("reason").(string)
+	if reason == "" {
+		return logical.ErrorResponse("missing reason"), nil
+	}
+	cfg.Freeze = &freeze{
+		Reason:     reason,
+		Prefixes:   d.Get("prefixes").([]string),
+		Frameworks: d.Get("frameworks").([]string),
+		Renewals:   d.Get("renewals").(bool),
+		Since:      time.Now(),
+	}
+
+	b.Logger().Warn("LOGINS FROZEN",
+		"reason", reason,
+		"prefixes", cfg.Freeze.Prefixes,
+		"frameworks", cfg.Freeze.Frameworks,
+		"renewals", cfg.Freeze.Renewals)
+
+	err = rh.store("config", cfg)
+	return &logical.Response{}, err
+}
+
+// pathConfigFreezeRead is the "config/freeze" read request handler.
+func (b *mesosBackend) pathConfigFreezeRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfigOrNil()
+	if cfg == nil || cfg.Freeze == nil || err != nil {
+		return nil, err
+	}
+	return &logical.Response{Data: cfg.Freeze.data()}, nil
+}
+
+// pathConfigFreezeDelete is the "config/freeze" delete request handler. It
+// lifts any freeze.
+func (b *mesosBackend) pathConfigFreezeDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfigOrNil()
+	if cfg == nil || cfg.Freeze == nil || err != nil {
+		return nil, err
+	}
+	cfg.Freeze = nil
+
+	b.Logger().Warn("LOGINS UNFROZEN")
+	return nil, rh.store("config", cfg)
+}
@@ -0,0 +1,165 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// FreezeTests is a testify test suite object that we can attach helper
+// methods to.
+type FreezeTests struct{ TestSuite }
+
+// Test_Freeze is a standard Go test function that runs our test suite's
+// tests.
+func Test_Freeze(t *testing.T) { suite.Run(t, new(FreezeTests)) }
+
+// setupFreezeTasks sets up a backend with the given config and running tasks
+// for each of two prefixes, one of which belongs to a marathon framework.
+func (ts *FreezeTests) setupFreezeTasks(cfg jsonobj) {
+	tasks := []mesos.Task{
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING),
+	}
+	for _, id := range []string{"app.abc-123", "app.abc-124"} {
+		task := mkTask("app", id, mesos.TASK_RUNNING)
+		task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+		tasks = append(tasks, task)
+	}
+	ts.SetupLoginTasks(cfg, tasks...)
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+}
+
+// A freeze can be set, read (on its own and with the config) and lifted.
+func (ts *FreezeTests) Test_freeze_read_delete() {
+	ts.SetupBackendWithMesos()
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("config/freeze")))
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("config")).Data["freeze"])
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{
+		"reason":   "incident 42",
+		"prefixes": "task,other",
+		"renewals": true,
+	}))
+	data := ts.HandleRequest(ts.mkReadReq("config/freeze")).Data
+	ts.NotEmpty(data["since"])
+	delete(data, "since")
+	ts.Equal(data, jsonobj{
+		"reason":     "incident 42",
+		"prefixes":   []string{"task", "other"},
+		"frameworks": []string{},
+		"renewals":   true,
+	})
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("config")).Data["freeze"].(jsonobj)["reason"], "incident 42")
+
+	// Writing the rest of the config doesn't lift the freeze.
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"skip-verify": true, "period": "5m"}))
+	ts.NotNil(ts.HandleRequest(ts.mkReadReq("config/freeze")))
+
+	ts.HandleRequestSuccess(ts.mkDeleteReq("config/freeze"))
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("config/freeze")))
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("config")).Data["freeze"])
+}
+
+// A freeze needs a reason and a config to freeze.
+func (ts *FreezeTests) Test_freeze_invalid() {
+	ts.SetupBackend()
+	ts.HandleRequestError(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42"}), "backend not configured")
+
+	ts.ConfigureBackend("http://master.mesos:5050")
+	resp := ts.HandleRequest(ts.mkReq("config/freeze", jsonobj{}))
+	ts.Equal(resp, logical.ErrorResponse("missing reason"))
+}
+
+// Logins denied by a freeze don't count towards a lockout, so lifting the
+// freeze lets the agents that retried during it log in.
+func (ts *FreezeTests) Test_freeze_no_lockout() {
+	ts.setupFreezeTasks(jsonobj{
+		"lockout-threshold": 3,
+		"lockout-window":    "1m",
+		"lockout-duration":  "1h",
+	})
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42"}))
+
+	for i := 0; i < 3; i++ {
+		req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+		req.Connection.RemoteAddr = "10.0.0.5"
+		_, err := ts.HandleRequestRaw(req)
+		ts.EqualError(err, "permission denied: frozen: logins are frozen: incident 42")
+	}
+
+	ts.HandleRequestSuccess(ts.mkDeleteReq("config/freeze"))
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	req.Connection.RemoteAddr = "10.0.0.5"
+	ts.WithoutError(ts.HandleRequestRaw(req))
+}
+
+// A global freeze stops all logins, and lifting it lets them through again.
+func (ts *FreezeTests) Test_login_global() {
+	ts.setupFreezeTasks(jsonobj{})
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42"}))
+
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: frozen: logins are frozen: incident 42")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "app.abc-123"}),
+		"permission denied: frozen: logins are frozen: incident 42")
+
+	ts.HandleRequestSuccess(ts.mkDeleteReq("config/freeze"))
+	ts.Login("task.abc-123")
+}
+
+// A freeze can apply to some prefixes or frameworks only.
+func (ts *FreezeTests) Test_login_selected() {
+	ts.setupFreezeTasks(jsonobj{})
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42", "prefixes": "task"}))
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: frozen: logins are frozen: incident 42")
+	ts.Login("app.abc-123")
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 43", "frameworks": "marathon"}))
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "app.abc-124"}),
+		"permission denied: frozen: logins are frozen: incident 43")
+	ts.Login("task.abc-124")
+}
+
+// Renewals are still allowed during a freeze unless the freeze says
+// otherwise.
+func (ts *FreezeTests) Test_renewals() {
+	ts.setupFreezeTasks(jsonobj{})
+	taskAuth := ts.Login("task.abc-123")
+	appAuth := ts.Login("app.abc-123")
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42"}))
+	ts.WithoutError(ts.HandleRequestRaw(ts.mkRenew(taskAuth)))
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42", "renewals": true}))
+	ts.HandleRequestError(ts.mkRenew(taskAuth), "renewals are frozen: incident 42")
+
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{
+		"reason":     "incident 43",
+		"frameworks": "marathon",
+		"renewals":   true,
+	}))
+	ts.WithoutError(ts.HandleRequestRaw(ts.mkRenew(taskAuth)))
+	ts.HandleRequestError(ts.mkRenew(appAuth), "renewals are frozen: incident 43")
+}
+
+// A login check explains a freeze.
+func (ts *FreezeTests) Test_login_check() {
+	ts.setupFreezeTasks(jsonobj{})
+	ts.HandleRequestSuccess(ts.mkReq("config/freeze", jsonobj{"reason": "incident 42"}))
+
+	data := ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data
+	ts.Equal(data["denial-reason"], "frozen")
+	ts.Contains(data["steps"], jsonobj{
+		"step":   "freeze",
+		"result": "denied",
+		"reason": "frozen",
+		"detail": "logins are frozen: incident 42",
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"os"
 	"time"
 
+	metrics "github.com/armon/go-metrics"
 	log "github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/helper/logging"
 	"github.com/hashicorp/vault/logical"
@@ -22,6 +23,7 @@ type TestSuite struct {
 	storage   logical.Storage
 	fakeMesos *mctesting.FakeMesos
 	backend   *mesosBackend
+	metrics   *metrics.InmemSink
 }
 
 // SetupTest clears all our TestSuite state at the start of each test, because
@@ -32,6 +34,7 @@ func (ts *TestSuite) SetupTest() {
 	ts.storage = nil
 	ts.fakeMesos = nil
 	ts.backend = nil
+	ts.metrics = nil
 }
 
 // SetupBackend creates an unconfigured backend object (and associated storage
@@ -46,6 +49,14 @@ func (ts *TestSuite) SetupBackend() {
 	}
 
 	ts.backend = ts.WithoutError(Factory(context.Background(), config)).(*mesosBackend)
+
+	// We give the backend its own metrics so that we can look at them
+	// without interference from other tests.
+	ts.metrics = metrics.NewInmemSink(time.Minute, time.Minute)
+	metricsConfig := metrics.DefaultConfig("")
+	metricsConfig.EnableHostname = false
+	metricsConfig.EnableRuntimeMetrics = false
+	ts.backend.metrics = ts.WithoutError(metrics.New(metricsConfig, ts.metrics)).(*metrics.Metrics)
 }
 
 // SetupBackendWithMesos creates a FakeMesos and a backend configured to use
@@ -105,6 +116,32 @@ func (ts *TestSuite) AddTask(tasks ...mesos.Task) {
 	ts.fakeMesos.AddTask(tasks...)
 }
 
+// AddFramework adds one or more new frameworks to fake Mesos. Panics if a
+// framework already exists.
+func (ts *TestSuite) AddFramework(frameworks ...mesos.FrameworkInfo) {
+	ts.requireFakeMesos()
+	ts.fakeMesos.AddFramework(frameworks...)
+}
+
+// AddAgent adds one or more new agents to fake Mesos. Panics if an agent
+// already exists.
+func (ts *TestSuite) AddAgent(agents ...mesos.AgentInfo) {
+	ts.requireFakeMesos()
+	ts.fakeMesos.AddAgent(agents...)
+}
+
+// SetAgentPID sets the PID fake Mesos reports for an agent.
+func (ts *TestSuite) SetAgentPID(agentID, pid string) {
+	ts.requireFakeMesos()
+	ts.fakeMesos.SetAgentPID(agentID, pid)
+}
+
+// StartAgent starts a fake agent with the given ID and adds it to fake Mesos.
+func (ts *TestSuite) StartAgent(agentID string) *mctesting.FakeAgent {
+	ts.requireFakeMesos()
+	return ts.fakeMesos.StartAgent(agentID)
+}
+
 // RemoveTask removes one or more tasks by id. Missing tasks are ignored.
 func (ts *TestSuite) RemoveTask(taskIDs ...string) {
 	ts.requireFakeMesos()
@@ -118,6 +155,32 @@ func (ts *TestSuite) UpdateTask(updateFunc mctesting.TaskUpdateFunc, taskIDs ...
 	ts.fakeMesos.UpdateTask(updateFunc, taskIDs...)
 }
 
+// MetricCount returns the number of times the given counter or timer key
+// (including any labels) has been recorded.
+func (ts *TestSuite) MetricCount(key string) int {
+	count := 0
+	for _, interval := range ts.metrics.Data() {
+		if sv, ok := interval.Counters[key]; ok {
+			count += sv.Count
+		}
+		if sv, ok := interval.Samples[key]; ok {
+			count += sv.Count
+		}
+	}
+	return count
+}
+
+// GaugeValue returns the most recent value of the given gauge key (including
+// any labels), and whether it has been set at all.
+func (ts *TestSuite) GaugeValue(key string) (float32, bool) {
+	for _, interval := range ts.metrics.Data() {
+		if gv, ok := interval.Gauges[key]; ok {
+			return gv.Value, true
+		}
+	}
+	return 0, false
+}
+
 // mkReq builds a basic update request object.
 func (ts *TestSuite) mkReq(path string, data jsonobj) *logical.Request {
 	return &logical.Request{
@@ -139,6 +202,38 @@ func (ts *TestSuite) mkReadReq(path string) *logical.Request {
 	}
 }
 
+// mkListReq builds a basic list request object.
+func (ts *TestSuite) mkListReq(path string) *logical.Request {
+	return &logical.Request{
+		Operation:  logical.ListOperation,
+		Connection: &logical.Connection{},
+		Path:       path,
+		Storage:    ts.storage,
+	}
+}
+
+// mkDeleteReq builds a basic delete request object.
+func (ts *TestSuite) mkDeleteReq(path string) *logical.Request {
+	return &logical.Request{
+		Operation:  logical.DeleteOperation,
+		Connection: &logical.Connection{},
+		Path:       path,
+		Storage:    ts.storage,
+	}
+}
+
+// mkRenew builds a renewal request.
+func (ts *TestSuite) mkRenew(auth *logical.Auth) *logical.Request {
+	return &logical.Request{
+		Operation:       "renew",
+		Path:            "login",
+		Auth:            auth,
+		Unauthenticated: false,
+		Storage:         ts.storage,
+		Connection:      &logical.Connection{},
+	}
+}
+
 // HandleRequestRaw is a thin wrapper around the backend's HandleRequest method
 // to avoid some boilerplate in the tests.
 func (ts *TestSuite) HandleRequestRaw(req *logical.Request) (*logical.Response, error) {
@@ -178,15 +273,53 @@ func (ts *TestSuite) GetStored(key string) *logical.StorageEntry {
 	return ts.WithoutError(ts.storage.Get(context.Background(), key)).(*logical.StorageEntry)
 }
 
-// PutStored writes a value to Vault storage.
+// PutStored writes a value to Vault storage behind the backend's back, the
+// way another node in the cluster would. Like Vault, we tell the backend about
+// the write.
 func (ts *TestSuite) PutStored(key string, value interface{}) {
 	ts.Require().NoError(
 		ts.storage.Put(context.Background(), ts.mkStorageEntry(key, value)))
+	ts.backend.InvalidateKey(context.Background(), key)
 }
 
-// DeleteStored removes a value from Vault storage.
+// racingStorage runs a function just before the first read of a particular
+// storage key, so that tests can make another request get in first.
+type racingStorage struct {
+	logical.Storage
+	key    string
+	before func()
+}
+
+func (rs *racingStorage) Get(ctx context.Context, key string) (*logical.StorageEntry, error) {
+	if key == rs.key && rs.before != nil {
+		before := rs.before
+		rs.before = nil
+		before()
+	}
+	return rs.Storage.Get(ctx, key)
+}
+
+// LoginLosingRace makes a login request for a task that another node records
+// as logged in just before we read the given storage key, after our first
+// replay check has passed.
+func (ts *TestSuite) LoginLosingRace(key string, data jsonobj) error {
+	taskID := data["task-id"].(string)
+	prefix, err := taskIDPrefix(taskID)
+	ts.Require().NoError(err)
+	req := ts.mkReq("login", data)
+	req.Storage = &racingStorage{Storage: ts.storage, key: key, before: func() {
+		ts.PutStored(tiKey(prefix), taskInstances{TaskIDs: map[string]bool{taskID: true}})
+	}}
+	_, err = ts.HandleRequestRaw(req)
+	return err
+}
+
+// DeleteStored removes a value from Vault storage behind the backend's back,
+// the way another node in the cluster would. Like Vault, we tell the backend
+// about the delete.
 func (ts *TestSuite) DeleteStored(key string) {
 	ts.Require().NoError(ts.storage.Delete(context.Background(), key))
+	ts.backend.InvalidateKey(context.Background(), key)
 }
 
 // mkStorageEntry builds a StorageEntry object with errors handled.
@@ -205,7 +338,65 @@ func (ts *TestSuite) SetTaskPolicies(taskPrefix string, policies ...string) {
 	ts.HandleRequestSuccess(ts.mkReq("task-policies", tpParams(taskPrefix, policies)))
 }
 
+// SetTaskImagePolicies sets task policies restricted to the given
+// comma-separated image patterns through the API.
+func (ts *TestSuite) SetTaskImagePolicies(taskPrefix string, images string, policies ...string) {
+	params := tpParams(taskPrefix, policies)
+	params["images"] = images
+	ts.HandleRequestSuccess(ts.mkReq("task-policies", params))
+}
+
+// SetTaskTokenPolicies sets task policies with the given token settings
+// through the API.
+func (ts *TestSuite) SetTaskTokenPolicies(taskPrefix string, settings jsonobj, policies ...string) {
+	params := tpParams(taskPrefix, policies)
+	for k, v := range settings {
+		params[k] = v
+	}
+	ts.HandleRequestSuccess(ts.mkReq("task-policies", params))
+}
+
+// SetupLoginTasks creates a backend with FakeMesos and the given tasks, maps
+// each task's prefix to the "insurance" policy, and configures the backend to
+// explain login denials. Any config settings given are added to (or override)
+// those.
+func (ts *TestSuite) SetupLoginTasks(cfg jsonobj, tasks ...mesos.Task) {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(tasks...)
+	prefixes := map[string]bool{}
+	for _, task := range tasks {
+		prefix, err := taskIDPrefix(task.TaskID.Value)
+		ts.Require().NoError(err)
+		if !prefixes[prefix] {
+			prefixes[prefix] = true
+			ts.SetTaskPolicies(prefix, "insurance")
+		}
+	}
+	settings := jsonobj{"expose-denial-reasons": true, "skip-verify": true}
+	for k, v := range cfg {
+		settings[k] = v
+	}
+	ts.HandleRequestSuccess(ts.mkReq("config", settings))
+}
+
+// SetupLoginTask is SetupLoginTasks for a single running task.
+func (ts *TestSuite) SetupLoginTask(taskID string, cfg jsonobj) {
+	prefix, err := taskIDPrefix(taskID)
+	ts.Require().NoError(err)
+	ts.SetupLoginTasks(cfg, mkTask(prefix, taskID, mesos.TASK_RUNNING))
+}
+
 // tpParams removes boilerplate from request creation.
 func tpParams(taskPrefix string, policies interface{}) jsonobj {
 	return jsonobj{"task-id-prefix": taskPrefix, "policies": policies}
 }
+
+// SetRolePolicies sets Mesos role policies through the API.
+func (ts *TestSuite) SetRolePolicies(role string, policies ...string) {
+	ts.HandleRequestSuccess(ts.mkReq(rpKey(role), jsonobj{"policies": policies}))
+}
+
+// SetPrincipalPolicies sets framework principal policies through the API.
+func (ts *TestSuite) SetPrincipalPolicies(principal string, policies ...string) {
+	ts.HandleRequestSuccess(ts.mkReq(ppKey(principal), jsonobj{"policies": policies}))
+}
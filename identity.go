@@ -0,0 +1,178 @@
+package mesosauth
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+)
+
+// These constants are the valid values for the "alias-source" config setting,
+// which determines what we name the identity alias for a logged-in task.
+const (
+	// aliasTaskPrefix uses the task ID prefix.
+	aliasTaskPrefix = "task-prefix"
+	// aliasAppID uses the Marathon app ID derived from the task ID prefix.
+	aliasAppID = "app-id"
+	// aliasFrameworkTask uses the framework name and the task name.
+	aliasFrameworkTask = "framework-task-name"
+)
+
+// aliasSources lists the valid alias sources.
+var aliasSources = []string{aliasTaskPrefix, aliasAppID, aliasFrameworkTask}
+
+// taskIdentity collects everything we know about a task that is relevant to
+// its identity in Vault. The framework and agent may be nil if Mesos doesn't
+// know about them.
+type taskIdentity struct {
+	prefix    string
+	task      *mesos.Task
+	framework *mesos.FrameworkInfo
+	agent     *mesos.AgentInfo
+}
+
+// aliasName builds the identity alias name for a task according to the given
+// alias source.
+func (ti *taskIdentity) aliasName(source string) string {
+	switch source {
+	case aliasAppID:
+		return marathonAppID(ti.prefix)
+	case aliasFrameworkTask:
+		// If we don't know the framework name, the ID is the next best thing.
+		fwName := ti.task.FrameworkID.Value
+		if ti.framework != nil {
+			fwName = ti.framework.Name
+		}
+		return fwName + "/" + ti.task.Name
+	}
+	// Configs written before we had alias sources don't have one, so we
+	// treat anything unknown as the default.
+	return ti.prefix
+}
+
+// metadata builds the auth metadata for a task, including the values of any
+// of the given label keys that the task has.
+func (ti *taskIdentity) metadata(labelKeys []string) map[string]string {
+	md := map[string]string{
+		"task-id":      ti.task.TaskID.Value,
+		"task-name":    ti.task.Name,
+		"task-prefix":  ti.prefix,
+		"framework-id": ti.task.FrameworkID.Value,
+		"agent-id":     ti.task.AgentID.Value,
+	}
+	if ti.framework != nil {
+		md["framework-name"] = ti.framework.Name
+	}
+	if ti.agent != nil {
+		md["agent-hostname"] = ti.agent.Hostname
+	}
+	for _, key := range labelKeys {
+		if value, ok := taskLabel(ti.task, key); ok {
+			md["label-"+key] = value
+		}
+	}
+	return md
+}
+
+// groupAliases builds the identity group aliases for a task from its
+// framework name, its Mesos roles and the values of any of the given label
+// keys that the task has. Each kind of alias has its own prefix so that, for
+// example, a label can't masquerade as a role.
+func (ti *taskIdentity) groupAliases(labelKeys []string) []*logical.Alias {
+	var aliases []*logical.Alias
+	add := func(name string) { aliases = append(aliases, &logical.Alias{Name: name}) }
+
+	if ti.framework != nil {
+		add("framework:" + ti.framework.Name)
+	}
+	for _, role := range taskRoles(ti.task) {
+		add("role:" + role)
+	}
+	for _, key := range labelKeys {
+		if value, ok := taskLabel(ti.task, key); ok {
+			add("label:" + key + "=" + value)
+		}
+	}
+	return aliases
+}
+
+// marathonAppID converts a task ID prefix to the Marathon app ID it was
+// generated from. Marathon replaces the slashes in app IDs with underscores,
+// which are not allowed in app IDs, so this is unambiguous.
+func marathonAppID(prefix string) string {
+	return "/" + strings.Replace(prefix, "_", "/", -1)
+}
+
+// taskLabel looks up a task label by key. Labels without values have empty
+// values, but still exist.
+func taskLabel(task *mesos.Task, key string) (string, bool) {
+	if task.Labels == nil {
+		return "", false
+	}
+	for _, label := range task.Labels.Labels {
+		if label.Key == key {
+			if label.Value == nil {
+				return "", true
+			}
+			return *label.Value, true
+		}
+	}
+	return "", false
+}
+
+// pathLoginAliasLookahead is the "login" alias lookahead request handler. It
+// tells Vault which identity alias a login would use, without actually
+// logging in.
+func (b *mesosBackend) pathLoginAliasLookahead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// An empty taskID has no prefix, so we don't need to check for it
+	// separately.
+	taskID := d.Get("task-id").(string)
+	prefix, err := taskIDPrefix(taskID)
+	if err != nil {
+		return nil, logical.ErrPermissionDenied
+	}
+
+	ti := taskIdentity{prefix: prefix}
+
+	// We only need to ask Mesos about the task if the alias depends on more
+	// than the task ID. We ask the same way the login will, so that they
+	// agree about the task.
+	if cfg.AliasSource == aliasFrameworkTask {
+		remoteAddr := ""
+		if req.Connection != nil {
+			remoteAddr = req.Connection.RemoteAddr
+		}
+		src, err := b.taskSource(ctx, cfg, b.mesosClient(cfg), remoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		if src == nil {
+			return nil, logical.ErrPermissionDenied
+		}
+		rgt, err := src.getTasks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ti.task = b.findRunningTask(taskID, rgt); ti.task == nil {
+			return nil, logical.ErrPermissionDenied
+		}
+		if ti.framework, err = src.getFramework(ctx, ti.task.FrameworkID.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return &logical.Response{
+		Auth: &logical.Auth{
+			Alias: &logical.Alias{Name: ti.aliasName(cfg.AliasSource)},
+		},
+	}, nil
+}
@@ -0,0 +1,84 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// IdentityTests is a testify test suite object that we can attach helper
+// methods to.
+type IdentityTests struct{ TestSuite }
+
+// Test_Identity is a standard Go test function that runs our test suite's
+// tests.
+func Test_Identity(t *testing.T) { suite.Run(t, new(IdentityTests)) }
+
+// Task prefixes convert to Marathon app IDs.
+func (ts *IdentityTests) Test_marathonAppID() {
+	ts.Equal(marathonAppID("web"), "/web")
+	ts.Equal(marathonAppID("team_web"), "/team/web")
+	ts.Equal(marathonAppID("org_team_web-v2"), "/org/team/web-v2")
+}
+
+// Alias names depend on the alias source.
+func (ts *IdentityTests) Test_aliasName() {
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	fw := mkFramework("marathon", "fw-1", "")
+
+	ti := taskIdentity{prefix: "team_web", task: &task}
+	ts.Equal(ti.aliasName(aliasTaskPrefix), "team_web")
+	ts.Equal(ti.aliasName(""), "team_web")
+	ts.Equal(ti.aliasName(aliasAppID), "/team/web")
+	// Without a framework, we use the framework ID.
+	ts.Equal(ti.aliasName(aliasFrameworkTask), "fw-1/web")
+	ti.framework = &fw
+	ts.Equal(ti.aliasName(aliasFrameworkTask), "marathon/web")
+}
+
+// Group aliases come from the framework, roles and selected labels.
+func (ts *IdentityTests) Test_groupAliases() {
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	ti := taskIdentity{prefix: "team_web", task: &task}
+	ts.Nil(ti.groupAliases([]string{"team"}))
+
+	fw := mkFramework("marathon", "fw-1", "")
+	ti.framework = &fw
+	task.Resources = []mesos.Resource{mkResource("cpus", "web"), mkResource("mem", "web")}
+	task.Labels = &mesos.Labels{Labels: []mesos.Label{
+		{Key: "team", Value: strptr("platform")},
+		{Key: "env", Value: strptr("prod")},
+	}}
+	ts.Equal(ti.groupAliases([]string{"team", "missing"}), []*logical.Alias{
+		{Name: "framework:marathon"},
+		{Name: "role:web"},
+		{Name: "label:team=platform"},
+	})
+}
+
+// Labels are looked up by key, and may have no value.
+func (ts *IdentityTests) Test_taskLabel() {
+	task := mkTask("web", "team_web.abc-123", mesos.TASK_RUNNING)
+	ts.Equal(ts.label(taskLabel(&task, "team")), "<missing>")
+
+	task.Labels = &mesos.Labels{Labels: []mesos.Label{
+		{Key: "team", Value: strptr("platform")},
+		{Key: "canary"},
+	}}
+	ts.Equal(ts.label(taskLabel(&task, "team")), "platform")
+	ts.Equal(ts.label(taskLabel(&task, "canary")), "")
+	ts.Equal(ts.label(taskLabel(&task, "env")), "<missing>")
+}
+
+// label squashes taskLabel's return values for easier assertions.
+func (ts *IdentityTests) label(value string, ok bool) string {
+	if !ok {
+		return "<missing>"
+	}
+	return value
+}
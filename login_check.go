@@ -0,0 +1,463 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/vault/helper/strutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+)
+
+// pathLoginCheck returns the "login-check" path struct. It is a function
+// rather than a method because we never call it once the backend struct is
+// built and we don't want name collisions with any request handler methods.
+func pathLoginCheck(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "login-check",
+		Fields: map[string]*framework.FieldSchema{
+			"task-id":     {Type: framework.TypeString},
+			"task-secret": {Type: framework.TypeString},
+			"secret-id":   {Type: framework.TypeString},
+			"remote-addr": {
+				Type:        framework.TypeString,
+				Description: "Address to check against login-cidrs, as if the login came from there.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathLoginCheck,
+		},
+	}
+}
+
+// denialReason is a machine-readable reason for denying a login.
+type denialReason string
+
+// These constants are the reasons we deny logins for.
+const (
+	denyMalformedTaskID     denialReason = "malformed-task-id"
+	denyNoPolicyMapping     denialReason = "no-policy-mapping"
+	denyAlreadyLoggedIn     denialReason = "already-logged-in"
+	denyTaskNotRunning      denialReason = "task-not-running"
+	denyImageNotAllowed     denialReason = "image-not-allowed"
+	denyFrameworkNotAllowed denialReason = "framework-not-allowed"
+	denyMesosError          denialReason = "mesos-error"
+	denyStorageError        denialReason = "storage-error"
+	denyRateLimited         denialReason = "rate-limited"
+	denyLockedOut           denialReason = "locked-out"
+	denyNotPreauthorized    denialReason = "not-preauthorized"
+	denyBadTaskSecret       denialReason = "bad-task-secret"
+	denyBadSecretID         denialReason = "bad-secret-id"
+	denyFrozen              denialReason = "frozen"
+	denyAddressNotAllowed   denialReason = "address-not-allowed"
+	denyNoRemoteAddress     denialReason = "no-remote-address"
+	denyTaskAge             denialReason = "task-age"
+	denyUnknownAgent        denialReason = "unknown-agent"
+)
+
+// loginDenial describes why we denied a login.
+type loginDenial struct {
+	reason denialReason
+	detail string
+}
+
+// logLevel returns the level to log a denial at. Ordinary client mistakes are
+// informational, anything that might indicate an attack is a warning, and
+// failures on our side are errors.
+func (ld *loginDenial) logLevel() log.Level {
+	switch ld.reason {
+	case denyAlreadyLoggedIn, denyImageNotAllowed, denyFrameworkNotAllowed, denyRateLimited, denyLockedOut, denyNotPreauthorized, denyBadTaskSecret, denyBadSecretID, denyAddressNotAllowed, denyNoRemoteAddress, denyTaskAge, denyUnknownAgent:
+		return log.Warn
+	case denyMesosError, denyStorageError:
+		return log.Error
+	}
+	return log.Info
+}
+
+// loginDecision holds everything we worked out while evaluating a login,
+// including an explanation of each step we took.
+type loginDecision struct {
+	taskID       string
+	prefix       string
+	policySource string
+	tp           *taskPolicies
+	policies     []string
+	task         *mesos.Task
+	framework    *mesos.FrameworkInfo
+	agent        *mesos.AgentInfo
+	steps        []jsonobj
+	denial       *loginDenial
+	// unknownTask is set if Mesos has never heard of the task, which
+	// suggests someone is guessing task IDs.
+	unknownTask bool
+}
+
+// pass records a step that the login passed.
+func (ld *loginDecision) pass(step string, detail string) {
+	ld.steps = append(ld.steps, jsonobj{"step": step, "result": "ok", "detail": detail})
+}
+
+// fail records a step that the login failed and the reason for the denial,
+// and returns the given error for the caller to return.
+func (ld *loginDecision) fail(step string, reason denialReason, detail string, err error) error {
+	ld.steps = append(ld.steps, jsonobj{
+		"step":   step,
+		"result": "denied",
+		"reason": string(reason),
+		"detail": detail,
+	})
+	ld.denial = &loginDenial{reason: reason, detail: detail}
+	return err
+}
+
+// loginSecrets holds the secrets a task may present when it logs in. Which
+// ones it needs depends on its task-policies entry and its framework.
+type loginSecrets struct {
+	taskSecret string
+	secretID   string
+}
+
+// loginSecretsFromData gets the login secrets from a request.
+func loginSecretsFromData(d *framework.FieldData) loginSecrets {
+	return loginSecrets{
+		taskSecret: d.Get("task-secret").(string),
+		secretID:   d.Get("secret-id").(string),
+	}
+}
+
+// evaluateLogin runs all the login checks for a task and, unless dryRun is
+// set, marks the task as logged in if they all pass. A denied login returns
+// ErrPermissionDenied, and the returned decision always explains how far we
+// got.
+func (b *mesosBackend) evaluateLogin(ctx context.Context, rh *requestHelper, cfg *config, taskID string, conn *logical.Connection, secrets loginSecrets, dryRun bool) (*loginDecision, error) {
+	ld := &loginDecision{taskID: taskID}
+
+	// The login endpoint is unauthenticated, so we check where the request
+	// came from before we do anything else. Vault gives us connection
+	// information for every real request, and without it we can't tell where
+	// the login came from.
+	if conn == nil {
+		return ld, ld.fail("remote-address", denyNoRemoteAddress,
+			"request has no connection information", logical.ErrPermissionDenied)
+	}
+	remoteAddr := conn.RemoteAddr
+	if err := ld.checkRemoteAddress(remoteAddr, cfg.LoginCIDRs, "global"); err != nil {
+		return ld, err
+	}
+
+	// An empty taskID has no prefix, so we don't need to check for it
+	// separately.
+	prefix, err := taskIDPrefix(taskID)
+	if err != nil {
+		return ld, ld.fail("task-id", denyMalformedTaskID, err.Error(), logical.ErrPermissionDenied)
+	}
+	ld.prefix = prefix
+	ld.pass("task-id", "prefix is "+prefix)
+
+	// A freeze is meant to stop logins immediately, so we check it before
+	// doing any real work.
+	if cfg.Freeze != nil && cfg.Freeze.blocksPrefix(prefix) {
+		return ld, ld.fail("freeze", denyFrozen, cfg.Freeze.detail(), logical.ErrPermissionDenied)
+	}
+
+	tp, err := rh.getTaskPoliciesOrNil(prefix)
+	if err != nil {
+		return ld, ld.fail("policy-mapping", denyStorageError, err.Error(), err)
+	}
+
+	// If there's no explicit mapping for this prefix, we fall back to the
+	// default policies (if any). We can only check whether the task is
+	// allowed to have them once we know its framework.
+	ld.policySource = policySourceTaskPolicies
+	if tp == nil {
+		if len(cfg.DefaultPolicies) == 0 {
+			return ld, ld.fail("policy-mapping", denyNoPolicyMapping,
+				"no task-policies entry and no default policies", logical.ErrPermissionDenied)
+		}
+		tp = &taskPolicies{Policies: cfg.DefaultPolicies}
+		ld.policySource = policySourceDefaultPolicies
+		ld.pass("policy-mapping", "no task-policies entry, using default policies")
+	} else {
+		ld.pass("policy-mapping", "task-policies entry for "+prefix)
+	}
+	ld.tp = tp
+
+	if err := ld.checkRemoteAddress(remoteAddr, tp.LoginCIDRs, "prefix"); err != nil {
+		return ld, err
+	}
+
+	if !dryRun {
+		bucket := prefix
+		if ld.policySource == policySourceDefaultPolicies {
+			bucket = defaultPolicyBucket
+		}
+		if !b.limiter.allowPrefix(bucket, cfg.loginLimits) {
+			return ld, ld.fail("rate-limit", denyRateLimited,
+				"too many logins for "+bucket, logical.ErrPermissionDenied)
+		}
+	}
+
+	// We only check for replays here, because we don't want to record the
+	// task as logged in until we know it's allowed to. We check again when we
+	// record it, in case another login for the same task got there first.
+	instances, err := rh.getTaskInstances(prefix)
+	if err != nil {
+		return ld, ld.fail("replay", denyStorageError, err.Error(), err)
+	}
+	if instances[taskID] {
+		return ld, ld.fail("replay", denyAlreadyLoggedIn, "task has already logged in", logical.ErrPermissionDenied)
+	}
+	ld.pass("replay", "task has not logged in before")
+
+	if tp.RequirePreauth {
+		pa, err := rh.getPreauthOrNil(taskID)
+		if err != nil {
+			return ld, ld.fail("preauth", denyStorageError, err.Error(), err)
+		}
+		if pa == nil {
+			return ld, ld.fail("preauth", denyNotPreauthorized,
+				"task has not been pre-authorized", logical.ErrPermissionDenied)
+		}
+		if pa.expired() {
+			return ld, ld.fail("preauth", denyNotPreauthorized,
+				"pre-authorization expired at "+pa.Expires.UTC().Format(time.RFC3339), logical.ErrPermissionDenied)
+		}
+		ld.pass("preauth", "task is pre-authorized")
+	}
+
+	// Once a secret ID has been issued for a task, the task must present it
+	// even if its prefix doesn't require one.
+	si, err := rh.getSecretIDOrNil(taskID)
+	if err != nil {
+		return ld, ld.fail("secret-id", denyStorageError, err.Error(), err)
+	}
+	if si != nil || tp.RequireSecretID {
+		switch {
+		case si == nil:
+			return ld, ld.fail("secret-id", denyBadSecretID,
+				"no secret ID has been issued for this task", logical.ErrPermissionDenied)
+		case si.expired():
+			return ld, ld.fail("secret-id", denyBadSecretID,
+				"secret ID expired at "+si.Expires.UTC().Format(time.RFC3339), logical.ErrPermissionDenied)
+		case !si.matches(secrets.secretID):
+			return ld, ld.fail("secret-id", denyBadSecretID,
+				"missing or invalid secret ID", logical.ErrPermissionDenied)
+		}
+		ld.pass("secret-id", "secret ID is valid")
+	}
+
+	// Calling Mesos is expensive, so only do it if everything else is okay
+	// and we haven't recently been told that the task isn't running.
+	if !dryRun && b.limiter.knownNotRunning(taskID) {
+		return ld, ld.fail("mesos-task", denyTaskNotRunning,
+			"task is not running (cached)", logical.ErrPermissionDenied)
+	}
+	src, err := b.taskSource(ctx, cfg, b.mesosClient(cfg), remoteAddr)
+	if err != nil {
+		return ld, ld.fail("mesos-task", denyMesosError, "mesos error: "+err.Error(), err)
+	}
+	if src == nil {
+		return ld, ld.fail("mesos-task", denyUnknownAgent,
+			fmt.Sprintf("no Mesos agent at address %q", remoteAddr), logical.ErrPermissionDenied)
+	}
+	rgt, err := src.getTasks(ctx)
+	if err != nil {
+		return ld, ld.fail("mesos-task", denyMesosError, "mesos error: "+err.Error(), err)
+	}
+
+	ld.task = b.findRunningTask(taskID, rgt)
+	notRunning := "task is not running"
+	if ld.task == nil && cfg.RunningWait > 0 && taskStarting(taskID, rgt) {
+		// A login check shouldn't keep the operator waiting, so it only says
+		// what a login would do.
+		if dryRun {
+			return ld, ld.fail("mesos-task", denyTaskNotRunning,
+				fmt.Sprintf("task is not running yet, a login would wait up to %s", cfg.RunningWait),
+				logical.ErrPermissionDenied)
+		}
+		ld.task, rgt, err = b.waitForRunningTask(ctx, src, taskID, rgt, cfg.RunningWait)
+		if err != nil {
+			return ld, ld.fail("mesos-task", denyMesosError, "mesos error: "+err.Error(), err)
+		}
+		if taskStarting(taskID, rgt) {
+			notRunning = fmt.Sprintf("task did not start running within %s", cfg.RunningWait)
+		}
+	}
+	if ld.task == nil {
+		ld.unknownTask = !taskKnown(taskID, rgt)
+		// A task Mesos knows about may be about to start running, so we only
+		// remember tasks that Mesos has never heard of.
+		if ld.unknownTask && !dryRun {
+			b.limiter.rememberNotRunning(taskID, cfg.NegativeCacheTTL)
+		}
+		return ld, ld.fail("mesos-task", denyTaskNotRunning, notRunning, logical.ErrPermissionDenied)
+	}
+	ld.pass("mesos-task", "task is running")
+
+	if tp.MinTaskAge > 0 || tp.MaxTaskAge > 0 {
+		if err := ld.checkTaskAge(tp); err != nil {
+			return ld, err
+		}
+	}
+
+	if image := taskImage(ld.task); !imageAllowed(image, tp.Images) {
+		return ld, ld.fail("image", denyImageNotAllowed,
+			fmt.Sprintf("image %q not allowed", image), logical.ErrPermissionDenied)
+	}
+	ld.pass("image", "image allowed")
+
+	if ld.framework, err = src.getFramework(ctx, ld.task.FrameworkID.Value); err != nil {
+		return ld, ld.fail("framework", denyMesosError, "mesos error: "+err.Error(), err)
+	}
+
+	if ld.agent, err = src.getAgent(ctx, ld.task.AgentID.Value); err != nil {
+		return ld, ld.fail("agent", denyMesosError, "mesos error: "+err.Error(), err)
+	}
+
+	fw := ld.framework
+	if ld.policySource == policySourceDefaultPolicies && (fw == nil || !strutil.StrListContains(cfg.DefaultFrameworks, fw.Name)) {
+		return ld, ld.fail("framework", denyFrameworkNotAllowed,
+			fmt.Sprintf("framework %s not allowed default policies", ld.task.FrameworkID.Value),
+			logical.ErrPermissionDenied)
+	}
+	if fw != nil {
+		ld.pass("framework", "framework is "+fw.Name)
+	} else {
+		ld.pass("framework", "framework is unknown")
+	}
+
+	if cfg.Freeze != nil && cfg.Freeze.blocksFramework(fw) {
+		return ld, ld.fail("freeze", denyFrozen, cfg.Freeze.detail(), logical.ErrPermissionDenied)
+	}
+
+	// If the task's framework has a key, the task must prove that its
+	// scheduler gave it a secret derived from that key. We look keys up by
+	// the framework ID on the task, which Mesos assigns, so we don't need to
+	// know anything else about the framework.
+	frameworkID := ld.task.FrameworkID.Value
+	fks, err := rh.getFrameworkKeysOrNil(frameworkID)
+	if err != nil {
+		return ld, ld.fail("task-secret", denyStorageError, err.Error(), err)
+	}
+	if fks != nil {
+		if !fks.verifyTaskSecret(taskID, secrets.taskSecret, time.Now()) {
+			return ld, ld.fail("task-secret", denyBadTaskSecret,
+				"missing or invalid task secret for framework "+frameworkID, logical.ErrPermissionDenied)
+		}
+		ld.pass("task-secret", "task secret is valid")
+	}
+
+	if ld.policies, err = rh.grantedPolicies(tp, ld.task, fw); err != nil {
+		return ld, ld.fail("policies", denyStorageError, err.Error(), err)
+	}
+	ld.pass("policies", "granted "+strings.Join(ld.policies, ","))
+
+	if dryRun {
+		return ld, nil
+	}
+
+	// TODO: Clean out stale entries.
+	count, err := rh.verifyTaskNotLoggedIn(taskID, prefix)
+	if err == logical.ErrPermissionDenied {
+		return ld, ld.fail("replay", denyAlreadyLoggedIn, "task has already logged in", err)
+	} else if err != nil {
+		return ld, ld.fail("replay", denyStorageError, err.Error(), err)
+	}
+
+	// Secret IDs and pre-authorizations are only good for one login. We only
+	// use them up once we know this login has won any race with another for
+	// the same task, so that replaying a login can't destroy one meant for
+	// the task itself.
+	if si != nil {
+		if err := rh.delete(siKey(taskID)); err != nil {
+			return ld, ld.fail("secret-id", denyStorageError, err.Error(), err)
+		}
+	}
+	if tp.RequirePreauth {
+		if err := rh.delete(paKey(taskID)); err != nil {
+			return ld, ld.fail("preauth", denyStorageError, err.Error(), err)
+		}
+	}
+
+	// We can't label by prefix if we're using the default policies, so those
+	// task instances are only counted in the total.
+	if labels := ld.metricLabels(); labels != nil {
+		b.setGauge(metricTaskInstances, float32(count), labels)
+	}
+
+	return ld, nil
+}
+
+// pathLoginCheck is the "login-check" request handler. It tells an operator
+// whether a task could log in (and with which policies) or why it couldn't,
+// without logging it in.
+func (b *mesosBackend) pathLoginCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	taskID := d.Get("task-id").(string)
+	b.Logger().Info("LOGIN CHECK", "task-id", taskID)
+
+	// Errors other than denials are part of the explanation rather than
+	// failures of the check itself.
+	conn := &logical.Connection{RemoteAddr: d.Get("remote-addr").(string)}
+	ld, err := b.evaluateLogin(ctx, &rh, cfg, taskID, conn, loginSecretsFromData(d), true)
+	policies := ld.policies
+	if policies == nil {
+		policies = []string{}
+	}
+	reason := ""
+	if ld.denial != nil {
+		reason = string(ld.denial.reason)
+	}
+	return &logical.Response{
+		Data: jsonobj{
+			"task-id":       taskID,
+			"allowed":       err == nil,
+			"denial-reason": reason,
+			"policies":      policies,
+			"steps":         ld.steps,
+		},
+	}, nil
+}
+
+// logDenial logs a denied login with consistent fields, at a level that
+// depends on the reason.
+func (b *mesosBackend) logDenial(ld *loginDecision, remoteAddr string) {
+	args := []interface{}{
+		"task-id", ld.taskID,
+		"prefix", ld.prefix,
+		"reason", string(ld.denial.reason),
+		"detail", ld.denial.detail,
+		"remote-addr", remoteAddr,
+	}
+	switch ld.denial.logLevel() {
+	case log.Error:
+		b.Logger().Error("LOGIN DENIED", args...)
+	case log.Warn:
+		b.Logger().Warn("LOGIN DENIED", args...)
+	default:
+		b.Logger().Info("LOGIN DENIED", args...)
+	}
+}
+
+// denialError returns the error we give the client for a denied login. Unless
+// the config says otherwise, we don't tell the client why.
+func denialError(cfg *config, ld *loginDecision, err error) error {
+	if err != logical.ErrPermissionDenied || !cfg.ExposeDenialReasons {
+		return err
+	}
+	// A coded error keeps its status code across the plugin boundary, which
+	// a wrapped ErrPermissionDenied wouldn't.
+	return logical.CodedError(http.StatusForbidden, fmt.Sprintf(
+		"%s: %s: %s", logical.ErrPermissionDenied, ld.denial.reason, ld.denial.detail))
+}
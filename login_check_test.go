@@ -0,0 +1,153 @@
+package mesosauth
+
+import (
+	"strings"
+	"testing"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// LoginCheckTests is a testify test suite object that we can attach helper
+// methods to.
+type LoginCheckTests struct{ TestSuite }
+
+// Test_LoginCheck is a standard Go test function that runs our test suite's
+// tests.
+func Test_LoginCheck(t *testing.T) { suite.Run(t, new(LoginCheckTests)) }
+
+// check makes a login-check request and returns the response data.
+func (ts *LoginCheckTests) check(taskID string) jsonobj {
+	return ts.HandleRequestSuccess(ts.mkReq("login-check", jsonobj{"task-id": taskID})).Data
+}
+
+// lastStep returns the last step in a login-check response.
+func lastStep(data jsonobj) jsonobj {
+	steps := data["steps"].([]jsonobj)
+	return steps[len(steps)-1]
+}
+
+// A task that could log in is explained step by step, and isn't logged in.
+func (ts *LoginCheckTests) Test_allowed() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+
+	ts.Equal(ts.check("task.abc-123"), jsonobj{
+		"task-id":       "task.abc-123",
+		"allowed":       true,
+		"denial-reason": "",
+		"policies":      []string{"insurance"},
+		"steps": []jsonobj{
+			{"step": "task-id", "result": "ok", "detail": "prefix is task"},
+			{"step": "policy-mapping", "result": "ok", "detail": "task-policies entry for task"},
+			{"step": "replay", "result": "ok", "detail": "task has not logged in before"},
+			{"step": "mesos-task", "result": "ok", "detail": "task is running"},
+			{"step": "image", "result": "ok", "detail": "image allowed"},
+			{"step": "framework", "result": "ok", "detail": "framework is unknown"},
+			{"step": "policies", "result": "ok", "detail": "granted insurance"},
+		},
+	})
+
+	// We can still log in for real afterwards.
+	ts.Login("task.abc-123")
+}
+
+// A malformed task ID is denied.
+func (ts *LoginCheckTests) Test_malformed_task_id() {
+	ts.SetupBackendWithMesos()
+
+	data := ts.check("no-prefix")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(data["policies"], []string{})
+	ts.Equal(data["denial-reason"], "malformed-task-id")
+	ts.Equal(lastStep(data), jsonobj{
+		"step":   "task-id",
+		"result": "denied",
+		"reason": "malformed-task-id",
+		"detail": `malformed task-id: "no-prefix"`,
+	})
+}
+
+// A task with no policy mapping is denied.
+func (ts *LoginCheckTests) Test_no_mapping() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+
+	data := ts.check("task.abc-123")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(lastStep(data), jsonobj{
+		"step":   "policy-mapping",
+		"result": "denied",
+		"reason": "no-policy-mapping",
+		"detail": "no task-policies entry and no default policies",
+	})
+}
+
+// A task that has already logged in is denied.
+func (ts *LoginCheckTests) Test_already_logged_in() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	ts.Login("task.abc-123")
+
+	data := ts.check("task.abc-123")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(lastStep(data)["step"], "replay")
+	ts.Equal(data["denial-reason"], "already-logged-in")
+}
+
+// A task that isn't running is denied.
+func (ts *LoginCheckTests) Test_not_running() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_STAGING))
+	ts.SetTaskPolicies("task", "insurance")
+
+	data := ts.check("task.abc-123")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(lastStep(data), jsonobj{
+		"step":   "mesos-task",
+		"result": "denied",
+		"reason": "task-not-running",
+		"detail": "task is not running",
+	})
+}
+
+// A task with a disallowed image is denied.
+func (ts *LoginCheckTests) Test_disallowed_image() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkDockerTask("task", "task.abc-123", "redis:4"))
+	ts.SetTaskImagePolicies("task", "nginx:*", "insurance")
+
+	data := ts.check("task.abc-123")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(lastStep(data), jsonobj{
+		"step":   "image",
+		"result": "denied",
+		"reason": "image-not-allowed",
+		"detail": `image "redis:4" not allowed`,
+	})
+}
+
+// Mesos errors are explained rather than failing the check.
+func (ts *LoginCheckTests) Test_mesos_error() {
+	ts.SetupBackendWithMesos()
+	ts.ConfigureBackend(ts.fakeMesos.GetBaseURL() + "/bad")
+	ts.SetTaskPolicies("task", "insurance")
+
+	data := ts.check("task.abc-123")
+	ts.Equal(data["allowed"], false)
+	ts.Equal(lastStep(data)["step"], "mesos-task")
+	ts.Equal(data["denial-reason"], "mesos-error")
+	ts.True(strings.HasPrefix(lastStep(data)["detail"].(string), "mesos error: "))
+}
+
+// An unconfigured backend can't check logins.
+func (ts *LoginCheckTests) Test_unconfigured() {
+	ts.SetupBackend()
+
+	req := ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})
+	ts.HandleRequestError(req, "backend not configured")
+}
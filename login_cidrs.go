@@ -0,0 +1,90 @@
+package mesosauth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// normaliseCIDRs checks that all the given CIDRs are valid and returns them
+// in canonical form. A bare IP address is treated as a network containing
+// only that address.
+func normaliseCIDRs(cidrs []string) ([]string, error) {
+	normalised := []string{}
+	for _, cidr := range cidrs {
+		ipnet, err := parseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		normalised = append(normalised, ipnet.String())
+	}
+	return normalised, nil
+}
+
+// parseCIDR parses a CIDR or a bare IP address. We build the network for a
+// bare address ourselves, because an IPv4-mapped IPv6 address with "/32"
+// appended would be parsed as an IPv6 network.
+func parseCIDR(cidr string) (*net.IPNet, error) {
+	if !strings.Contains(cidr, "/") {
+		ip := net.ParseIP(cidr)
+		switch {
+		case ip == nil:
+			return nil, fmt.Errorf("invalid CIDR: %q", cidr)
+		case ip.To4() != nil:
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		default:
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+		}
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CIDR: %q", cidr)
+	}
+	return ipnet, nil
+}
+
+// parseRemoteIP parses a remote address, which may have a port and (for
+// IPv6) a zone, returning nil if it isn't an IP address.
+func parseRemoteIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if i := strings.IndexByte(addr, '%'); i >= 0 {
+		addr = addr[:i]
+	}
+	return net.ParseIP(addr)
+}
+
+// ipAllowed checks whether an IP is in any of the given (normalised) CIDRs.
+// IPv4 networks also contain the IPv4-mapped forms of their addresses.
+func ipAllowed(ip net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err == nil && ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRemoteAddress checks a login's remote address against an allowlist,
+// recording the step in the login decision. An empty allowlist allows
+// everything, but a non-empty one can only allow addresses we can parse.
+func (ld *loginDecision) checkRemoteAddress(remoteAddr string, cidrs []string, scope string) error {
+	if len(cidrs) == 0 {
+		return nil
+	}
+	ip := parseRemoteIP(remoteAddr)
+	if ip == nil {
+		return ld.fail("remote-address", denyAddressNotAllowed,
+			fmt.Sprintf("missing or invalid remote address %q", remoteAddr), logical.ErrPermissionDenied)
+	}
+	if !ipAllowed(ip, cidrs) {
+		return ld.fail("remote-address", denyAddressNotAllowed,
+			fmt.Sprintf("address %s not in %s login-cidrs", ip, scope), logical.ErrPermissionDenied)
+	}
+	ld.pass("remote-address", fmt.Sprintf("address %s in %s login-cidrs", ip, scope))
+	return nil
+}
@@ -0,0 +1,178 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// LoginCIDRsTests is a testify test suite object that we can attach helper
+// methods to.
+type LoginCIDRsTests struct{ TestSuite }
+
+// Test_LoginCIDRs is a standard Go test function that runs our test suite's
+// tests.
+func Test_LoginCIDRs(t *testing.T) { suite.Run(t, new(LoginCIDRsTests)) }
+
+// setupCIDRTasks sets up a backend with running tasks for two prefixes and
+// the given config settings.
+func (ts *LoginCIDRsTests) setupCIDRTasks(settings jsonobj) {
+	ts.SetupLoginTasks(settings,
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING),
+		mkTask("other", "other.abc-123", mesos.TASK_RUNNING))
+}
+
+// loginFrom makes a login request from the given remote address.
+func (ts *LoginCIDRsTests) loginFrom(addr string, taskID string) error {
+	req := ts.mkReq("login", jsonobj{"task-id": taskID})
+	req.Connection.RemoteAddr = addr
+	_, err := ts.HandleRequestRaw(req)
+	return err
+}
+
+var normaliseCIDRsData = []struct {
+	cidr       string
+	normalised string
+}{
+	{"10.0.0.0/8", "10.0.0.0/8"},
+	{"10.1.2.3/8", "10.0.0.0/8"},
+	{"10.1.2.3", "10.1.2.3/32"},
+	{"2001:db8::/32", "2001:db8::/32"},
+	{"2001:DB8:0:0::1/64", "2001:db8::/64"},
+	{"2001:db8::1", "2001:db8::1/128"},
+	{"::ffff:10.1.2.3", "10.1.2.3/32"},
+}
+
+// CIDRs and bare addresses are normalised.
+func (ts *LoginCIDRsTests) Test_normaliseCIDRs() {
+	for _, ncd := range normaliseCIDRsData {
+		ts.Equalf([]string{ncd.normalised}, ts.WithoutError(normaliseCIDRs([]string{ncd.cidr})), "%#v", ncd)
+	}
+	for _, bad := range []string{"", "10.0.0.0/33", "10.0.0", "master.mesos", "2001:db8::/129"} {
+		_, err := normaliseCIDRs([]string{bad})
+		ts.EqualErrorf(err, `invalid CIDR: "`+bad+`"`, "%#v", bad)
+	}
+}
+
+var ipAllowedData = []struct {
+	addr    string
+	allowed bool
+}{
+	{"10.1.2.3", true},
+	{"10.1.2.3:8200", true},
+	{"::ffff:10.1.2.3", true},
+	{"[::ffff:10.1.2.3]:8200", true},
+	{"11.1.2.3", false},
+	{"2001:db8::1", true},
+	{"[2001:db8::1]:8200", true},
+	{"fe80::1%eth0", true},
+	{"2001:db9::1", false},
+}
+
+// Remote addresses in various forms are matched against IPv4 and IPv6 CIDRs.
+func (ts *LoginCIDRsTests) Test_ipAllowed() {
+	cidrs := []string{"10.0.0.0/8", "2001:db8::/32", "fe80::/10"}
+	for _, iad := range ipAllowedData {
+		ip := parseRemoteIP(iad.addr)
+		ts.Require().NotNilf(ip, "%#v", iad)
+		ts.Equalf(iad.allowed, ipAllowed(ip, cidrs), "%#v", iad)
+	}
+	for _, bad := range []string{"", "master.mesos", "10.0.0"} {
+		ts.Nilf(parseRemoteIP(bad), "%#v", bad)
+	}
+}
+
+// Login CIDRs can be configured globally and per prefix, and invalid ones are
+// rejected.
+func (ts *LoginCIDRsTests) Test_config() {
+	ts.SetupBackendWithMesos()
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"skip-verify": true, "login-cidrs": "10.1.2.3/8,2001:db8::1"}))
+	data := ts.HandleRequest(ts.mkReadReq("config")).Data
+	ts.Equal(data["login-cidrs"], []string{"10.0.0.0/8", "2001:db8::1/128"})
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "login-cidrs": "10.0.0.0/99"}))
+	ts.Equal(resp, logical.ErrorResponse(`login-cidrs: invalid CIDR: "10.0.0.0/99"`))
+
+	ts.SetTaskTokenPolicies("task", jsonobj{"login-cidrs": "192.168.0.0/16"}, "insurance")
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": "task"}
+	ts.Equal(ts.HandleRequest(req).Data["login-cidrs"], []string{"192.168.0.0/16"})
+
+	resp = ts.HandleRequest(ts.mkReq("task-policies", jsonobj{
+		"task-id-prefix": "task",
+		"policies":       "insurance",
+		"login-cidrs":    "nonsense",
+	}))
+	ts.Equal(resp, logical.ErrorResponse(`login-cidrs: invalid CIDR: "nonsense"`))
+}
+
+// Without any login CIDRs, logins may come from anywhere, including from
+// addresses we can't parse.
+func (ts *LoginCIDRsTests) Test_no_cidrs() {
+	ts.setupCIDRTasks(jsonobj{})
+
+	ts.NoError(ts.loginFrom("", "task.abc-123"))
+	ts.NoError(ts.loginFrom("2001:db8::1", "other.abc-123"))
+}
+
+// The global login CIDRs apply to every login, and are checked before we ask
+// Mesos anything.
+func (ts *LoginCIDRsTests) Test_global() {
+	ts.setupCIDRTasks(jsonobj{"login-cidrs": "10.0.0.0/8,2001:db8::/32"})
+
+	ts.EqualError(ts.loginFrom("192.168.0.1", "task.abc-123"),
+		"permission denied: address-not-allowed: address 192.168.0.1 not in global login-cidrs")
+	ts.EqualError(ts.loginFrom("", "task.abc-123"),
+		`permission denied: address-not-allowed: missing or invalid remote address ""`)
+	ts.Equal(0, ts.MetricCount("mesos.call;call=GET_TASKS"))
+
+	ts.NoError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+	ts.NoError(ts.loginFrom("2001:db8::1", "other.abc-123"))
+}
+
+// A prefix's login CIDRs apply as well as the global ones.
+func (ts *LoginCIDRsTests) Test_prefix() {
+	ts.setupCIDRTasks(jsonobj{"login-cidrs": "10.0.0.0/8"})
+	ts.SetTaskTokenPolicies("task", jsonobj{"login-cidrs": "10.1.0.0/16"}, "insurance")
+
+	ts.EqualError(ts.loginFrom("10.2.0.1", "task.abc-123"),
+		"permission denied: address-not-allowed: address 10.2.0.1 not in prefix login-cidrs")
+	ts.EqualError(ts.loginFrom("192.168.0.1", "task.abc-123"),
+		"permission denied: address-not-allowed: address 192.168.0.1 not in global login-cidrs")
+	ts.Equal(0, ts.MetricCount("mesos.call;call=GET_TASKS"))
+
+	ts.NoError(ts.loginFrom("10.1.0.1", "task.abc-123"))
+	ts.NoError(ts.loginFrom("10.2.0.1", "other.abc-123"))
+}
+
+// A login without any connection information is denied, and counted like any
+// other denial.
+func (ts *LoginCIDRsTests) Test_missing_connection() {
+	ts.setupCIDRTasks(jsonobj{})
+
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	req.Connection = nil
+	_, err := ts.HandleRequestRaw(req)
+	ts.EqualError(err, "permission denied: no-remote-address: request has no connection information")
+	ts.Equal(1, ts.MetricCount("mesos.login.denied;reason=no-remote-address"))
+}
+
+// A login check can say whether a login from a given address would be
+// allowed.
+func (ts *LoginCIDRsTests) Test_login_check() {
+	ts.setupCIDRTasks(jsonobj{"login-cidrs": "10.0.0.0/8"})
+
+	req := ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "remote-addr": "10.0.0.1"})
+	data := ts.HandleRequest(req).Data
+	ts.Equal(data["allowed"], true)
+	ts.Contains(data["steps"], jsonobj{"step": "remote-address", "result": "ok", "detail": "address 10.0.0.1 in global login-cidrs"})
+
+	req = ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "remote-addr": "192.168.0.1"})
+	ts.Equal(ts.HandleRequest(req).Data["denial-reason"], "address-not-allowed")
+}
@@ -0,0 +1,401 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// defaultPolicyBucket is the rate limit bucket for tasks that get the default
+// policies. We don't know those prefixes in advance, so they share a bucket.
+const defaultPolicyBucket = "(default-policies)"
+
+// limiterPruneInterval is how often we drop limiter state that no longer
+// matters.
+const limiterPruneInterval = time.Minute
+
+// pathLockouts returns the "lockouts" path struct. It is a function rather
+// than a method because we never call it once the backend struct is built and
+// we don't want name collisions with any request handler methods.
+func pathLockouts(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "lockouts",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathLockoutsRead,
+		},
+	}
+}
+
+// loginLimitsFields returns the field schemas for the login limit settings, so
+// they can be added to the config path.
+func loginLimitsFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"address-rate-limit": {
+			Type:        framework.TypeInt,
+			Description: "Logins allowed per minute from each remote address. Zero means unlimited.",
+		},
+		"address-rate-burst": {
+			Type:        framework.TypeInt,
+			Description: "Logins allowed in a burst from each remote address. Defaults to the rate limit.",
+		},
+		"prefix-rate-limit": {
+			Type:        framework.TypeInt,
+			Description: "Logins allowed per minute for each task ID prefix. Zero means unlimited.",
+		},
+		"prefix-rate-burst": {
+			Type:        framework.TypeInt,
+			Description: "Logins allowed in a burst for each task ID prefix. Defaults to the rate limit.",
+		},
+		"lockout-threshold": {
+			Type:        framework.TypeInt,
+			Description: "Failed logins from a remote address that lock it out. Zero disables lockout.",
+		},
+		"lockout-window": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Period over which failed logins are counted towards a lockout.",
+		},
+		"lockout-duration": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long a remote address stays locked out.",
+		},
+		"negative-cache-ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long to remember that Mesos doesn't know about a task before asking it again. Zero disables the cache.",
+		},
+	}
+}
+
+// loginLimits holds the settings that protect the login path (and Mesos) from
+// brute force attempts. Zero values disable each limit.
+type loginLimits struct {
+	AddressRateLimit int
+	AddressRateBurst int
+	PrefixRateLimit  int
+	PrefixRateBurst  int
+	LockoutThreshold int
+	LockoutWindow    time.Duration
+	LockoutDuration  time.Duration
+	NegativeCacheTTL time.Duration
+}
+
+// update sets any login limits present in the request data. Any error it
+// returns is the caller's fault.
+func (ll *loginLimits) update(d *framework.FieldData) error {
+	ints := map[string]*int{
+		"address-rate-limit": &ll.AddressRateLimit,
+		"address-rate-burst": &ll.AddressRateBurst,
+		"prefix-rate-limit":  &ll.PrefixRateLimit,
+		"prefix-rate-burst":  &ll.PrefixRateBurst,
+		"lockout-threshold":  &ll.LockoutThreshold,
+	}
+	for name, field := range ints {
+		if value, ok := d.GetOk(name); ok {
+			if value.(int) < 0 {
+				return fmt.Errorf("%s must not be negative", name)
+			}
+			*field = value.(int)
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"lockout-window":     &ll.LockoutWindow,
+		"lockout-duration":   &ll.LockoutDuration,
+		"negative-cache-ttl": &ll.NegativeCacheTTL,
+	}
+	for name, field := range durations {
+		if value, ok := d.GetOk(name); ok {
+			if value.(int) < 0 {
+				return fmt.Errorf("%s must not be negative", name)
+			}
+			*field = time.Duration(value.(int)) * time.Second
+		}
+	}
+
+	if ll.LockoutThreshold > 0 && (ll.LockoutWindow == 0 || ll.LockoutDuration == 0) {
+		return fmt.Errorf("lockout-threshold requires lockout-window and lockout-duration")
+	}
+	return nil
+}
+
+// data returns the login limits in a form suitable for a read response.
+func (ll *loginLimits) data() jsonobj {
+	return jsonobj{
+		"address-rate-limit": ll.AddressRateLimit,
+		"address-rate-burst": ll.AddressRateBurst,
+		"prefix-rate-limit":  ll.PrefixRateLimit,
+		"prefix-rate-burst":  ll.PrefixRateBurst,
+		"lockout-threshold":  ll.LockoutThreshold,
+		"lockout-window":     ll.LockoutWindow.String(),
+		"lockout-duration":   ll.LockoutDuration.String(),
+		"negative-cache-ttl": ll.NegativeCacheTTL.String(),
+	}
+}
+
+// tokenBucket is a rate limit bucket. Rather than refilling it on a timer, we
+// work out how many tokens it has gained whenever we look at it.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// full is when the bucket will be full again, after which we can forget
+	// about it without changing anything.
+	full time.Time
+}
+
+// failureRecord tracks failed logins from a remote address.
+type failureRecord struct {
+	count       int
+	windowStart time.Time
+	lockedUntil time.Time
+}
+
+// loginLimiter keeps track of login attempts so we can enforce the login
+// limits. It is shared by all requests to a backend, and lives only in
+// memory, so each Vault node enforces the limits separately.
+type loginLimiter struct {
+	lock sync.Mutex
+	// now is the clock we use, which tests can replace.
+	now        func() time.Time
+	addresses  map[string]*tokenBucket
+	prefixes   map[string]*tokenBucket
+	failures   map[string]*failureRecord
+	notRunning map[string]time.Time
+	lastPrune  time.Time
+}
+
+// newLoginLimiter builds an empty loginLimiter.
+func newLoginLimiter() *loginLimiter {
+	return &loginLimiter{
+		now:        time.Now,
+		addresses:  map[string]*tokenBucket{},
+		prefixes:   map[string]*tokenBucket{},
+		failures:   map[string]*failureRecord{},
+		notRunning: map[string]time.Time{},
+	}
+}
+
+// take takes a token from the bucket with the given key, creating a full one
+// if necessary, and returns whether there was a token to take. A zero rate
+// means no limit.
+func (ll *loginLimiter) take(buckets map[string]*tokenBucket, key string, rate int, burst int) bool {
+	if rate == 0 {
+		return true
+	}
+	if burst == 0 {
+		burst = rate
+	}
+	now := ll.now()
+	perSecond := float64(rate) / 60
+
+	bucket := buckets[key]
+	if bucket == nil {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * perSecond
+	if bucket.tokens > float64(burst) {
+		bucket.tokens = float64(burst)
+	}
+	bucket.last = now
+
+	allowed := bucket.tokens >= 1
+	if allowed {
+		bucket.tokens--
+	}
+	refill := time.Duration((float64(burst) - bucket.tokens) / perSecond * float64(time.Second))
+	bucket.full = now.Add(refill)
+	return allowed
+}
+
+// allowAddress checks the rate limit for a remote address.
+func (ll *loginLimiter) allowAddress(addr string, limits loginLimits) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.prune()
+	return ll.take(ll.addresses, addr, limits.AddressRateLimit, limits.AddressRateBurst)
+}
+
+// allowPrefix checks the rate limit for a task ID prefix (or the default
+// policy bucket).
+func (ll *loginLimiter) allowPrefix(prefix string, limits loginLimits) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.prune()
+	return ll.take(ll.prefixes, prefix, limits.PrefixRateLimit, limits.PrefixRateBurst)
+}
+
+// lockedOut returns when the lockout for a remote address ends, if it is
+// locked out.
+func (ll *loginLimiter) lockedOut(addr string) (time.Time, bool) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.prune()
+	if fr := ll.failures[addr]; fr != nil && ll.now().Before(fr.lockedUntil) {
+		return fr.lockedUntil, true
+	}
+	return time.Time{}, false
+}
+
+// recordFailure records a failed login from a remote address. If that locks
+// the address out, it returns true along with the number of failures.
+func (ll *loginLimiter) recordFailure(addr string, limits loginLimits) (int, bool) {
+	if limits.LockoutThreshold == 0 {
+		return 0, false
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	now := ll.now()
+
+	fr := ll.failures[addr]
+	if fr == nil || now.Sub(fr.windowStart) > limits.LockoutWindow {
+		fr = &failureRecord{windowStart: now}
+		ll.failures[addr] = fr
+	}
+	fr.count++
+	if fr.count < limits.LockoutThreshold {
+		return fr.count, false
+	}
+	count := fr.count
+	fr.count = 0
+	fr.windowStart = now
+	fr.lockedUntil = now.Add(limits.LockoutDuration)
+	return count, true
+}
+
+// recordSuccess forgets any failed logins from a remote address.
+func (ll *loginLimiter) recordSuccess(addr string) {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	if fr := ll.failures[addr]; fr != nil && !ll.now().Before(fr.lockedUntil) {
+		delete(ll.failures, addr)
+	}
+}
+
+// knownNotRunning checks the negative cache for a task ID.
+func (ll *loginLimiter) knownNotRunning(taskID string) bool {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	expiry, ok := ll.notRunning[taskID]
+	return ok && ll.now().Before(expiry)
+}
+
+// rememberNotRunning adds a task ID to the negative cache. A zero TTL means
+// we don't cache anything.
+func (ll *loginLimiter) rememberNotRunning(taskID string, ttl time.Duration) {
+	if ttl == 0 {
+		return
+	}
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	ll.notRunning[taskID] = ll.now().Add(ttl)
+}
+
+// prune drops state that has no further effect, so that an attacker can't
+// make us use unbounded memory. It must be called with the lock held.
+func (ll *loginLimiter) prune() {
+	now := ll.now()
+	if now.Sub(ll.lastPrune) < limiterPruneInterval {
+		return
+	}
+	ll.lastPrune = now
+	for _, buckets := range []map[string]*tokenBucket{ll.addresses, ll.prefixes} {
+		for key, bucket := range buckets {
+			if now.After(bucket.full) {
+				delete(buckets, key)
+			}
+		}
+	}
+	for addr, fr := range ll.failures {
+		// We don't know the lockout window here, so we keep failure records
+		// until they're an hour old. That's plenty for any sensible window.
+		if now.After(fr.lockedUntil) && now.Sub(fr.windowStart) > time.Hour {
+			delete(ll.failures, addr)
+		}
+	}
+	for taskID, expiry := range ll.notRunning {
+		if now.After(expiry) {
+			delete(ll.notRunning, taskID)
+		}
+	}
+}
+
+// lockoutData returns the current lockouts and recent failures in a form
+// suitable for a read response.
+func (ll *loginLimiter) lockoutData() jsonobj {
+	ll.lock.Lock()
+	defer ll.lock.Unlock()
+	now := ll.now()
+	addresses := jsonobj{}
+	for addr, fr := range ll.failures {
+		lockedUntil := ""
+		if now.Before(fr.lockedUntil) {
+			lockedUntil = fr.lockedUntil.UTC().Format(time.RFC3339Nano)
+		}
+		addresses[addr] = jsonobj{
+			"failures":     fr.count,
+			"locked-until": lockedUntil,
+		}
+	}
+	return jsonobj{"addresses": addresses}
+}
+
+// limitLogin enforces the lockout and rate limit for a login's remote address,
+// returning a denied decision if the login may not proceed.
+func (b *mesosBackend) limitLogin(cfg *config, taskID string, remoteAddr string) (*loginDecision, error) {
+	ld := &loginDecision{taskID: taskID}
+	if until, ok := b.limiter.lockedOut(remoteAddr); ok {
+		return ld, ld.fail("lockout", denyLockedOut,
+			"address locked out until "+until.UTC().Format(time.RFC3339), logical.ErrPermissionDenied)
+	}
+	if !b.limiter.allowAddress(remoteAddr, cfg.loginLimits) {
+		return ld, ld.fail("rate-limit", denyRateLimited,
+			"too many logins from address", logical.ErrPermissionDenied)
+	}
+	return ld, nil
+}
+
+// recordLoginResult updates the lockout state for a remote address after a
+// login. Only denials that could be the client's fault count as failures.
+func (b *mesosBackend) recordLoginResult(cfg *config, ld *loginDecision, remoteAddr string) {
+	if ld.denial == nil {
+		b.limiter.recordSuccess(remoteAddr)
+		return
+	}
+	// Failures that aren't the client's fault don't count towards a
+	// lockout. A freeze stops every login, so counting those would lock out
+	// every agent that retried during the incident. An unknown agent may
+	// just be one the master hasn't told us about yet.
+	//
+	// Failures are counted per address, which is usually an agent shared by
+	// many tasks, so we also ignore those that happen in normal operation: a
+	// task trying to log in before it's running, or retrying a login that
+	// has already succeeded. Tasks Mesos has never heard of still count,
+	// because guessing task IDs is what lockouts are for.
+	switch ld.denial.reason {
+	case denyMesosError, denyStorageError, denyRateLimited, denyLockedOut, denyFrozen, denyUnknownAgent:
+		return
+	case denyAlreadyLoggedIn:
+		return
+	case denyTaskNotRunning:
+		if !ld.unknownTask {
+			return
+		}
+	}
+	if count, locked := b.limiter.recordFailure(remoteAddr, cfg.loginLimits); locked {
+		b.Logger().Warn("LOGIN LOCKOUT",
+			"remote-addr", remoteAddr,
+			"failures", count,
+			"duration", cfg.LockoutDuration.String())
+		b.incrCounter(metricLoginLockout, nil)
+	}
+}
+
+// pathLockoutsRead is the "lockouts" read request handler. It shows which
+// remote addresses are locked out or have recently failed to log in on this
+// node.
+func (b *mesosBackend) pathLockoutsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	return &logical.Response{Data: b.limiter.lockoutData()}, nil
+}
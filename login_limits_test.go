@@ -0,0 +1,243 @@
+package mesosauth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// LoginLimitsTests is a testify test suite object that we can attach helper
+// methods to.
+type LoginLimitsTests struct {
+	TestSuite
+	now time.Time
+}
+
+// Test_LoginLimits is a standard Go test function that runs our test suite's
+// tests.
+func Test_LoginLimits(t *testing.T) { suite.Run(t, new(LoginLimitsTests)) }
+
+// setupLimits sets up a backend with the given tasks and login limits, and
+// replaces the limiter's clock with one we control.
+func (ts *LoginLimitsTests) setupLimits(limits jsonobj, tasks ...mesos.Task) {
+	ts.SetupLoginTasks(limits, tasks...)
+	ts.now = time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	ts.backend.limiter.now = func() time.Time { return ts.now }
+}
+
+// advance moves our clock forward.
+func (ts *LoginLimitsTests) advance(d time.Duration) {
+	ts.now = ts.now.Add(d)
+}
+
+// loginFrom makes a login request from the given remote address.
+func (ts *LoginLimitsTests) loginFrom(addr string, taskID string) (*logical.Response, error) {
+	req := ts.mkReq("login", jsonobj{"task-id": taskID})
+	req.Connection.RemoteAddr = addr
+	return ts.HandleRequestRaw(req)
+}
+
+// assertDenied asserts that a login from the given address is denied for the
+// given reason.
+func (ts *LoginLimitsTests) assertDenied(addr string, taskID string, reason denialReason) {
+	ts.T().Helper()
+	_, err := ts.loginFrom(addr, taskID)
+	ts.Require().Error(err)
+	ts.Contains(err.Error(), "permission denied: "+string(reason)+":")
+}
+
+// Login limits can be configured and read back, and nonsense is rejected.
+func (ts *LoginLimitsTests) Test_config() {
+	ts.SetupBackendWithMesos()
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{
+		"skip-verify":        true,
+		"address-rate-limit": 10,
+		"lockout-threshold":  5,
+		"lockout-window":     "5m",
+		"lockout-duration":   "1h",
+		"negative-cache-ttl": "10s",
+	}))
+	data := ts.HandleRequest(ts.mkReadReq("config")).Data
+	ts.Equal(data["address-rate-limit"], 10)
+	ts.Equal(data["address-rate-burst"], 0)
+	ts.Equal(data["prefix-rate-limit"], 0)
+	ts.Equal(data["lockout-threshold"], 5)
+	ts.Equal(data["lockout-window"], "5m0s")
+	ts.Equal(data["lockout-duration"], "1h0m0s")
+	ts.Equal(data["negative-cache-ttl"], "10s")
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "prefix-rate-limit": -1}))
+	ts.Equal(resp, logical.ErrorResponse("prefix-rate-limit must not be negative"))
+
+	resp = ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "lockout-window": "0s"}))
+	ts.Equal(resp, logical.ErrorResponse("lockout-threshold requires lockout-window and lockout-duration"))
+}
+
+// Logins from an address are rate limited, and the bucket refills over time.
+// Other addresses have their own buckets.
+func (ts *LoginLimitsTests) Test_address_rate_limit() {
+	ts.setupLimits(jsonobj{"address-rate-limit": 2},
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-125", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-126", mesos.TASK_RUNNING))
+
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-124"))
+	ts.assertDenied("10.0.0.1", "task.abc-125", denyRateLimited)
+	ts.WithoutError(ts.loginFrom("10.0.0.2", "task.abc-125"))
+
+	ts.advance(30 * time.Second)
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-126"))
+}
+
+// Logins for a prefix are rate limited, and tasks with the default policies
+// share a bucket.
+func (ts *LoginLimitsTests) Test_prefix_rate_limit() {
+	ts.setupLimits(jsonobj{
+		"prefix-rate-limit":  1,
+		"default-policies":   "default-thing",
+		"default-frameworks": "marathon",
+	},
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING),
+		mkTask("other", "other.abc-123", mesos.TASK_RUNNING))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+	for _, id := range []string{"app-a.abc-123", "app-b.abc-123"} {
+		task := mkTask("app", id, mesos.TASK_RUNNING)
+		task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+		ts.AddTask(task)
+	}
+
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+	ts.assertDenied("10.0.0.1", "task.abc-124", denyRateLimited)
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "other.abc-123"))
+
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "app-a.abc-123"))
+	ts.assertDenied("10.0.0.1", "app-b.abc-123", denyRateLimited)
+}
+
+// Repeated failures lock an address out until the lockout expires, and the
+// lockout is visible through the lockouts path.
+func (ts *LoginLimitsTests) Test_lockout() {
+	ts.setupLimits(jsonobj{
+		"lockout-threshold": 3,
+		"lockout-window":    "1m",
+		"lockout-duration":  "10m",
+	}, mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+
+	for _, id := range []string{"bad.1", "bad.2", "bad.3"} {
+		ts.assertDenied("10.0.0.1", id, denyNoPolicyMapping)
+	}
+	ts.assertDenied("10.0.0.1", "task.abc-123", denyLockedOut)
+
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("lockouts")).Data, jsonobj{
+		"addresses": jsonobj{
+			"10.0.0.1": jsonobj{
+				"failures":     0,
+				"locked-until": "2018-07-01T12:10:00Z",
+			},
+		},
+	})
+
+	ts.advance(10 * time.Minute)
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("lockouts")).Data, jsonobj{"addresses": jsonobj{}})
+}
+
+// Denials that happen in normal operation, such as a task logging in before
+// it's running or retrying a login, don't lock out other tasks on the same
+// agent.
+func (ts *LoginLimitsTests) Test_lockout_sibling_tasks() {
+	ts.setupLimits(jsonobj{
+		"lockout-threshold": 2,
+		"lockout-window":    "1m",
+		"lockout-duration":  "10m",
+	},
+		mkTask("task", "task.abc-123", mesos.TASK_STAGING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-125", mesos.TASK_RUNNING))
+
+	for i := 0; i < 3; i++ {
+		ts.assertDenied("10.0.0.1", "task.abc-123", denyTaskNotRunning)
+	}
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-124"))
+	for i := 0; i < 3; i++ {
+		ts.assertDenied("10.0.0.1", "task.abc-124", denyAlreadyLoggedIn)
+	}
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-125"))
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("lockouts")).Data, jsonobj{"addresses": jsonobj{}})
+}
+
+// Failures outside the lockout window don't count towards a lockout.
+func (ts *LoginLimitsTests) Test_lockout_window() {
+	ts.setupLimits(jsonobj{
+		"lockout-threshold": 2,
+		"lockout-window":    "1m",
+		"lockout-duration":  "10m",
+	})
+
+	ts.assertDenied("10.0.0.1", "bad.1", denyNoPolicyMapping)
+	ts.advance(2 * time.Minute)
+	ts.assertDenied("10.0.0.1", "bad.2", denyNoPolicyMapping)
+	ts.assertDenied("10.0.0.1", "bad.3", denyNoPolicyMapping)
+	ts.assertDenied("10.0.0.1", "bad.4", denyLockedOut)
+}
+
+// A task that Mesos doesn't know about is remembered so that we don't ask
+// Mesos about it again until the negative cache entry expires.
+func (ts *LoginLimitsTests) Test_negative_cache() {
+	ts.setupLimits(jsonobj{"negative-cache-ttl": "10s"})
+	ts.SetTaskPolicies("task", "insurance")
+
+	ts.assertDenied("10.0.0.1", "task.abc-123", denyTaskNotRunning)
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.assertDenied("10.0.0.1", "task.abc-123", denyTaskNotRunning)
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_TASKS"))
+
+	// The login-check path always asks Mesos.
+	ts.Equal(ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data["allowed"], true)
+
+	ts.advance(10 * time.Second)
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+}
+
+// A task that Mesos knows about but that isn't running yet isn't remembered,
+// so it can log in as soon as it is running.
+func (ts *LoginLimitsTests) Test_negative_cache_starting_task() {
+	ts.setupLimits(jsonobj{"negative-cache-ttl": "10s"}, mkTask("task", "task.abc-123", mesos.TASK_STAGING))
+
+	ts.assertDenied("10.0.0.1", "task.abc-123", denyTaskNotRunning)
+	ts.Len(ts.backend.limiter.notRunning, 0)
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_RUNNING), "task.abc-123")
+	ts.WithoutError(ts.loginFrom("10.0.0.1", "task.abc-123"))
+	ts.Equal(2, ts.MetricCount("mesos.call;call=GET_TASKS"))
+}
+
+// Limiter state that no longer has any effect is eventually dropped.
+func (ts *LoginLimitsTests) Test_prune() {
+	ts.setupLimits(jsonobj{
+		"address-rate-limit": 60,
+		"negative-cache-ttl": "10s",
+	})
+	ts.SetTaskPolicies("task", "insurance")
+	limiter := ts.backend.limiter
+
+	ts.assertDenied("10.0.0.1", "task.abc-123", denyTaskNotRunning)
+	ts.Len(limiter.addresses, 1)
+	ts.Len(limiter.notRunning, 1)
+
+	ts.advance(2 * time.Minute)
+	ts.assertDenied("10.0.0.2", "bad.1", denyNoPolicyMapping)
+	ts.Len(limiter.addresses, 1)
+	ts.Len(limiter.notRunning, 0)
+}
@@ -0,0 +1,172 @@
+package mesosauth
+
+import (
+	"context"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+)
+
+// pathMesosRolePolicies returns the "mesos-role-policies/<role>" path struct.
+// It is a function rather than a method because we never call it once the
+// backend struct is built and we don't want name collisions with any request
+// handler methods.
+func pathMesosRolePolicies(b *mesosBackend) *framework.Path {
+	return pathPolicyMapping(b, "mesos-role-policies/", "role")
+}
+
+// pathPrincipalPolicies returns the "principal-policies/<principal>" path
+// struct. It is a function rather than a method for the same reasons as
+// pathMesosRolePolicies.
+func pathPrincipalPolicies(b *mesosBackend) *framework.Path {
+	return pathPolicyMapping(b, "principal-policies/", "principal")
+}
+
+// pathPolicyMapping builds a path struct for a policy mapping keyed on the
+// named field, which is taken from the remainder of the path after the given
+// prefix. The prefix doubles as the storage key prefix.
+func pathPolicyMapping(b *mesosBackend, prefix string, field string) *framework.Path {
+	return &framework.Path{
+		// Mesos roles may be hierarchical and framework principals are
+		// arbitrary strings, so we match everything after the prefix.
+		Pattern: prefix + "(?P<" + field + ">.+)",
+		Fields: map[string]*framework.FieldSchema{
+			field:      {Type: framework.TypeString},
+			"policies": {Type: framework.TypeCommaStringSlice},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.policyMappingUpdate(prefix, field),
+			logical.ReadOperation:   b.policyMappingRead(prefix, field),
+		},
+	}
+}
+
+// policyMapping is used to store policies for a Mesos role or framework
+// principal.
+type policyMapping struct {
+	Policies []string
+}
+
+// rpKey builds a Mesos role policy storage key.
+func rpKey(role string) string {
+	return "mesos-role-policies/" + role
+}
+
+// ppKey builds a framework principal policy storage key.
+func ppKey(principal string) string {
+	return "principal-policies/" + principal
+}
+
+// policyMappingUpdate returns the update request handler for a policy mapping
+// path.
+func (b *mesosBackend) policyMappingUpdate(prefix string, field string) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+		name := d.Get(field).(string)
+
+		policies := d.Get("policies").([]string)
+		if len(policies) == 0 {
+			return logical.ErrorResponse("missing or invalid policies"), nil
+		}
+
+		b.Logger().Info("POLICY MAPPING", field, name, "policies", policies)
+
+		err := rh.store(prefix+name, policyMapping{Policies: policies})
+		return &logical.Response{}, err
+	}
+}
+
+// policyMappingRead returns the read request handler for a policy mapping
+// path.
+func (b *mesosBackend) policyMappingRead(prefix string, field string) framework.OperationFunc {
+	return func(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+		rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+		policies, err := rh.getMappedPolicies(prefix + d.Get(field).(string))
+		// A fetch failure will leave us with a nil policy list, and any
+		// response we return alongside an error will be ignored.
+		resp := &logical.Response{
+			Data: jsonobj{
+				"policies": policies,
+			},
+		}
+		return resp, err
+	}
+}
+
+// getMappedPolicies fetches the policies stored in a policy mapping. A missing
+// mapping has no policies.
+func (rh *requestHelper) getMappedPolicies(key string) ([]string, error) {
+	var pm policyMapping
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			// Empty policyMapping struct.
+			return nil
+		}
+		return se.DecodeJSON(&pm)
+	}
+	err := rh.fetch(key, decode)
+	return pm.Policies, err
+}
+
+// getMesosPolicies fetches the policies mapped to a task's Mesos roles and its
+// framework's principal. The framework may be nil if it is unknown or we
+// didn't need to look it up.
+func (rh *requestHelper) getMesosPolicies(task *mesos.Task, fw *mesos.FrameworkInfo) ([]string, error) {
+	policies := []string{}
+	for _, role := range taskRoles(task) {
+		rolePolicies, err := rh.getMappedPolicies(rpKey(role))
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, rolePolicies...)
+	}
+
+	if fw != nil && fw.Principal != nil {
+		principalPolicies, err := rh.getMappedPolicies(ppKey(*fw.Principal))
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, principalPolicies...)
+	}
+
+	return policies, nil
+}
+
+// taskRoles extracts the set of roles a task's resources are allocated to.
+// Resources allocated to multi-role frameworks carry the role in their
+// AllocationInfo, while older resources use the deprecated Role field.
+func taskRoles(task *mesos.Task) []string {
+	seen := map[string]bool{}
+	roles := []string{}
+	for _, res := range task.Resources {
+		var role string
+		switch {
+		case res.AllocationInfo != nil && res.AllocationInfo.Role != nil:
+			role = *res.AllocationInfo.Role
+		case res.Role != nil:
+			role = *res.Role
+		default:
+			continue
+		}
+		if !seen[role] {
+			seen[role] = true
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// findFramework finds the framework with the given ID, returning nil if the
+// framework is unknown.
+func findFramework(frameworkID string, rgf *master.Response_GetFrameworks) *mesos.FrameworkInfo {
+	for i, fw := range rgf.Frameworks {
+		if fw.FrameworkInfo.ID != nil && fw.FrameworkInfo.ID.Value == frameworkID {
+			return &rgf.Frameworks[i].FrameworkInfo
+		}
+	}
+	return nil
+}
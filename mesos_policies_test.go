@@ -0,0 +1,108 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// MesosPoliciesTests is a testify test suite object that we can attach helper
+// methods to.
+type MesosPoliciesTests struct{ TestSuite }
+
+// Test_MesosPolicies is a standard Go test function that runs our test
+// suite's tests.
+func Test_MesosPolicies(t *testing.T) { suite.Run(t, new(MesosPoliciesTests)) }
+
+// Missing or empty policies cause a policy mapping update request to fail.
+func (ts *MesosPoliciesTests) Test_update_invalid_policies() {
+	ts.SetupBackend()
+	for _, path := range []string{rpKey("web"), ppKey("marathon")} {
+		for _, data := range []jsonobj{{}, {"policies": ""}, {"policies": []string{}}} {
+			resp := ts.HandleRequest(ts.mkReq(path, data))
+			ts.EqualError(resp.Error(), "missing or invalid policies")
+		}
+	}
+}
+
+// We can store and replace role policies, including for hierarchical roles.
+func (ts *MesosPoliciesTests) Test_update_role_policies() {
+	ts.SetupBackend()
+	ts.Nil(ts.GetStored(rpKey("eng/web")))
+
+	req1 := ts.mkReq(rpKey("eng/web"), jsonobj{"policies": "insurance"})
+	ts.Equal(ts.HandleRequest(req1), &logical.Response{})
+	ts.StoredEqual(rpKey("eng/web"), policyMapping{Policies: []string{"insurance"}})
+
+	req2 := ts.mkReq(rpKey("eng/web"), jsonobj{"policies": "foreign,domestic"})
+	ts.Equal(ts.HandleRequest(req2), &logical.Response{})
+	ts.StoredEqual(rpKey("eng/web"), policyMapping{Policies: []string{"foreign", "domestic"}})
+}
+
+// We can store principal policies.
+func (ts *MesosPoliciesTests) Test_update_principal_policies() {
+	ts.SetupBackend()
+	ts.Nil(ts.GetStored(ppKey("marathon")))
+
+	req := ts.mkReq(ppKey("marathon"), jsonobj{"policies": "insurance"})
+	ts.Equal(ts.HandleRequest(req), &logical.Response{})
+	ts.StoredEqual(ppKey("marathon"), policyMapping{Policies: []string{"insurance"}})
+}
+
+// If we try to read a missing mapping, we get a nil policy list.
+func (ts *MesosPoliciesTests) Test_read_missing() {
+	ts.SetupBackend()
+	for _, path := range []string{rpKey("web"), ppKey("marathon")} {
+		ts.Equal(ts.HandleRequest(ts.mkReadReq(path)), &logical.Response{
+			Data: jsonobj{"policies": ([]string)(nil)},
+		})
+	}
+}
+
+// We can read existing mappings.
+func (ts *MesosPoliciesTests) Test_read_existing() {
+	ts.SetupBackend()
+	ts.SetRolePolicies("web", "insurance")
+	ts.SetPrincipalPolicies("marathon", "foreign")
+
+	ts.Equal(ts.HandleRequest(ts.mkReadReq(rpKey("web"))), &logical.Response{
+		Data: jsonobj{"policies": []string{"insurance"}},
+	})
+	ts.Equal(ts.HandleRequest(ts.mkReadReq(ppKey("marathon"))), &logical.Response{
+		Data: jsonobj{"policies": []string{"foreign"}},
+	})
+}
+
+// Task roles come from allocation info if present, and are deduplicated.
+func (ts *MesosPoliciesTests) Test_taskRoles() {
+	task := mkTask("task", "task.abc-123", mesos.TASK_RUNNING)
+	ts.Equal(taskRoles(&task), []string{})
+
+	task.Resources = []mesos.Resource{
+		mkResource("cpus", "web"),
+		mkResource("mem", "web"),
+		{Name: "disk", AllocationInfo: &mesos.Resource_AllocationInfo{Role: strptr("batch")}},
+		{Name: "ports"},
+	}
+	ts.Equal(taskRoles(&task), []string{"web", "batch"})
+}
+
+// Frameworks are looked up by framework ID.
+func (ts *MesosPoliciesTests) Test_findFramework() {
+	fw1 := mkFramework("anonymous", "fw-1", "")
+	fw2 := mkFramework("marathon", "fw-2", "marathon")
+	rgf := &master.Response_GetFrameworks{
+		Frameworks: []master.Response_GetFrameworks_Framework{
+			{FrameworkInfo: fw1},
+			{FrameworkInfo: fw2},
+		},
+	}
+	ts.Nil(findFramework("fw-0", rgf))
+	ts.Equal(findFramework("fw-1", rgf), &fw1)
+	ts.Equal(findFramework("fw-2", rgf), &fw2)
+}
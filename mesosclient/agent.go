@@ -0,0 +1,60 @@
+package mesosclient
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/mesos/mesos-go/api/v1/lib/agent"
+	agentcalls "github.com/mesos/mesos-go/api/v1/lib/agent/calls"
+	"github.com/mesos/mesos-go/api/v1/lib/httpcli/httpagent"
+)
+
+// AgentClient is a Mesos agent API client. It shares its transport,
+// credentials and metrics with the Client it was built from.
+type AgentClient struct {
+	url    string
+	client *Client
+}
+
+// AgentClient builds a new AgentClient object that queries a Mesos agent API
+// endpoint at the given base URL. The baseURL parameter should have the form
+// "http://host:port".
+func (c *Client) AgentClient(baseURL string) *AgentClient {
+	return &AgentClient{
+		url:    fmt.Sprintf("%s/api/v1", baseURL),
+		client: c,
+	}
+}
+
+// GetState makes a GET_STATE API call and returns the agent's tasks,
+// executors and frameworks.
+func (ac *AgentClient) GetState(ctx context.Context) (*agent.Response_GetState, error) {
+	respData, err := ac.makeCall(ctx, agentcalls.GetState())
+	if err != nil {
+		return nil, err
+	}
+
+	return respData.GetState, nil
+}
+
+// makeCall makes the given API call and returns the response. It records how
+// long the call took and whether it failed, labelled by call type. Agents
+// don't redirect, so we don't have to handle that.
+func (ac *AgentClient) makeCall(ctx context.Context, call *agent.Call) (*agent.Response, error) {
+	labels := []metrics.Label{{Name: "call", Value: call.Type.String()}}
+	defer ac.client.measureSince([]string{"mesos", "agent", "call"}, time.Now(), labels)
+	sender := httpagent.NewSender(ac.client.getHTTPClient(ac.url).Send)
+	resp, err := sender.Send(ctx, agentcalls.NonStreaming(call))
+	if err != nil {
+		ac.client.incrCounter([]string{"mesos", "agent", "call", "error"}, labels)
+		return nil, err
+	}
+	var respData agent.Response
+	if err := resp.Decode(&respData); err != nil {
+		return nil, err
+	}
+
+	return &respData, nil
+}
@@ -0,0 +1,68 @@
+package mesosclient
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/agent"
+
+	mesostest "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// mkAgentTask builds a simple task value on the given agent.
+func mkAgentTask(name, id string, state mesos.TaskState, agentID string) mesos.Task {
+	task := mkTask(name, id, state)
+	task.AgentID = mesos.AgentID{Value: agentID}
+	return task
+}
+
+// We can get an agent's state, which only includes its own tasks.
+func (ts *MesosClientTests) Test_AgentClient_GetState() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fa := fm.StartAgent("agent-1")
+	fm.StartAgent("agent-2")
+
+	task1 := mkAgentTask("task", "abc-123", mesos.TASK_RUNNING, "agent-1")
+	task2 := mkAgentTask("task", "abc-124", mesos.TASK_RUNNING, "agent-2")
+	fm.AddTask(task1, task2)
+
+	client := NewClient(fm.GetBaseURL()).AgentClient(fa.GetBaseURL())
+	rgs := ts.WithoutError(client.GetState(context.Background())).(*agent.Response_GetState)
+	ts.Equal(rgs.GetTasks, &agent.Response_GetTasks{LaunchedTasks: []mesos.Task{task1}})
+}
+
+// GetState errors are returned.
+func (ts *MesosClientTests) Test_AgentClient_GetState_bad_server() {
+	srv := httptest.NewServer(http.HandlerFunc(http.NotFound))
+	ts.AddCleanup(srv.Close)
+	client := NewClient("http://master.mesos:5050").AgentClient(srv.URL)
+
+	_, err := client.GetState(context.Background())
+	ts.Error(err)
+	ts.Contains(err.Error(), "404 page not found")
+}
+
+// An agent client uses the credentials and metrics of the client it was built
+// from.
+func (ts *MesosClientTests) Test_AgentClient_auth_and_metrics() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fm.SetCredentials("vault", "sekrit")
+	fa := fm.StartAgent("agent-1")
+	m, sink := newInmemMetrics()
+
+	client := NewClient(fm.GetBaseURL())
+	client.SetMetrics(m)
+	_, err := client.AgentClient(fa.GetBaseURL()).GetState(context.Background())
+	ts.Error(err)
+
+	client.SetBasicAuth("vault", "sekrit")
+	_, err = client.AgentClient(fa.GetBaseURL()).GetState(context.Background())
+	ts.NoError(err)
+
+	ts.Equal(2, sampleCount(sink, "mesos.agent.call;call=GET_STATE"))
+	ts.Equal(1, sampleCount(sink, "mesos.agent.call.error;call=GET_STATE"))
+}
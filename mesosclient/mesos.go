@@ -3,8 +3,12 @@ package mesosclient
 import (
 	"context"
 	"fmt"
+	"net"
+	"net/http"
 	"strings"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	"github.com/mesos/mesos-go/api/v1/lib/httpcli"
 	"github.com/mesos/mesos-go/api/v1/lib/httpcli/apierrors"
 	"github.com/mesos/mesos-go/api/v1/lib/httpcli/httpmaster"
@@ -14,7 +18,11 @@ import (
 
 // Client is a Mesos API client.
 type Client struct {
-	url string
+	url       string
+	transport http.RoundTripper
+	principal string
+	secret    string
+	metrics   *metrics.Metrics
 }
 
 // NewClient builds a new Client object that queries a Mesos API endpoint at
@@ -26,14 +34,68 @@ func NewClient(baseURL string) *Client {
 	}
 }
 
+// NewClientWithTransport builds a new Client object like NewClient, but makes
+// its requests with the given transport instead of creating a new one for
+// each request. This allows connections to be reused across clients.
+func NewClientWithTransport(baseURL string, transport http.RoundTripper) *Client {
+	c := NewClient(baseURL)
+	c.transport = transport
+	return c
+}
+
+// SetBasicAuth makes the client authenticate its requests with the given
+// principal and secret using HTTP basic authentication.
+func (c *Client) SetBasicAuth(principal, secret string) {
+	c.principal = principal
+	c.secret = secret
+}
+
+// SetMetrics makes the client emit its metrics through the given Metrics
+// object instead of the global one.
+func (c *Client) SetMetrics(m *metrics.Metrics) {
+	c.metrics = m
+}
+
+// NewTransport builds an HTTP transport suitable for sharing between clients,
+// with the same timeouts that the Mesos HTTP client uses by default.
+func NewTransport() *http.Transport {
+	dialer := &net.Dialer{
+		KeepAlive: 30 * time.Second,
+		Timeout:   5 * time.Second,
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		Dial:                  dialer.Dial,
+		ResponseHeaderTimeout: 15 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		MaxIdleConnsPerHost:   2,
+	}
+}
+
 // getSender returns a Sender for the given URL.
 func (c *Client) getSender(url string) calls.Sender {
-	return httpmaster.NewSender(httpcli.New(httpcli.Endpoint(url)).Send)
+	return httpmaster.NewSender(c.getHTTPClient(url).Send)
+}
+
+// getHTTPClient returns an HTTP client for the given URL that uses our
+// transport and credentials.
+func (c *Client) getHTTPClient(url string) *httpcli.Client {
+	// We copy the default config options so we don't modify the original
+	// when we append to it.
+	configOpts := append([]httpcli.ConfigOpt{}, httpcli.DefaultConfigOpt...)
+	if c.transport != nil {
+		configOpts = append(configOpts, httpcli.RoundTripper(c.transport))
+	}
+	// Basic auth wraps the transport, so it must come after it.
+	if c.principal != "" {
+		configOpts = append(configOpts, httpcli.BasicAuth(c.principal, c.secret))
+	}
+	return httpcli.New(httpcli.Endpoint(url), httpcli.Do(httpcli.With(configOpts...)))
 }
 
 // GetTasks makes a GET_TASKS API call and returns the collection of tasks.
 func (c *Client) GetTasks(ctx context.Context) (*master.Response_GetTasks, error) {
-	respData, err := c.makeCall(ctx, calls.NonStreaming(calls.GetTasks()))
+	respData, err := c.makeCall(ctx, calls.GetTasks())
 	if err != nil {
 		return nil, err
 	}
@@ -41,12 +103,69 @@ func (c *Client) GetTasks(ctx context.Context) (*master.Response_GetTasks, error
 	return respData.GetTasks, nil
 }
 
-// makeCall makes the given API call and returns the response.
-func (c *Client) makeCall(ctx context.Context, rf calls.RequestFunc) (*master.Response, error) {
-	resp, err := c.makeCallWithRedirect(ctx, rf, c.url, 10)
+// GetFrameworks makes a GET_FRAMEWORKS API call and returns the collection of
+// frameworks.
+func (c *Client) GetFrameworks(ctx context.Context) (*master.Response_GetFrameworks, error) {
+	respData, err := c.makeCall(ctx, calls.GetFrameworks())
+	if err != nil {
+		return nil, err
+	}
+
+	return respData.GetFrameworks, nil
+}
+
+// GetAgents makes a GET_AGENTS API call and returns the collection of agents.
+func (c *Client) GetAgents(ctx context.Context) (*master.Response_GetAgents, error) {
+	respData, err := c.makeCall(ctx, calls.GetAgents())
+	if err != nil {
+		return nil, err
+	}
+
+	return respData.GetAgents, nil
+}
+
+// GetVersion makes a GET_VERSION API call and returns the master's version
+// information.
+func (c *Client) GetVersion(ctx context.Context) (*master.Response_GetVersion, error) {
+	respData, err := c.makeCall(ctx, calls.GetVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	return respData.GetVersion, nil
+}
+
+// GetHealth makes a GET_HEALTH API call and returns the master's health.
+func (c *Client) GetHealth(ctx context.Context) (*master.Response_GetHealth, error) {
+	respData, err := c.makeCall(ctx, calls.GetHealth())
+	if err != nil {
+		return nil, err
+	}
+
+	return respData.GetHealth, nil
+}
+
+// GetMaster makes a GET_MASTER API call and returns information about the
+// leading master.
+func (c *Client) GetMaster(ctx context.Context) (*master.Response_GetMaster, error) {
+	respData, err := c.makeCall(ctx, calls.GetMaster())
 	if err != nil {
 		return nil, err
 	}
+
+	return respData.GetMaster, nil
+}
+
+// makeCall makes the given API call and returns the response. It records how
+// long the call took and whether it failed, labelled by call type.
+func (c *Client) makeCall(ctx context.Context, call *master.Call) (*master.Response, error) {
+	labels := []metrics.Label{{Name: "call", Value: call.Type.String()}}
+	defer c.measureSince([]string{"mesos", "call"}, time.Now(), labels)
+	resp, err := c.makeCallWithRedirect(ctx, calls.NonStreaming(call), c.url, 10)
+	if err != nil {
+		c.incrCounter([]string{"mesos", "call", "error"}, labels)
+		return nil, err
+	}
 	var respData master.Response
 	if err := resp.Decode(&respData); err != nil {
 		return nil, err
@@ -65,6 +184,7 @@ func (c *Client) makeCallWithRedirect(ctx context.Context, rf calls.RequestFunc,
 	if apierrors.CodeNotLeader.Matches(err) {
 		res := resp.(*httpcli.Response)
 		newURL := buildURL(url, res.Header.Get("Location"))
+		c.incrCounter([]string{"mesos", "redirect"}, nil)
 		return c.makeCallWithRedirect(ctx, rf, newURL, redirs-1)
 	}
 	if err != nil {
@@ -73,6 +193,26 @@ func (c *Client) makeCallWithRedirect(ctx context.Context, rf calls.RequestFunc,
 	return resp.(*httpcli.Response), nil
 }
 
+// incrCounter increments a counter, using the client's Metrics object if it
+// has one.
+func (c *Client) incrCounter(key []string, labels []metrics.Label) {
+	if c.metrics != nil {
+		c.metrics.IncrCounterWithLabels(key, 1, labels)
+		return
+	}
+	metrics.IncrCounterWithLabels(key, 1, labels)
+}
+
+// measureSince records the time elapsed since start, using the client's
+// Metrics object if it has one.
+func (c *Client) measureSince(key []string, start time.Time, labels []metrics.Label) {
+	if c.metrics != nil {
+		c.metrics.MeasureSinceWithLabels(key, start, labels)
+		return
+	}
+	metrics.MeasureSinceWithLabels(key, start, labels)
+}
+
 // buildURL returns newURL as-is if it has a scheme, otherwise it sticks the
 // scheme from oldURL on the front and returns that. We use string juggling
 // instead of net/url because I'm so tired of having to "handle" "errors"
@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	metrics "github.com/armon/go-metrics"
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
 	"github.com/mesos/mesos-go/api/v1/lib/master"
 	"github.com/stretchr/testify/suite"
@@ -32,6 +34,32 @@ func mkTask(name, id string, state mesos.TaskState) mesos.Task {
 	}
 }
 
+// newInmemMetrics builds a Metrics object that keeps everything in memory so
+// that we can look at it.
+func newInmemMetrics() (*metrics.Metrics, *metrics.InmemSink) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	cfg := metrics.DefaultConfig("")
+	cfg.EnableHostname = false
+	cfg.EnableRuntimeMetrics = false
+	m, _ := metrics.New(cfg, sink)
+	return m, sink
+}
+
+// sampleCount returns the number of samples recorded for the given counter or
+// timer key, which includes any labels.
+func sampleCount(sink *metrics.InmemSink, key string) int {
+	count := 0
+	for _, interval := range sink.Data() {
+		if sv, ok := interval.Counters[key]; ok {
+			count += sv.Count
+		}
+		if sv, ok := interval.Samples[key]; ok {
+			count += sv.Count
+		}
+	}
+	return count
+}
+
 // We get an error if the client isn't talking to a Mesos API.
 func (ts *MesosClientTests) Test_bad_server() {
 	srv := httptest.NewServer(http.HandlerFunc(http.NotFound))
@@ -82,6 +110,109 @@ func (ts *MesosClientTests) Test_GetTasks_some_tasks() {
 	ts.Equal(rgt, &master.Response_GetTasks{Tasks: []mesos.Task{task}})
 }
 
+// We can get the frameworks if frameworks exist.
+func (ts *MesosClientTests) Test_GetFrameworks() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	client := NewClient(fm.GetBaseURL())
+
+	fw := mesos.FrameworkInfo{Name: "marathon", ID: &mesos.FrameworkID{Value: "fw-1"}}
+	fm.AddFramework(fw)
+
+	rgf := ts.WithoutError(client.GetFrameworks(context.Background())).(*master.Response_GetFrameworks)
+	ts.Equal(rgf, &master.Response_GetFrameworks{
+		Frameworks: []master.Response_GetFrameworks_Framework{
+			{FrameworkInfo: fw, Active: true, Connected: true},
+		},
+	})
+}
+
+// GetFrameworks errors are returned.
+func (ts *MesosClientTests) Test_GetFrameworks_bad_server() {
+	srv := httptest.NewServer(http.HandlerFunc(http.NotFound))
+	ts.AddCleanup(srv.Close)
+	client := NewClient(srv.URL)
+
+	_, err := client.GetFrameworks(context.Background())
+	ts.Error(err)
+	ts.Contains(err.Error(), "404 page not found")
+}
+
+// We can get the agents if agents exist.
+func (ts *MesosClientTests) Test_GetAgents() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	client := NewClient(fm.GetBaseURL())
+
+	agent := mesos.AgentInfo{Hostname: "agent1.example.com", ID: &mesos.AgentID{Value: "agent-1"}}
+	fm.AddAgent(agent)
+
+	rga := ts.WithoutError(client.GetAgents(context.Background())).(*master.Response_GetAgents)
+	ts.Equal(rga, &master.Response_GetAgents{
+		Agents: []master.Response_GetAgents_Agent{{AgentInfo: agent, Active: true}},
+	})
+}
+
+// GetAgents errors are returned.
+func (ts *MesosClientTests) Test_GetAgents_bad_server() {
+	srv := httptest.NewServer(http.HandlerFunc(http.NotFound))
+	ts.AddCleanup(srv.Close)
+	client := NewClient(srv.URL)
+
+	_, err := client.GetAgents(context.Background())
+	ts.Error(err)
+	ts.Contains(err.Error(), "404 page not found")
+}
+
+// We can get the master's version.
+func (ts *MesosClientTests) Test_GetVersion() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	client := NewClient(fm.GetBaseURL())
+	fm.SetVersion("1.6.1")
+
+	rgv := ts.WithoutError(client.GetVersion(context.Background())).(*master.Response_GetVersion)
+	ts.Equal(rgv, &master.Response_GetVersion{VersionInfo: mesos.VersionInfo{Version: "1.6.1"}})
+}
+
+// We can get the master's health.
+func (ts *MesosClientTests) Test_GetHealth() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	client := NewClient(fm.GetBaseURL())
+
+	rgh := ts.WithoutError(client.GetHealth(context.Background())).(*master.Response_GetHealth)
+	ts.Equal(rgh, &master.Response_GetHealth{Healthy: true})
+
+	fm.SetHealthy(false)
+	rgh = ts.WithoutError(client.GetHealth(context.Background())).(*master.Response_GetHealth)
+	ts.Equal(rgh, &master.Response_GetHealth{Healthy: false})
+}
+
+// We can get the leading master.
+func (ts *MesosClientTests) Test_GetMaster() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	client := NewClient(fm.GetBaseURL())
+
+	rgm := ts.WithoutError(client.GetMaster(context.Background())).(*master.Response_GetMaster)
+	ts.Equal(rgm, &master.Response_GetMaster{MasterInfo: fm.MasterInfo()})
+}
+
+// GetVersion and GetHealth errors are returned.
+func (ts *MesosClientTests) Test_GetVersion_GetHealth_bad_server() {
+	srv := httptest.NewServer(http.HandlerFunc(http.NotFound))
+	ts.AddCleanup(srv.Close)
+	client := NewClient(srv.URL)
+
+	_, err := client.GetVersion(context.Background())
+	ts.Error(err)
+	ts.Contains(err.Error(), "404 page not found")
+	_, err = client.GetHealth(context.Background())
+	ts.Error(err)
+	ts.Contains(err.Error(), "404 page not found")
+}
+
 // We can make a successful request with a redirect.
 func (ts *MesosClientTests) Test_GetTasks_redirect() {
 	// Where we want to end up.
@@ -129,6 +260,87 @@ func (ts *MesosClientTests) Test_GetTasks_too_many_redirects() {
 	ts.Contains(err.Error(), "too many redirects")
 }
 
+// Calls, call errors, and redirects are recorded as metrics.
+func (ts *MesosClientTests) Test_metrics() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, fm.GetBaseURL()+"/api/v1", http.StatusTemporaryRedirect)
+	}))
+	ts.AddCleanup(srv.Close)
+	m, sink := newInmemMetrics()
+
+	client := NewClient(srv.URL)
+	client.SetMetrics(m)
+	ts.getTasks(client)
+	_, err := client.GetVersion(context.Background())
+	ts.NoError(err)
+
+	badClient := NewClient(fm.GetBaseURL() + "/bad")
+	badClient.SetMetrics(m)
+	_, err = badClient.GetTasks(context.Background())
+	ts.Error(err)
+
+	ts.Equal(2, sampleCount(sink, "mesos.call;call=GET_TASKS"))
+	ts.Equal(1, sampleCount(sink, "mesos.call;call=GET_VERSION"))
+	ts.Equal(1, sampleCount(sink, "mesos.call.error;call=GET_TASKS"))
+	ts.Equal(0, sampleCount(sink, "mesos.call.error;call=GET_VERSION"))
+	ts.Equal(2, sampleCount(sink, "mesos.redirect"))
+}
+
+// A client with a shared transport works, and leaves its connection in the
+// transport for the next client to reuse.
+func (ts *MesosClientTests) Test_shared_transport() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	transport := NewTransport()
+	ts.AddCleanup(transport.CloseIdleConnections)
+
+	task := mkTask("task", "abc-123", mesos.TASK_RUNNING)
+	fm.AddTask(task)
+
+	rgt1 := ts.getTasks(NewClientWithTransport(fm.GetBaseURL(), transport))
+	ts.Equal(rgt1, &master.Response_GetTasks{Tasks: []mesos.Task{task}})
+	rgt2 := ts.getTasks(NewClientWithTransport(fm.GetBaseURL(), transport))
+	ts.Equal(rgt2, &master.Response_GetTasks{Tasks: []mesos.Task{task}})
+}
+
+// A client can authenticate with basic auth, with or without a shared
+// transport.
+func (ts *MesosClientTests) Test_basic_auth() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fm.SetCredentials("vault", "sekrit")
+	transport := NewTransport()
+	ts.AddCleanup(transport.CloseIdleConnections)
+
+	_, err := NewClient(fm.GetBaseURL()).GetTasks(context.Background())
+	ts.Error(err)
+
+	client := NewClient(fm.GetBaseURL())
+	client.SetBasicAuth("vault", "sekrit")
+	ts.Equal(ts.getTasks(client), &master.Response_GetTasks{})
+
+	client = NewClientWithTransport(fm.GetBaseURL(), transport)
+	client.SetBasicAuth("vault", "sekrit")
+	ts.Equal(ts.getTasks(client), &master.Response_GetTasks{})
+}
+
+// A client with a shared transport still handles redirects.
+func (ts *MesosClientTests) Test_shared_transport_redirect() {
+	fm := mesostest.NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, fm.GetBaseURL()+"/api/v1", http.StatusTemporaryRedirect)
+	}))
+	ts.AddCleanup(srv.Close)
+	transport := NewTransport()
+	ts.AddCleanup(transport.CloseIdleConnections)
+
+	rgt := ts.getTasks(NewClientWithTransport(srv.URL, transport))
+	ts.Equal(rgt, &master.Response_GetTasks{})
+}
+
 // getResp is a wrapper around all the type and error juggling noise.
 func (ts *MesosClientTests) getTasks(client *Client) *master.Response_GetTasks {
 	return ts.WithoutError(client.GetTasks(context.Background())).(*master.Response_GetTasks)
@@ -0,0 +1,133 @@
+package testing
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/agent"
+)
+
+// FakeAgent pretends to be a subset of the Mesos v1 agent API for an agent
+// belonging to a FakeMesos. It serves whichever of the FakeMesos tasks and
+// frameworks are on the agent, so tests only have to manage them in one
+// place.
+type FakeAgent struct {
+	*httptest.Server
+	master *FakeMesos
+	id     string
+}
+
+// StartAgent starts a FakeAgent with the given ID and adds it to FakeMesos,
+// with the agent's hostname and port pointing at the fake agent server. The
+// agent is closed when FakeMesos is.
+func (fm *FakeMesos) StartAgent(agentID string) *FakeAgent {
+	fa := &FakeAgent{master: fm, id: agentID}
+	fa.Server = httptest.NewServer(http.HandlerFunc(fa.handleAPI))
+	fm.fakeAgents = append(fm.fakeAgents, fa)
+
+	addr := fa.Listener.Addr().(*net.TCPAddr)
+	port := int32(addr.Port)
+	fm.AddAgent(mesos.AgentInfo{
+		ID:       &mesos.AgentID{Value: agentID},
+		Hostname: addr.IP.String(),
+		Port:     &port,
+	})
+	return fa
+}
+
+// GetBaseURL returns the fake agent server's base URL.
+func (fa *FakeAgent) GetBaseURL() string {
+	return fa.Server.URL
+}
+
+// handleAPI parses and dispatches Mesos agent API calls. We share the
+// master's credentials and latency.
+func (fa *FakeAgent) handleAPI(w http.ResponseWriter, r *http.Request) {
+	fm := fa.master
+	if r.URL.Path != "/api/v1" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "", http.StatusMethodNotAllowed)
+		return
+	}
+	if principal, secret, _ := r.BasicAuth(); fm.principal != "" && (principal != fm.principal || secret != fm.secret) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/x-protobuf" {
+		http.Error(w, "", http.StatusUnsupportedMediaType)
+		return
+	}
+	// As with the master API, we treat bad data as a zero-value request.
+	var call agent.Call
+	bytes, _ := ioutil.ReadAll(r.Body) // #nosec G104
+	_ = call.Unmarshal(bytes)          // #nosec G104
+	switch call.Type {
+	case agent.Call_GET_STATE:
+		fa.respond(w, agent.Response{
+			Type:     agent.Response_GET_STATE,
+			GetState: fa.getState(),
+		})
+	default:
+		http.Error(w, "invalid operation: "+call.Type.String(), 400)
+	}
+}
+
+// getState collects the tasks on this agent, and the frameworks they belong
+// to, into a suitable container.
+//
+// The PendingTasks, QueuedTasks and GetExecutors fields will always be empty.
+// Unreachable tasks are never returned, because the agent that would know
+// about them can't be reached.
+func (fa *FakeAgent) getState() *agent.Response_GetState {
+	fm := fa.master
+	getTasks := agent.Response_GetTasks{}
+	frameworkIDs := map[string]bool{}
+
+	fm.tasksLock.Lock()
+	for _, task := range fm.tasks {
+		if task.AgentID.Value != fa.id {
+			continue
+		}
+		switch stateLifecycle[*task.State] {
+		case stateActive:
+			appendTask(&getTasks.LaunchedTasks, copyTask(task))
+		case stateTerminated:
+			appendTask(&getTasks.CompletedTasks, copyTask(task))
+		default:
+			continue
+		}
+		frameworkIDs[task.FrameworkID.Value] = true
+	}
+	fm.tasksLock.Unlock()
+
+	getFrameworks := agent.Response_GetFrameworks{}
+	for id, fw := range fm.frameworks {
+		if frameworkIDs[id] {
+			getFrameworks.Frameworks = append(getFrameworks.Frameworks, agent.Response_GetFrameworks_Framework{
+				FrameworkInfo: copyFramework(fw),
+			})
+		}
+	}
+
+	return &agent.Response_GetState{
+		GetTasks:      &getTasks,
+		GetFrameworks: &getFrameworks,
+	}
+}
+
+// respond writes a response after waiting a configured duration to simulate
+// actual request latency.
+func (fa *FakeAgent) respond(w http.ResponseWriter, resp agent.Response) {
+	time.Sleep(fa.master.latency)
+	data, err := resp.Marshal()
+	err2panic(err)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data) // #nosec G104
+}
@@ -0,0 +1,91 @@
+package testing
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/agent"
+)
+
+// mkAgentTask builds a simple task value on the given agent and framework.
+func mkAgentTask(name, id string, state mesos.TaskState, agentID, frameworkID string) mesos.Task {
+	task := mkTask(name, id, state)
+	task.AgentID = mesos.AgentID{Value: agentID}
+	task.FrameworkID = mesos.FrameworkID{Value: frameworkID}
+	return task
+}
+
+// Starting an agent adds it to FakeMesos with the fake agent's address.
+func (ts *FakeMesosTests) Test_StartAgent() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fa := fm.StartAgent("agent-1")
+	info := fm.agents["agent-1"]
+	ts.Require().NotNil(info)
+	ts.Equal(fa.GetBaseURL(), "http://"+info.Hostname+":"+fmt.Sprint(*info.Port))
+	ts.Panics(func() { fm.StartAgent("agent-1") })
+}
+
+// An agent's state only includes its own tasks and their frameworks.
+func (ts *FakeMesosTests) Test_FakeAgent_getState() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fa := fm.StartAgent("agent-1")
+
+	ts.Equal(fa.getState(), &agent.Response_GetState{
+		GetTasks:      &agent.Response_GetTasks{},
+		GetFrameworks: &agent.Response_GetFrameworks{},
+	})
+
+	fw1 := mkFramework("marathon", "fw-1")
+	fw2 := mkFramework("chronos", "fw-2")
+	fm.AddFramework(fw1, fw2)
+	running := mkAgentTask("task", "abc-123", mesos.TASK_RUNNING, "agent-1", "fw-1")
+	finished := mkAgentTask("task", "abc-124", mesos.TASK_FINISHED, "agent-1", "fw-1")
+	lost := mkAgentTask("task", "abc-125", mesos.TASK_LOST, "agent-1", "fw-1")
+	elsewhere := mkAgentTask("task", "abc-126", mesos.TASK_RUNNING, "agent-2", "fw-2")
+	fm.AddTask(running, finished, lost, elsewhere)
+
+	ts.Equal(fa.getState(), &agent.Response_GetState{
+		GetTasks: &agent.Response_GetTasks{
+			LaunchedTasks:  []mesos.Task{running},
+			CompletedTasks: []mesos.Task{finished},
+		},
+		GetFrameworks: &agent.Response_GetFrameworks{
+			Frameworks: []agent.Response_GetFrameworks_Framework{{FrameworkInfo: fw1}},
+		},
+	})
+}
+
+// The agent API handles GET_STATE and nothing else, and requires the same
+// credentials as the master.
+func (ts *FakeMesosTests) Test_FakeAgent_API() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fa := fm.StartAgent("agent-1")
+	apiURL := fa.GetBaseURL() + "/api/v1"
+
+	resp := ts.postAgentAPI(apiURL, agent.Call_GET_STATE)
+	ts.Equal(resp.StatusCode, 200)
+	var respData agent.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData.Type, agent.Response_GET_STATE)
+
+	ts.Equal(ts.postAgentAPI(apiURL, agent.Call_GET_CONTAINERS).StatusCode, 400)
+	ts.Equal(ts.postAgentAPI(fa.GetBaseURL()+"/bad", agent.Call_GET_STATE).StatusCode, 404)
+
+	fm.SetCredentials("vault", "sekrit")
+	ts.Equal(ts.postAgentAPI(apiURL, agent.Call_GET_STATE).StatusCode, 401)
+}
+
+// postAgentAPI makes an agent API call with the given call type.
+func (ts *FakeMesosTests) postAgentAPI(url string, callType agent.Call_Type) *http.Response {
+	call := &agent.Call{Type: callType}
+	body := bytes.NewReader(ts.WithoutError(call.Marshal()).([]byte))
+	return ts.getResp(http.Post(url, "application/x-protobuf", body))
+}
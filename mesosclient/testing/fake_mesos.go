@@ -4,8 +4,10 @@ package testing
 import (
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"time"
 
 	mesos "github.com/mesos/mesos-go/api/v1/lib"
@@ -42,22 +44,56 @@ var stateLifecycle = map[mesos.TaskState]int{
 // A taskMap is a collection of tasks.
 type taskMap map[string]*mesos.Task
 
+// A frameworkMap is a collection of frameworks.
+type frameworkMap map[string]*mesos.FrameworkInfo
+
+// An agentMap is a collection of agents.
+type agentMap map[string]*mesos.AgentInfo
+
+// DefaultVersion is the Mesos version FakeMesos claims to be unless told
+// otherwise.
+const DefaultVersion = "1.5.0"
+
 // FakeMesos pretends to be a subset of the Mesos v1 API. Only protobuf
 // payloads are supported, not JSON.
 type FakeMesos struct {
 	*httptest.Server
-	tasks   taskMap
-	latency time.Duration
+	// tasksLock lets tests change tasks while a request is being handled.
+	tasksLock  sync.Mutex
+	tasks      taskMap
+	frameworks frameworkMap
+	agents     agentMap
+	agentPIDs  map[string]string
+	fakeAgents []*FakeAgent
+	latency    time.Duration
+	version    string
+	unhealthy  bool
+	principal  string
+	secret     string
 }
 
 // NewFakeMesos does what it says on the tin. It needs to be stopped with a
 // call to .Close() when the test is over.
 func NewFakeMesos() *FakeMesos {
-	fm := FakeMesos{tasks: taskMap{}}
+	fm := FakeMesos{
+		tasks:      taskMap{},
+		frameworks: frameworkMap{},
+		agents:     agentMap{},
+		agentPIDs:  map[string]string{},
+		version:    DefaultVersion,
+	}
 	fm.Server = httptest.NewServer(http.HandlerFunc(fm.handleAPI))
 	return &fm
 }
 
+// Close shuts down the fake server and any fake agents started with it.
+func (fm *FakeMesos) Close() {
+	for _, fa := range fm.fakeAgents {
+		fa.Close()
+	}
+	fm.Server.Close()
+}
+
 // SetLatency sets the simulated request latency.
 //
 // This can be useful for testing race conditions and timeouts or modeling the
@@ -66,6 +102,23 @@ func (fm *FakeMesos) SetLatency(latency time.Duration) {
 	fm.latency = latency
 }
 
+// SetVersion sets the Mesos version reported by GET_VERSION.
+func (fm *FakeMesos) SetVersion(version string) {
+	fm.version = version
+}
+
+// SetHealthy sets the health reported by GET_HEALTH.
+func (fm *FakeMesos) SetHealthy(healthy bool) {
+	fm.unhealthy = !healthy
+}
+
+// SetCredentials makes fake Mesos require HTTP basic authentication with the
+// given principal and secret. An empty principal turns authentication off.
+func (fm *FakeMesos) SetCredentials(principal, secret string) {
+	fm.principal = principal
+	fm.secret = secret
+}
+
 // GetBaseURL returns the fake server's base URL.
 func (fm *FakeMesos) GetBaseURL() string {
 	return fm.Server.URL
@@ -86,6 +139,10 @@ func (fm *FakeMesos) handleAPI(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusMethodNotAllowed)
 		return
 	}
+	if principal, secret, _ := r.BasicAuth(); fm.principal != "" && (principal != fm.principal || secret != fm.secret) {
+		http.Error(w, "", http.StatusUnauthorized)
+		return
+	}
 	if r.Header.Get("Content-Type") != "application/x-protobuf" {
 		http.Error(w, "", http.StatusUnsupportedMediaType)
 		return
@@ -100,6 +157,16 @@ func (fm *FakeMesos) handleAPI(w http.ResponseWriter, r *http.Request) {
 	switch call.Type {
 	case master.Call_GET_TASKS:
 		fm.respondGetTasks(w)
+	case master.Call_GET_FRAMEWORKS:
+		fm.respondGetFrameworks(w)
+	case master.Call_GET_AGENTS:
+		fm.respondGetAgents(w)
+	case master.Call_GET_VERSION:
+		fm.respondGetVersion(w)
+	case master.Call_GET_HEALTH:
+		fm.respondGetHealth(w)
+	case master.Call_GET_MASTER:
+		fm.respondGetMaster(w)
 	default:
 		http.Error(w, "invalid operation: "+call.Type.String(), 400)
 	}
@@ -114,6 +181,8 @@ func appendTask(tl *[]mesos.Task, t mesos.Task) { *tl = append(*tl, t) }
 // since Mesos 1.2.0) fields will always be empty. Tasks in state TASK_UNKNOWN
 // are never returned, because Mesos doesn't know about them.
 func (fm *FakeMesos) getTasks() *master.Response_GetTasks {
+	fm.tasksLock.Lock()
+	defer fm.tasksLock.Unlock()
 	getTasks := master.Response_GetTasks{}
 	for _, task := range fm.tasks {
 		switch stateLifecycle[*task.State] {
@@ -138,14 +207,132 @@ func copyTask(taskIn *mesos.Task) mesos.Task {
 	return taskOut
 }
 
-// respondGetTasks returns a GET_TASKS response after waiting a configured
-// duration to simulate actual request latency.
+// getFrameworks collects the frameworks we know about into a suitable
+// container.
+//
+// All frameworks are returned as active and connected. The
+// CompletedFrameworks and RecoveredFrameworks fields will always be empty.
+func (fm *FakeMesos) getFrameworks() *master.Response_GetFrameworks {
+	getFrameworks := master.Response_GetFrameworks{}
+	for _, fw := range fm.frameworks {
+		getFrameworks.Frameworks = append(getFrameworks.Frameworks, master.Response_GetFrameworks_Framework{
+			FrameworkInfo: copyFramework(fw),
+			Active:        true,
+			Connected:     true,
+		})
+	}
+	return &getFrameworks
+}
+
+// copyFramework serialises and deserialises a framework in order to deep-copy
+// it.
+func copyFramework(fwIn *mesos.FrameworkInfo) mesos.FrameworkInfo {
+	// We ignore all errors, because we expect the generated serialisation code
+	// to correctly-roud-trip any framework we give it.
+	bytes, _ := fwIn.Marshal() // #nosec G104
+	var fwOut mesos.FrameworkInfo
+	_ = fwOut.Unmarshal(bytes) // #nosec G104
+	return fwOut
+}
+
+// getAgents collects the agents we know about into a suitable container.
+//
+// All agents are returned as active. The RecoveredAgents field will always be
+// empty.
+func (fm *FakeMesos) getAgents() *master.Response_GetAgents {
+	getAgents := master.Response_GetAgents{}
+	for _, agent := range fm.agents {
+		a := master.Response_GetAgents_Agent{
+			AgentInfo: copyAgent(agent),
+			Active:    true,
+		}
+		if pid, ok := fm.agentPIDs[agent.ID.Value]; ok {
+			a.PID = &pid
+		}
+		getAgents.Agents = append(getAgents.Agents, a)
+	}
+	return &getAgents
+}
+
+// copyAgent serialises and deserialises an agent in order to deep-copy it.
+func copyAgent(agentIn *mesos.AgentInfo) mesos.AgentInfo {
+	// We ignore all errors, because we expect the generated serialisation code
+	// to correctly-roud-trip any agent we give it.
+	bytes, _ := agentIn.Marshal() // #nosec G104
+	var agentOut mesos.AgentInfo
+	_ = agentOut.Unmarshal(bytes) // #nosec G104
+	return agentOut
+}
+
+// respondGetTasks returns a GET_TASKS response.
 func (fm *FakeMesos) respondGetTasks(w http.ResponseWriter) {
-	time.Sleep(fm.latency)
-	resp := master.Response{
+	fm.respond(w, master.Response{
 		Type:     master.Response_GET_TASKS,
 		GetTasks: fm.getTasks(),
+	})
+}
+
+// respondGetFrameworks returns a GET_FRAMEWORKS response.
+func (fm *FakeMesos) respondGetFrameworks(w http.ResponseWriter) {
+	fm.respond(w, master.Response{
+		Type:          master.Response_GET_FRAMEWORKS,
+		GetFrameworks: fm.getFrameworks(),
+	})
+}
+
+// respondGetAgents returns a GET_AGENTS response.
+func (fm *FakeMesos) respondGetAgents(w http.ResponseWriter) {
+	fm.respond(w, master.Response{
+		Type:      master.Response_GET_AGENTS,
+		GetAgents: fm.getAgents(),
+	})
+}
+
+// respondGetVersion returns a GET_VERSION response.
+func (fm *FakeMesos) respondGetVersion(w http.ResponseWriter) {
+	fm.respond(w, master.Response{
+		Type: master.Response_GET_VERSION,
+		GetVersion: &master.Response_GetVersion{
+			VersionInfo: mesos.VersionInfo{Version: fm.version},
+		},
+	})
+}
+
+// respondGetHealth returns a GET_HEALTH response.
+func (fm *FakeMesos) respondGetHealth(w http.ResponseWriter) {
+	fm.respond(w, master.Response{
+		Type:      master.Response_GET_HEALTH,
+		GetHealth: &master.Response_GetHealth{Healthy: !fm.unhealthy},
+	})
+}
+
+// respondGetMaster returns a GET_MASTER response describing the fake server,
+// which is always the leading master.
+func (fm *FakeMesos) respondGetMaster(w http.ResponseWriter) {
+	fm.respond(w, master.Response{
+		Type:      master.Response_GET_MASTER,
+		GetMaster: &master.Response_GetMaster{MasterInfo: fm.MasterInfo()},
+	})
+}
+
+// MasterInfo describes the fake server as a Mesos master.
+func (fm *FakeMesos) MasterInfo() *mesos.MasterInfo {
+	addr := fm.Listener.Addr().(*net.TCPAddr)
+	ip := addr.IP.String()
+	port := uint32(addr.Port)
+	return &mesos.MasterInfo{
+		ID:       "fake-master",
+		Port:     &port,
+		Hostname: &ip,
+		Version:  &fm.version,
+		Address:  &mesos.Address{IP: &ip, Port: int32(addr.Port)},
 	}
+}
+
+// respond writes a response after waiting a configured duration to simulate
+// actual request latency.
+func (fm *FakeMesos) respond(w http.ResponseWriter, resp master.Response) {
+	time.Sleep(fm.latency)
 	data, err := resp.Marshal()
 	err2panic(err)
 	w.Header().Set("Content-Type", "application/x-protobuf")
@@ -155,6 +342,8 @@ func (fm *FakeMesos) respondGetTasks(w http.ResponseWriter) {
 // AddTask adds one or more new tasks to fake Mesos. Panics if a task already
 // exists.
 func (fm *FakeMesos) AddTask(tasks ...mesos.Task) {
+	fm.tasksLock.Lock()
+	defer fm.tasksLock.Unlock()
 	for _, task := range tasks {
 		if _, ok := fm.tasks[task.TaskID.Value]; ok {
 			panic(fmt.Sprintf("Duplicate task: %s", task.TaskID.Value))
@@ -166,11 +355,49 @@ func (fm *FakeMesos) AddTask(tasks ...mesos.Task) {
 
 // RemoveTask removes one or more tasks by id. Missing tasks are ignored.
 func (fm *FakeMesos) RemoveTask(taskIDs ...string) {
+	fm.tasksLock.Lock()
+	defer fm.tasksLock.Unlock()
 	for _, taskID := range taskIDs {
 		delete(fm.tasks, taskID)
 	}
 }
 
+// AddFramework adds one or more new frameworks to fake Mesos. Each framework
+// must have an ID. Panics if a framework already exists.
+func (fm *FakeMesos) AddFramework(frameworks ...mesos.FrameworkInfo) {
+	for _, fw := range frameworks {
+		if fw.ID == nil {
+			panic(fmt.Sprintf("Framework has no ID: %s", fw.Name))
+		}
+		if _, ok := fm.frameworks[fw.ID.Value]; ok {
+			panic(fmt.Sprintf("Duplicate framework: %s", fw.ID.Value))
+		}
+		fwCopy := copyFramework(&fw)
+		fm.frameworks[fw.ID.Value] = &fwCopy
+	}
+}
+
+// AddAgent adds one or more new agents to fake Mesos. Each agent must have an
+// ID. Panics if an agent already exists.
+func (fm *FakeMesos) AddAgent(agents ...mesos.AgentInfo) {
+	for _, agent := range agents {
+		if agent.ID == nil {
+			panic(fmt.Sprintf("Agent has no ID: %s", agent.Hostname))
+		}
+		if _, ok := fm.agents[agent.ID.Value]; ok {
+			panic(fmt.Sprintf("Duplicate agent: %s", agent.ID.Value))
+		}
+		agentCopy := copyAgent(&agent)
+		fm.agents[agent.ID.Value] = &agentCopy
+	}
+}
+
+// SetAgentPID sets the PID (like "slave(1)@10.0.0.1:5051") that fake Mesos
+// reports for an agent. Agents have no PID unless one is set.
+func (fm *FakeMesos) SetAgentPID(agentID, pid string) {
+	fm.agentPIDs[agentID] = pid
+}
+
 // TaskUpdateFunc is the type of a function that updates a task.
 //
 // The task passed in should be updated in-place. Updates to TaskID are not
@@ -180,6 +407,8 @@ type TaskUpdateFunc func(task *mesos.Task)
 // UpdateTask updates one or more tasks using the given update function. Panics
 // if a task doesn't exist.
 func (fm *FakeMesos) UpdateTask(updateFunc TaskUpdateFunc, taskIDs ...string) {
+	fm.tasksLock.Lock()
+	defer fm.tasksLock.Unlock()
 	for _, taskID := range taskIDs {
 		task, ok := fm.tasks[taskID]
 		if !ok {
@@ -197,6 +426,22 @@ func UpdateState(state mesos.TaskState) TaskUpdateFunc {
 	return func(task *mesos.Task) { task.State = &state }
 }
 
+// UpdateStateAt returns a closure that updates the state of a task and records
+// a status update with the given timestamp, as the Mesos master does when a
+// task changes state.
+func UpdateStateAt(state mesos.TaskState, timestamp time.Time) TaskUpdateFunc {
+	return func(task *mesos.Task) {
+		task.State = &state
+		// Mesos timestamps are seconds since the epoch.
+		seconds := float64(timestamp.UnixNano()) / float64(time.Second)
+		task.Statuses = append(task.Statuses, mesos.TaskStatus{
+			TaskID:    task.TaskID,
+			State:     &state,
+			Timestamp: &seconds,
+		})
+	}
+}
+
 // err2panic lets us turn "impossible" errors into panics without leaving
 // untested error handlers in our code.
 func err2panic(err error) {
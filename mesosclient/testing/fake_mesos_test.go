@@ -3,6 +3,7 @@ package testing
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strings"
@@ -33,6 +34,22 @@ func mkTask(name, id string, state mesos.TaskState) mesos.Task {
 	}
 }
 
+// mkFramework builds a simple framework value.
+func mkFramework(name, id string) mesos.FrameworkInfo {
+	return mesos.FrameworkInfo{
+		Name: name,
+		ID:   &mesos.FrameworkID{Value: id},
+	}
+}
+
+// mkAgent builds a simple agent value.
+func mkAgent(hostname, id string) mesos.AgentInfo {
+	return mesos.AgentInfo{
+		Hostname: hostname,
+		ID:       &mesos.AgentID{Value: id},
+	}
+}
+
 // We can add a new task to FakeMesos.
 func (ts *FakeMesosTests) Test_AddTask_new() {
 	fm := NewFakeMesos()
@@ -150,6 +167,24 @@ func (ts *FakeMesosTests) Test_UpdateTask_multiple() {
 	})
 }
 
+// We can update a task's state with a timestamped status in FakeMesos.
+func (ts *FakeMesosTests) Test_UpdateTask_state_at() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fm.AddTask(mkTask("task", "abc-123", mesos.TASK_STARTING))
+	at := time.Unix(1500000000, 500000000)
+	fm.UpdateTask(UpdateStateAt(mesos.TASK_RUNNING, at), "abc-123")
+
+	task := fm.tasks["abc-123"]
+	ts.Equal(mesos.TASK_RUNNING, *task.State)
+	ts.Require().Len(task.Statuses, 1)
+	status := task.Statuses[0]
+	ts.Equal(task.TaskID, status.TaskID)
+	ts.Equal(mesos.TASK_RUNNING, *status.State)
+	ts.Equal(1500000000.5, *status.Timestamp)
+}
+
 // We can't update missing tasks in FakeMesos.
 func (ts *FakeMesosTests) Test_UpdateTask_missing() {
 	fm := NewFakeMesos()
@@ -177,6 +212,119 @@ func (ts *FakeMesosTests) Test_UpdateTask_missing() {
 	})
 }
 
+// We can add new frameworks to FakeMesos.
+func (ts *FakeMesosTests) Test_AddFramework_multiple() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fw1 := mkFramework("marathon", "fw-1")
+	fw2 := mkFramework("chronos", "fw-2")
+
+	ts.Equal(fm.frameworks, frameworkMap{})
+	fm.AddFramework(fw1, fw2)
+	ts.Equal(fm.frameworks, frameworkMap{"fw-1": &fw1, "fw-2": &fw2})
+}
+
+// We can't add duplicate frameworks or frameworks without IDs to FakeMesos.
+func (ts *FakeMesosTests) Test_AddFramework_duplicate_or_no_id() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fw := mkFramework("marathon", "fw-1")
+	fwdup := mkFramework("chronos", "fw-1")
+
+	ts.Panics(func() { fm.AddFramework(fw, fwdup) })
+	ts.Panics(func() { fm.AddFramework(mesos.FrameworkInfo{Name: "anonymous"}) })
+	// We successfully added the first framework, but nothing else.
+	ts.Equal(fm.frameworks, frameworkMap{"fw-1": &fw})
+}
+
+// Without frameworks to get, we get no frameworks.
+func (ts *FakeMesosTests) Test_getFrameworks_empty() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	ts.Equal(*fm.getFrameworks(), master.Response_GetFrameworks{})
+}
+
+// Frameworks are all active and connected.
+func (ts *FakeMesosTests) Test_getFrameworks_active() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fw1 := mkFramework("marathon", "fw-1")
+	fw2 := mkFramework("chronos", "fw-2")
+	fm.AddFramework(fw1, fw2)
+
+	// The order of the frameworks is arbitrary, so we can't just assert on
+	// the whole collection.
+	ts.ElementsMatch(fm.getFrameworks().Frameworks, []master.Response_GetFrameworks_Framework{
+		{FrameworkInfo: fw1, Active: true, Connected: true},
+		{FrameworkInfo: fw2, Active: true, Connected: true},
+	})
+}
+
+// We can add new agents to FakeMesos.
+func (ts *FakeMesosTests) Test_AddAgent_multiple() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	agent1 := mkAgent("agent1.example.com", "agent-1")
+	agent2 := mkAgent("agent2.example.com", "agent-2")
+
+	ts.Equal(fm.agents, agentMap{})
+	fm.AddAgent(agent1, agent2)
+	ts.Equal(fm.agents, agentMap{"agent-1": &agent1, "agent-2": &agent2})
+}
+
+// We can't add duplicate agents or agents without IDs to FakeMesos.
+func (ts *FakeMesosTests) Test_AddAgent_duplicate_or_no_id() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	agent := mkAgent("agent1.example.com", "agent-1")
+	agentdup := mkAgent("agent2.example.com", "agent-1")
+
+	ts.Panics(func() { fm.AddAgent(agent, agentdup) })
+	ts.Panics(func() { fm.AddAgent(mesos.AgentInfo{Hostname: "anonymous"}) })
+	// We successfully added the first agent, but nothing else.
+	ts.Equal(fm.agents, agentMap{"agent-1": &agent})
+}
+
+// Agents are all active.
+func (ts *FakeMesosTests) Test_getAgents() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	ts.Equal(*fm.getAgents(), master.Response_GetAgents{})
+
+	agent1 := mkAgent("agent1.example.com", "agent-1")
+	agent2 := mkAgent("agent2.example.com", "agent-2")
+	fm.AddAgent(agent1, agent2)
+
+	// The order of the agents is arbitrary, so we can't just assert on the
+	// whole collection.
+	ts.ElementsMatch(fm.getAgents().Agents, []master.Response_GetAgents_Agent{
+		{AgentInfo: agent1, Active: true},
+		{AgentInfo: agent2, Active: true},
+	})
+}
+
+// Agents have PIDs if we set them.
+func (ts *FakeMesosTests) Test_getAgents_pid() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	agent := mkAgent("agent1.example.com", "agent-1")
+	fm.AddAgent(agent)
+	fm.SetAgentPID("agent-1", "slave(1)@10.0.0.1:5051")
+
+	pid := "slave(1)@10.0.0.1:5051"
+	ts.Equal(fm.getAgents().Agents, []master.Response_GetAgents_Agent{
+		{AgentInfo: agent, Active: true, PID: &pid},
+	})
+}
+
 // Without tasks to get, we get no tasks.
 func (ts *FakeMesosTests) Test_getTasks_empty() {
 	fm := NewFakeMesos()
@@ -266,6 +414,28 @@ func (ts *FakeMesosTests) Test_API_bad_content_type() {
 	ts.Equal(resp.StatusCode, 415)
 }
 
+// Requests without the right credentials return 401 if we require them.
+func (ts *FakeMesosTests) Test_API_credentials() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+	fm.SetCredentials("vault", "sekrit")
+
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_TASKS)
+	ts.Equal(resp.StatusCode, 401)
+
+	call := &master.Call{Type: master.Call_GET_TASKS}
+	body := bytes.NewReader(ts.WithoutError(call.Marshal()).([]byte))
+	req := ts.WithoutError(http.NewRequest(http.MethodPost, fm.GetAPIURL(), body)).(*http.Request)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.SetBasicAuth("vault", "sekrit")
+	resp = ts.getResp(http.DefaultClient.Do(req))
+	ts.Equal(resp.StatusCode, 200)
+
+	fm.SetCredentials("", "")
+	resp = ts.postAPI(fm.GetAPIURL(), master.Call_GET_TASKS)
+	ts.Equal(resp.StatusCode, 200)
+}
+
 // Non-call request payloads return 400.
 func (ts *FakeMesosTests) Test_API_bad_request_payload() {
 	fm := NewFakeMesos()
@@ -338,6 +508,119 @@ func (ts *FakeMesosTests) Test_API_GET_TASKS_latency() {
 	ts.Truef(elapsed >= latency, "Expected latency of at least %s, got %s.", latency, elapsed)
 }
 
+// We can get the frameworks if frameworks exist.
+func (ts *FakeMesosTests) Test_API_GET_FRAMEWORKS_some_frameworks() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	fw := mkFramework("marathon", "fw-1")
+	fm.AddFramework(fw)
+
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_FRAMEWORKS)
+	ts.Equal(resp.StatusCode, 200)
+
+	var respData master.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData, master.Response{
+		Type: master.Response_GET_FRAMEWORKS,
+		GetFrameworks: &master.Response_GetFrameworks{
+			Frameworks: []master.Response_GetFrameworks_Framework{
+				{FrameworkInfo: fw, Active: true, Connected: true},
+			},
+		},
+	})
+}
+
+// We can get the agents if agents exist.
+func (ts *FakeMesosTests) Test_API_GET_AGENTS_some_agents() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	agent := mkAgent("agent1.example.com", "agent-1")
+	fm.AddAgent(agent)
+
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_AGENTS)
+	ts.Equal(resp.StatusCode, 200)
+
+	var respData master.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData, master.Response{
+		Type: master.Response_GET_AGENTS,
+		GetAgents: &master.Response_GetAgents{
+			Agents: []master.Response_GetAgents_Agent{
+				{AgentInfo: agent, Active: true},
+			},
+		},
+	})
+}
+
+// We get the default version unless we set a different one.
+func (ts *FakeMesosTests) Test_API_GET_VERSION() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	ts.Equal(ts.getVersion(fm), DefaultVersion)
+	fm.SetVersion("1.6.1")
+	ts.Equal(ts.getVersion(fm), "1.6.1")
+}
+
+// FakeMesos is healthy unless we tell it otherwise.
+func (ts *FakeMesosTests) Test_API_GET_HEALTH() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	ts.True(ts.getHealthy(fm))
+	fm.SetHealthy(false)
+	ts.False(ts.getHealthy(fm))
+	fm.SetHealthy(true)
+	ts.True(ts.getHealthy(fm))
+}
+
+// GET_MASTER describes the fake server.
+func (ts *FakeMesosTests) Test_API_GET_MASTER() {
+	fm := NewFakeMesos()
+	ts.AddCleanup(fm.Close)
+
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_MASTER)
+	ts.Equal(resp.StatusCode, 200)
+
+	var respData master.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData, master.Response{
+		Type:      master.Response_GET_MASTER,
+		GetMaster: &master.Response_GetMaster{MasterInfo: fm.MasterInfo()},
+	})
+	ts.Equal(fm.GetBaseURL(), fmt.Sprintf("http://%s:%d",
+		*respData.GetMaster.MasterInfo.Hostname, *respData.GetMaster.MasterInfo.Port))
+}
+
+// getVersion makes a GET_VERSION call and returns the version.
+func (ts *FakeMesosTests) getVersion(fm *FakeMesos) string {
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_VERSION)
+	ts.Equal(resp.StatusCode, 200)
+
+	var respData master.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData.Type, master.Response_GET_VERSION)
+	return respData.GetVersion.VersionInfo.Version
+}
+
+// getHealthy makes a GET_HEALTH call and returns the health.
+func (ts *FakeMesosTests) getHealthy(fm *FakeMesos) bool {
+	resp := ts.postAPI(fm.GetAPIURL(), master.Call_GET_HEALTH)
+	ts.Equal(resp.StatusCode, 200)
+
+	var respData master.Response
+	respBytes := ts.WithoutError(ioutil.ReadAll(resp.Body)).([]byte)
+	ts.NoError(respData.Unmarshal(respBytes))
+	ts.Equal(respData.Type, master.Response_GET_HEALTH)
+	return respData.GetHealth.Healthy
+}
+
 // getResp is a type signature hack.
 func (ts *FakeMesosTests) getResp(resp *http.Response, err error) *http.Response {
 	return ts.WithoutError(resp, err).(*http.Response)
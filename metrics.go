@@ -0,0 +1,81 @@
+package mesosauth
+
+import (
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/logical"
+)
+
+// These are the keys for the metrics we emit. Mesos API call metrics are
+// emitted by the Mesos client itself.
+var (
+	metricLogin         = []string{"mesos", "login"}
+	metricLoginAttempt  = []string{"mesos", "login", "attempt"}
+	metricLoginSuccess  = []string{"mesos", "login", "success"}
+	metricLoginDenied   = []string{"mesos", "login", "denied"}
+	metricLoginLockout  = []string{"mesos", "login", "lockout"}
+	metricRenew         = []string{"mesos", "renew"}
+	metricRenewAttempt  = []string{"mesos", "renew", "attempt"}
+	metricRenewSuccess  = []string{"mesos", "renew", "success"}
+	metricRenewFailure  = []string{"mesos", "renew", "failure"}
+	metricTaskInstances = []string{"mesos", "task-instances"}
+	metricTaskInstTotal = []string{"mesos", "task-instances", "total"}
+)
+
+// prefixLabels returns labels for metrics about a task ID prefix. We must only
+// use these for prefixes we know about, because otherwise anyone who can make
+// a login request can create as many distinct metrics as they like.
+func prefixLabels(prefix string) []metrics.Label {
+	return []metrics.Label{{Name: "prefix", Value: prefix}}
+}
+
+// metricLabels returns labels for metrics about a login. We only label by
+// prefix once we've found a task-policies entry for it.
+func (ld *loginDecision) metricLabels() []metrics.Label {
+	if ld.tp == nil || ld.policySource != policySourceTaskPolicies {
+		return nil
+	}
+	return prefixLabels(ld.prefix)
+}
+
+// renewalMetricLabels returns labels for metrics about a renewal. We issued
+// the token, so its prefix is one we know about.
+func renewalMetricLabels(auth *logical.Auth) []metrics.Label {
+	taskID, _ := auth.InternalData["task-id"].(string)
+	prefix, err := taskIDPrefix(taskID)
+	if err != nil {
+		return nil
+	}
+	return prefixLabels(prefix)
+}
+
+// incrCounter increments a counter, using the backend's Metrics object if it
+// has one and the global one otherwise.
+func (b *mesosBackend) incrCounter(key []string, labels []metrics.Label) {
+	if b.metrics != nil {
+		b.metrics.IncrCounterWithLabels(key, 1, labels)
+		return
+	}
+	metrics.IncrCounterWithLabels(key, 1, labels)
+}
+
+// measureSince records the time elapsed since start, using the backend's
+// Metrics object if it has one and the global one otherwise.
+func (b *mesosBackend) measureSince(key []string, start time.Time, labels []metrics.Label) {
+	if b.metrics != nil {
+		b.metrics.MeasureSinceWithLabels(key, start, labels)
+		return
+	}
+	metrics.MeasureSinceWithLabels(key, start, labels)
+}
+
+// setGauge sets a gauge, using the backend's Metrics object if it has one and
+// the global one otherwise.
+func (b *mesosBackend) setGauge(key []string, val float32, labels []metrics.Label) {
+	if b.metrics != nil {
+		b.metrics.SetGaugeWithLabels(key, val, labels)
+		return
+	}
+	metrics.SetGaugeWithLabels(key, val, labels)
+}
@@ -0,0 +1,88 @@
+package mesosauth
+
+import (
+	"testing"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// MetricsTests is a testify test suite object that we can attach helper
+// methods to.
+type MetricsTests struct{ TestSuite }
+
+// Test_Metrics is a standard Go test function that runs our test suite's
+// tests.
+func Test_Metrics(t *testing.T) { suite.Run(t, new(MetricsTests)) }
+
+// gaugeEqual asserts that a gauge has been set to the given value.
+func (ts *MetricsTests) gaugeEqual(key string, expected float32) {
+	ts.T().Helper()
+	value, ok := ts.GaugeValue(key)
+	ts.True(ok, "gauge %s not set", key)
+	ts.Equal(expected, value)
+}
+
+// Logins are counted and timed, and denials are counted by reason. Only
+// prefixes with task-policies entries are used as labels.
+func (ts *MetricsTests) Test_login_metrics() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkDockerTask("web", "web.abc-123", "evil/miner:latest"))
+	ts.SetTaskPolicies("task", "insurance")
+	ts.SetTaskImagePolicies("web", "nginx:*", "insurance")
+
+	ts.Login("task.abc-123")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}), "permission denied")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "web.abc-123"}), "permission denied")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "unknown.abc-123"}), "permission denied")
+
+	ts.Equal(4, ts.MetricCount("mesos.login.attempt"))
+	ts.Equal(4, ts.MetricCount("mesos.login"))
+	ts.Equal(1, ts.MetricCount("mesos.login.success;prefix=task"))
+	ts.Equal(1, ts.MetricCount("mesos.login.denied;prefix=task;reason=already-logged-in"))
+	ts.Equal(1, ts.MetricCount("mesos.login.denied;prefix=web;reason=image-not-allowed"))
+	ts.Equal(1, ts.MetricCount("mesos.login.denied;reason=no-policy-mapping"))
+	// The Mesos client emits its metrics through our metrics object.
+	ts.Equal(2, ts.MetricCount("mesos.call;call=GET_TASKS"))
+}
+
+// Renewals and renewal failures are counted and timed.
+func (ts *MetricsTests) Test_renewal_metrics() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(mkTask("task", "task.abc-123", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+	auth := ts.Login("task.abc-123")
+
+	ts.HandleRequestSuccess(ts.mkRenew(auth))
+	ts.RemoveTask("task.abc-123")
+	ts.HandleRequestError(ts.mkRenew(auth), "task task.abc-123 not found during renewal")
+
+	ts.Equal(2, ts.MetricCount("mesos.renew.attempt;prefix=task"))
+	ts.Equal(2, ts.MetricCount("mesos.renew;prefix=task"))
+	ts.Equal(1, ts.MetricCount("mesos.renew.success;prefix=task"))
+	ts.Equal(1, ts.MetricCount("mesos.renew.failure;prefix=task"))
+}
+
+// The number of task instances we store is reported per prefix on login and
+// in total on status reads.
+func (ts *MetricsTests) Test_task_instances_metrics() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING))
+	ts.SetTaskPolicies("task", "insurance")
+
+	ts.Login("task.abc-123")
+	ts.gaugeEqual("mesos.task-instances;prefix=task", 1)
+	ts.Login("task.abc-124")
+	ts.gaugeEqual("mesos.task-instances;prefix=task", 2)
+
+	_, ok := ts.GaugeValue("mesos.task-instances.total")
+	ts.False(ok)
+	ts.HandleRequestSuccess(ts.mkReadReq("status"))
+	ts.gaugeEqual("mesos.task-instances.total", 2)
+}
@@ -0,0 +1,105 @@
+package mesosauth
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/vault/logical"
+)
+
+// These constants are the valid values for the "renewal-policy-change" config
+// setting, which determines what happens when a token is renewed after the
+// policies it would be granted have changed. Vault doesn't change a token's
+// policies on renewal, so the token always keeps the policies it was issued
+// with.
+const (
+	// policyChangeFail fails the renewal if the policies have changed at all.
+	policyChangeFail = "fail"
+	// policyChangeRejectRemoved fails the renewal only if policies have been
+	// removed from the mapping since login, because renewing the token would
+	// keep privileges beyond what the current mappings allow. Policies added
+	// to the mapping since login are harmless, so those renewals succeed.
+	policyChangeRejectRemoved = "reject-removed"
+)
+
+// policyChanges lists the valid renewal policy change behaviours.
+var policyChanges = []string{policyChangeFail, policyChangeRejectRemoved}
+
+// These constants are the policy check decisions we record in a renewed
+// token's internal data.
+const (
+	// policyCheckUnchanged means the policies we would grant are the ones
+	// the token has.
+	policyCheckUnchanged = "unchanged"
+	// policyCheckGained means we would now grant policies that the token
+	// doesn't have, which is harmless.
+	policyCheckGained = "allowed: mapping grants additional policies"
+)
+
+// These constants are the values for the "policy-source" internal data, which
+// records where a token's policies came from.
+const (
+	policySourceTaskPolicies    = "task-policies"
+	policySourceDefaultPolicies = "default-policies"
+)
+
+// checkPolicyChange compares the policies a token was issued with against the
+// policies we would grant now, and returns the decision to record if the
+// renewal may proceed.
+func checkPolicyChange(behaviour string, issued []string, current []string) (string, error) {
+	var added, removed []string
+	for _, policy := range current {
+		if !containsPolicy(issued, policy) {
+			added = append(added, policy)
+		}
+	}
+	for _, policy := range issued {
+		if !containsPolicy(current, policy) {
+			removed = append(removed, policy)
+		}
+	}
+
+	switch {
+	case len(added) == 0 && len(removed) == 0:
+		return policyCheckUnchanged, nil
+	case len(removed) > 0:
+		return "", fmt.Errorf("token has policies that are no longer granted: %v", removed)
+	case behaviour == policyChangeRejectRemoved:
+		return policyCheckGained, nil
+	}
+	return "", fmt.Errorf("policies have changed since login: %v added", added)
+}
+
+// containsPolicy checks whether a policy list contains the given policy. The
+// "default" policy is added to tokens by Vault rather than by us, so we treat
+// it as always present.
+func containsPolicy(policies []string, policy string) bool {
+	if policy == "default" {
+		return true
+	}
+	for _, p := range policies {
+		if p == policy {
+			return true
+		}
+	}
+	return false
+}
+
+// issuedPolicies returns the policies we granted a token at login. Tokens
+// issued before we recorded them only have the policies Vault gives us, which
+// may include some that didn't come from us.
+func issuedPolicies(auth *logical.Auth) []string {
+	switch policies := auth.InternalData["policies"].(type) {
+	case []string:
+		return policies
+	case []interface{}:
+		// Internal data that has been through storage has lost its types.
+		strs := make([]string, 0, len(policies))
+		for _, p := range policies {
+			if s, ok := p.(string); ok {
+				strs = append(strs, s)
+			}
+		}
+		return strs
+	}
+	return auth.Policies
+}
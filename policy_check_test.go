@@ -0,0 +1,61 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// PolicyCheckTests is a testify test suite object that we can attach helper
+// methods to.
+type PolicyCheckTests struct{ TestSuite }
+
+// Test_PolicyCheck is a standard Go test function that runs our test suite's
+// tests.
+func Test_PolicyCheck(t *testing.T) { suite.Run(t, new(PolicyCheckTests)) }
+
+var policyChangeData = []struct {
+	behaviour string
+	issued    []string
+	current   []string
+	decision  string
+	err       string
+}{
+	{policyChangeFail, []string{"a"}, []string{"a"}, policyCheckUnchanged, ""},
+	{policyChangeFail, []string{"default", "a"}, []string{"a"}, policyCheckUnchanged, ""},
+	{policyChangeFail, []string{"a"}, []string{"a", "b"}, "", "policies have changed since login: [b] added"},
+	{policyChangeFail, []string{"a", "b"}, []string{"a"}, "", "token has policies that are no longer granted: [b]"},
+	{policyChangeRejectRemoved, []string{"a"}, []string{"a", "b"}, policyCheckGained, ""},
+	{policyChangeRejectRemoved, []string{"a", "b"}, []string{"a"}, "", "token has policies that are no longer granted: [b]"},
+}
+
+// Policy changes are allowed or rejected according to the configured
+// behaviour.
+func (ts *PolicyCheckTests) Test_checkPolicyChange() {
+	for _, pcd := range policyChangeData {
+		decision, err := checkPolicyChange(pcd.behaviour, pcd.issued, pcd.current)
+		ts.Equalf(pcd.decision, decision, "%#v", pcd)
+		if pcd.err == "" {
+			ts.NoErrorf(err, "%#v", pcd)
+		} else {
+			ts.EqualErrorf(err, pcd.err, "%#v", pcd)
+		}
+	}
+}
+
+// The issued policies come from internal data whether or not it has been
+// through storage, and from the token's policies if it has none.
+func (ts *PolicyCheckTests) Test_issuedPolicies() {
+	ts.Equal(issuedPolicies(&logical.Auth{
+		InternalData: jsonobj{"policies": []string{"a"}},
+	}), []string{"a"})
+	ts.Equal(issuedPolicies(&logical.Auth{
+		InternalData: jsonobj{"policies": []interface{}{"a"}},
+	}), []string{"a"})
+	ts.Equal(issuedPolicies(&logical.Auth{
+		Policies: []string{"default", "a"},
+	}), []string{"default", "a"})
+}
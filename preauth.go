@@ -0,0 +1,143 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	// defaultPreauthTTL is how long a pre-authorization lasts if the request
+	// doesn't say.
+	defaultPreauthTTL = 5 * time.Minute
+	// maxPreauthTTL is the longest a pre-authorization may last. They are
+	// meant to cover the time between launching a task and its login.
+	maxPreauthTTL = time.Hour
+)
+
+// pathPreauth returns the "preauth/<task-id>" path struct. It is a function
+// rather than a method because we never call it once the backend struct is
+// built and we don't want name collisions with any request handler methods.
+func pathPreauth(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		// Task IDs are arbitrary strings, so we match everything after the
+		// prefix. Capture group names can't contain hyphens, so this field
+		// is "task_id" rather than the "task-id" we use elsewhere.
+		Pattern: "preauth/(?P<task_id>.+)",
+		Fields: map[string]*framework.FieldSchema{
+			"task_id": {Type: framework.TypeString},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the pre-authorization lasts. Defaults to five minutes, and may not exceed an hour.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathPreauthUpdate,
+			logical.ReadOperation:   b.pathPreauthRead,
+			logical.DeleteOperation: b.pathPreauthDelete,
+		},
+	}
+}
+
+// preauth is used to store a pre-authorization for a task ID.
+type preauth struct {
+	Expires time.Time
+}
+
+// paKey builds a pre-authorization storage key.
+func paKey(taskID string) string {
+	return "preauth/" + taskID
+}
+
+// pathPreauthUpdate is the "preauth/<task-id>" update request handler. It
+// registers a task ID that we expect to log in soon.
+func (b *mesosBackend) pathPreauthUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	taskID := d.Get("task_id").(string)
+	if _, err := taskIDPrefix(taskID); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	ttl := defaultPreauthTTL
+	if ttlSeconds, ok := d.GetOk("ttl"); ok {
+		ttl = time.Duration(ttlSeconds.(int)) * time.Second
+	}
+	if ttl <= 0 || ttl > maxPreauthTTL {
+		return logical.ErrorResponse(fmt.Sprintf("ttl must be positive and no more than %s", maxPreauthTTL)), nil
+	}
+
+	pa := preauth{Expires: time.Now().Add(ttl)}
+	b.Logger().Info("PREAUTH", "task-id", taskID, "expires", pa.Expires)
+
+	err := rh.store(paKey(taskID), pa)
+	return &logical.Response{}, err
+}
+
+// pathPreauthRead is the "preauth/<task-id>" read request handler.
+func (b *mesosBackend) pathPreauthRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	pa, err := rh.getPreauthOrNil(d.Get("task_id").(string))
+	if pa == nil || err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: jsonobj{
+			"expires": pa.Expires.UTC().Format(time.RFC3339Nano),
+			"expired": pa.expired(),
+		},
+	}, nil
+}
+
+// pathPreauthDelete is the "preauth/<task-id>" delete request handler.
+func (b *mesosBackend) pathPreauthDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+	return nil, rh.delete(paKey(d.Get("task_id").(string)))
+}
+
+// expired checks whether a pre-authorization has expired.
+func (pa *preauth) expired() bool {
+	return !time.Now().Before(pa.Expires)
+}
+
+// getPreauthOrNil fetches the pre-authorization for a task ID, returning nil
+// if there is none.
+func (rh *requestHelper) getPreauthOrNil(taskID string) (*preauth, error) {
+	var pa *preauth
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			return nil
+		}
+		pa = &preauth{}
+		return se.DecodeJSON(pa)
+	}
+	err := rh.fetch(paKey(taskID), decode)
+	return pa, err
+}
+
+// tidyPreauths deletes expired pre-authorizations, because a task that was
+// expected but never logged in would otherwise leave one behind forever.
+func (rh *requestHelper) tidyPreauths() (int, error) {
+	taskIDs, err := rh.storage.List(rh.ctx, paKey(""))
+	if err != nil {
+		return 0, err
+	}
+	tidied := 0
+	for _, taskID := range taskIDs {
+		pa, err := rh.getPreauthOrNil(taskID)
+		if err != nil {
+			return tidied, err
+		}
+		if pa != nil && pa.expired() {
+			if err := rh.delete(paKey(taskID)); err != nil {
+				return tidied, err
+			}
+			tidied++
+		}
+	}
+	return tidied, nil
+}
@@ -0,0 +1,144 @@
+package mesosauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// PreauthTests is a testify test suite object that we can attach helper
+// methods to.
+type PreauthTests struct{ TestSuite }
+
+// Test_Preauth is a standard Go test function that runs our test suite's
+// tests.
+func Test_Preauth(t *testing.T) { suite.Run(t, new(PreauthTests)) }
+
+// setupPreauthTask sets up a backend with a running task whose prefix
+// requires pre-authorization.
+func (ts *PreauthTests) setupPreauthTask() {
+	ts.SetupLoginTask("task.abc-123", jsonobj{})
+	ts.SetTaskTokenPolicies("task", jsonobj{"require-preauth": true}, "insurance")
+}
+
+// A pre-authorization can be created, read and deleted.
+func (ts *PreauthTests) Test_write_read_delete() {
+	ts.SetupBackend()
+
+	ts.Nil(ts.HandleRequest(ts.mkReadReq("preauth/task.abc-123")))
+
+	ts.HandleRequestSuccess(ts.mkReq("preauth/task.abc-123", jsonobj{"ttl": "2m"}))
+	data := ts.HandleRequest(ts.mkReadReq("preauth/task.abc-123")).Data
+	ts.Equal(data["expired"], false)
+	expires, err := time.Parse(time.RFC3339Nano, data["expires"].(string))
+	ts.Require().NoError(err)
+	ts.WithinDuration(time.Now().Add(2*time.Minute), expires, 5*time.Second)
+
+	ts.HandleRequestSuccess(ts.mkDeleteReq("preauth/task.abc-123"))
+	ts.Nil(ts.GetStored("preauth/task.abc-123"))
+}
+
+// Pre-authorizations last five minutes by default.
+func (ts *PreauthTests) Test_default_ttl() {
+	ts.SetupBackend()
+
+	ts.HandleRequestSuccess(ts.mkReq("preauth/task.abc-123", jsonobj{}))
+	var pa preauth
+	ts.Require().NoError(ts.GetStored("preauth/task.abc-123").DecodeJSON(&pa))
+	ts.WithinDuration(time.Now().Add(5*time.Minute), pa.Expires, 5*time.Second)
+}
+
+// Malformed task IDs and unreasonable TTLs are rejected.
+func (ts *PreauthTests) Test_invalid() {
+	ts.SetupBackend()
+
+	resp := ts.HandleRequest(ts.mkReq("preauth/no-prefix", jsonobj{}))
+	ts.Equal(resp, logical.ErrorResponse(`malformed task-id: "no-prefix"`))
+
+	resp = ts.HandleRequest(ts.mkReq("preauth/task.abc-123", jsonobj{"ttl": "2h"}))
+	ts.Equal(resp, logical.ErrorResponse("ttl must be positive and no more than 1h0m0s"))
+	ts.Nil(ts.GetStored("preauth/task.abc-123"))
+}
+
+// A prefix that requires pre-authorization shows it in its read response.
+func (ts *PreauthTests) Test_task_policies_read() {
+	ts.setupPreauthTask()
+
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": "task"}
+	ts.Equal(ts.HandleRequest(req).Data["require-preauth"], true)
+}
+
+// A task whose prefix requires pre-authorization can't log in without one.
+func (ts *PreauthTests) Test_login_not_preauthorized() {
+	ts.setupPreauthTask()
+
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	ts.HandleRequestError(req, "permission denied: not-preauthorized: task has not been pre-authorized")
+}
+
+// A pre-authorization lets a task log in, and is used up by the login.
+func (ts *PreauthTests) Test_login_preauthorized() {
+	ts.setupPreauthTask()
+	ts.HandleRequestSuccess(ts.mkReq("preauth/task.abc-123", jsonobj{}))
+
+	auth := ts.Login("task.abc-123")
+	ts.Equal(auth.Policies, []string{"insurance"})
+	ts.Nil(ts.GetStored("preauth/task.abc-123"))
+}
+
+// A login that loses a race with another login for the same task doesn't
+// use up the pre-authorization.
+func (ts *PreauthTests) Test_login_race_keeps_preauth() {
+	ts.setupPreauthTask()
+	ts.HandleRequestSuccess(ts.mkReq("preauth/task.abc-123", jsonobj{}))
+
+	err := ts.LoginLosingRace(paKey("task.abc-123"), jsonobj{"task-id": "task.abc-123"})
+	ts.EqualError(err, "permission denied: already-logged-in: task has already logged in")
+	ts.NotNil(ts.GetStored("preauth/task.abc-123"))
+}
+
+// An expired pre-authorization doesn't let a task log in.
+func (ts *PreauthTests) Test_login_expired() {
+	ts.setupPreauthTask()
+	ts.PutStored("preauth/task.abc-123", preauth{Expires: time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)})
+
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	ts.HandleRequestError(req,
+		"permission denied: not-preauthorized: pre-authorization expired at 2018-07-01T12:00:00Z")
+}
+
+// Pre-authorizations are ignored for prefixes that don't require them.
+func (ts *PreauthTests) Test_login_not_required() {
+	ts.SetupLoginTask("task.abc-123", jsonobj{})
+
+	ts.Login("task.abc-123")
+}
+
+// A login check shows the pre-authorization step without using it up.
+func (ts *PreauthTests) Test_login_check() {
+	ts.setupPreauthTask()
+	ts.HandleRequestSuccess(ts.mkReq("preauth/task.abc-123", jsonobj{}))
+
+	data := ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data
+	ts.Equal(data["allowed"], true)
+	ts.Contains(data["steps"], jsonobj{"step": "preauth", "result": "ok", "detail": "task is pre-authorized"})
+	ts.NotNil(ts.GetStored("preauth/task.abc-123"))
+}
+
+// Expired pre-authorizations are tidied up in the background.
+func (ts *PreauthTests) Test_periodic_tidy() {
+	ts.SetupBackend()
+	ts.PutStored("preauth/old.abc-123", preauth{Expires: time.Now().Add(-time.Second)})
+	ts.PutStored("preauth/new.abc-123", preauth{Expires: time.Now().Add(time.Minute)})
+
+	req := &logical.Request{Storage: ts.storage}
+	ts.Require().NoError(ts.backend.periodic(context.Background(), req))
+	ts.Nil(ts.GetStored("preauth/old.abc-123"))
+	ts.NotNil(ts.GetStored("preauth/new.abc-123"))
+}
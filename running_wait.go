@@ -0,0 +1,72 @@
+package mesosauth
+
+import (
+	"context"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+)
+
+// defaultRunningPollInterval is how often we ask Mesos about a task we're
+// waiting for.
+const defaultRunningPollInterval = 500 * time.Millisecond
+
+// maxRunningWait is the longest we let a login wait for a task. Each waiting
+// login holds an unauthenticated request open and keeps asking Mesos about
+// the task, so we don't want them hanging around for long.
+const maxRunningWait = 5 * time.Minute
+
+// taskStarting checks whether Mesos knows about a task that hasn't started
+// running yet but may be about to.
+func taskStarting(taskID string, rgt *master.Response_GetTasks) bool {
+	for _, task := range rgt.PendingTasks {
+		if task.TaskID.Value == taskID {
+			return true
+		}
+	}
+	for _, task := range rgt.Tasks {
+		if task.TaskID.Value != taskID || task.State == nil {
+			continue
+		}
+		switch *task.State {
+		case mesos.TASK_STAGING, mesos.TASK_STARTING:
+			return true
+		}
+	}
+	return false
+}
+
+// waitForRunningTask polls Mesos until a starting task is running, stops
+// starting, or the wait is over. It returns the running task (or nil if it
+// isn't running) and the last tasks response we got. If the request is
+// cancelled while we're waiting, we return its error.
+func (b *mesosBackend) waitForRunningTask(ctx context.Context, src taskSource, taskID string, rgt *master.Response_GetTasks, wait time.Duration) (*mesos.Task, *master.Response_GetTasks, error) {
+	b.Logger().Info("WAITING FOR TASK", "task-id", taskID, "wait", wait)
+	waitCtx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+
+	ticker := time.NewTicker(b.runningPollInterval)
+	defer ticker.Stop()
+
+	for taskStarting(taskID, rgt) {
+		select {
+		case <-waitCtx.Done():
+			return nil, rgt, ctx.Err()
+		case <-ticker.C:
+		}
+		next, err := src.getTasks(waitCtx)
+		if err != nil {
+			// If the wait ran out during the call, it's not Mesos's fault.
+			if waitCtx.Err() != nil {
+				return nil, rgt, ctx.Err()
+			}
+			return nil, rgt, err
+		}
+		rgt = next
+		if task := b.findRunningTask(taskID, rgt); task != nil {
+			return task, rgt, nil
+		}
+	}
+	return nil, rgt, nil
+}
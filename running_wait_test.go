@@ -0,0 +1,132 @@
+package mesosauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// RunningWaitTests is a testify test suite object that we can attach helper
+// methods to.
+type RunningWaitTests struct{ TestSuite }
+
+// Test_RunningWait is a standard Go test function that runs our test suite's
+// tests.
+func Test_RunningWait(t *testing.T) { suite.Run(t, new(RunningWaitTests)) }
+
+// setupStagingTask sets up a backend with a staging task and the given
+// running-wait setting. We poll much more often than usual so that the tests
+// don't have to wait long.
+func (ts *RunningWaitTests) setupStagingTask(runningWait string) {
+	ts.SetupLoginTasks(jsonobj{"running-wait": runningWait}, mkTask("task", "task.abc-123", mesos.TASK_STAGING))
+	ts.backend.runningPollInterval = 10 * time.Millisecond
+}
+
+// updateStateAfter changes the task's state after a delay, while a login may
+// be waiting for it.
+func (ts *RunningWaitTests) updateStateAfter(delay time.Duration, state mesos.TaskState) {
+	fm := ts.fakeMesos
+	timer := time.AfterFunc(delay, func() { fm.UpdateTask(mctesting.UpdateState(state), "task.abc-123") })
+	ts.AddCleanup(func() { timer.Stop() })
+}
+
+// The running wait can be configured, but not to a negative duration or one
+// longer than the maximum.
+func (ts *RunningWaitTests) Test_config() {
+	ts.setupStagingTask("5s")
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("config")).Data["running-wait"], "5s")
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "running-wait": -1}))
+	ts.Equal(resp, logical.ErrorResponse("running-wait must not be negative"))
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"skip-verify": true, "running-wait": "5m"}))
+	resp = ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "running-wait": "5m1s"}))
+	ts.Equal(resp, logical.ErrorResponse("running-wait must not exceed 5m0s"))
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("config")).Data["running-wait"], "5m0s")
+}
+
+// Without a running wait, a task that isn't running yet can't log in.
+func (ts *RunningWaitTests) Test_no_wait() {
+	ts.setupStagingTask("0s")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-not-running: task is not running")
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_TASKS"))
+}
+
+// A login waits for a staging task to pass through TASK_STARTING to
+// TASK_RUNNING.
+func (ts *RunningWaitTests) Test_becomes_running() {
+	ts.setupStagingTask("5s")
+	ts.updateStateAfter(30*time.Millisecond, mesos.TASK_STARTING)
+	ts.updateStateAfter(60*time.Millisecond, mesos.TASK_RUNNING)
+
+	ts.Login("task.abc-123")
+	ts.True(ts.MetricCount("mesos.call;call=GET_TASKS") > 1)
+}
+
+// A login only waits as long as it's configured to.
+func (ts *RunningWaitTests) Test_times_out() {
+	ts.setupStagingTask("1s")
+
+	start := time.Now()
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-not-running: task did not start running within 1s")
+	ts.True(time.Since(start) >= time.Second)
+}
+
+// A login stops waiting as soon as the task stops starting without running.
+func (ts *RunningWaitTests) Test_fails_while_waiting() {
+	ts.setupStagingTask("5s")
+	ts.updateStateAfter(30*time.Millisecond, mesos.TASK_FAILED)
+
+	start := time.Now()
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-not-running: task is not running")
+	ts.True(time.Since(start) < time.Second)
+}
+
+// A login stops waiting when its request is cancelled.
+func (ts *RunningWaitTests) Test_cancelled() {
+	ts.setupStagingTask("5s")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := ts.backend.HandleRequest(ctx, ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}))
+	ts.EqualError(err, "context deadline exceeded")
+	ts.True(time.Since(start) < time.Second)
+}
+
+// Tasks that aren't starting, running or known at all aren't waited for.
+func (ts *RunningWaitTests) Test_not_starting() {
+	ts.setupStagingTask("5s")
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_FINISHED), "task.abc-123")
+
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-not-running: task is not running")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-124"}),
+		"permission denied: task-not-running: task is not running")
+	ts.Equal(2, ts.MetricCount("mesos.call;call=GET_TASKS"))
+}
+
+// A login check says that a login would wait, without waiting itself.
+func (ts *RunningWaitTests) Test_login_check() {
+	ts.setupStagingTask("5s")
+
+	data := ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data
+	ts.Equal(data["denial-reason"], "task-not-running")
+	ts.Contains(data["steps"], jsonobj{
+		"step":   "mesos-task",
+		"result": "denied",
+		"reason": "task-not-running",
+		"detail": "task is not running yet, a login would wait up to 5s",
+	})
+}
@@ -0,0 +1,159 @@
+package mesosauth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+const (
+	// secretIDSize is the size of a secret ID in bytes, before hex encoding.
+	secretIDSize = 32
+	// defaultSecretIDTTL is how long a secret ID lasts if the request doesn't
+	// say.
+	defaultSecretIDTTL = 10 * time.Minute
+	// maxSecretIDTTL is the longest a secret ID may last. A secret ID only
+	// needs to outlive the time it takes to launch the task it's for.
+	maxSecretIDTTL = 24 * time.Hour
+)
+
+// pathIssue returns the "issue/<prefix>" path struct. It is a function rather
+// than a method because we never call it once the backend struct is built and
+// we don't want name collisions with any request handler methods.
+func pathIssue(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		// Having the prefix in the path lets operators write ACL policies
+		// that only let a scheduler issue secret IDs for its own tasks.
+		Pattern: "issue/(?P<prefix>.+)",
+		Fields: map[string]*framework.FieldSchema{
+			"prefix":  {Type: framework.TypeString},
+			"task-id": {Type: framework.TypeString},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: "How long the secret ID lasts. Defaults to ten minutes, and may not exceed a day.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.UpdateOperation: b.pathIssue,
+		},
+	}
+}
+
+// secretID is used to store a secret ID issued for a task ID. We only store a
+// hash of the secret, so anyone who can read our storage still can't use it.
+type secretID struct {
+	Hash    string
+	Expires time.Time
+}
+
+// siKey builds a secret ID storage key.
+func siKey(taskID string) string {
+	return "secret-ids/" + taskID
+}
+
+// hashSecretID hashes a secret ID for storage.
+func hashSecretID(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// expired checks whether a secret ID has expired.
+func (si *secretID) expired() bool {
+	return !time.Now().Before(si.Expires)
+}
+
+// matches checks a secret against the stored hash in constant time.
+func (si *secretID) matches(secret string) bool {
+	return hmac.Equal([]byte(hashSecretID(secret)), []byte(si.Hash))
+}
+
+// pathIssue is the "issue/<prefix>" update request handler. It returns a new
+// secret ID bound to the given task ID, replacing any earlier one. Schedulers
+// should ask for the response to be wrapped and give the task the wrapping
+// token, so the secret ID itself is never visible to anything but the task.
+func (b *mesosBackend) pathIssue(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	prefix := d.Get("prefix").(string)
+	taskID := d.Get("task-id").(string)
+	taskPrefix, err := taskIDPrefix(taskID)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	if taskPrefix != prefix {
+		return logical.ErrorResponse(fmt.Sprintf("task-id %q does not have prefix %q", taskID, prefix)), nil
+	}
+
+	ttl := defaultSecretIDTTL
+	if ttlSeconds, ok := d.GetOk("ttl"); ok {
+		ttl = time.Duration(ttlSeconds.(int)) * time.Second
+	}
+	if ttl <= 0 || ttl > maxSecretIDTTL {
+		return logical.ErrorResponse(fmt.Sprintf("ttl must be positive and no more than %s", maxSecretIDTTL)), nil
+	}
+
+	raw := make([]byte, secretIDSize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	secret := hex.EncodeToString(raw)
+	si := secretID{Hash: hashSecretID(secret), Expires: time.Now().Add(ttl)}
+
+	b.Logger().Info("SECRET ID ISSUED", "task-id", taskID, "expires", si.Expires)
+
+	if err := rh.store(siKey(taskID), si); err != nil {
+		return nil, err
+	}
+	return &logical.Response{
+		Data: jsonobj{
+			"secret-id": secret,
+			"task-id":   taskID,
+			"expires":   si.Expires.UTC().Format(time.RFC3339Nano),
+		},
+	}, nil
+}
+
+// getSecretIDOrNil fetches the secret ID issued for a task ID, returning nil
+// if there is none.
+func (rh *requestHelper) getSecretIDOrNil(taskID string) (*secretID, error) {
+	var si *secretID
+	decode := func(se *logical.StorageEntry) error {
+		if se == nil {
+			return nil
+		}
+		si = &secretID{}
+		return se.DecodeJSON(si)
+	}
+	err := rh.fetch(siKey(taskID), decode)
+	return si, err
+}
+
+// tidySecretIDs deletes expired secret IDs, because a task that never logged
+// in would otherwise leave one behind forever.
+func (rh *requestHelper) tidySecretIDs() (int, error) {
+	taskIDs, err := rh.storage.List(rh.ctx, siKey(""))
+	if err != nil {
+		return 0, err
+	}
+	tidied := 0
+	for _, taskID := range taskIDs {
+		si, err := rh.getSecretIDOrNil(taskID)
+		if err != nil {
+			return tidied, err
+		}
+		if si != nil && si.expired() {
+			if err := rh.delete(siKey(taskID)); err != nil {
+				return tidied, err
+			}
+			tidied++
+		}
+	}
+	return tidied, nil
+}
@@ -0,0 +1,165 @@
+package mesosauth
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// SecretIDTests is a testify test suite object that we can attach helper
+// methods to.
+type SecretIDTests struct{ TestSuite }
+
+// Test_SecretIDs is a standard Go test function that runs our test suite's
+// tests.
+func Test_SecretIDs(t *testing.T) { suite.Run(t, new(SecretIDTests)) }
+
+// setupSecretIDTask sets up a backend with a running task, with the given
+// extra task-policies settings.
+func (ts *SecretIDTests) setupSecretIDTask(settings jsonobj) {
+	ts.SetupLoginTask("task.abc-123", jsonobj{})
+	ts.SetTaskTokenPolicies("task", settings, "insurance")
+}
+
+// issue issues a secret ID for a task and returns it.
+func (ts *SecretIDTests) issue(prefix string, taskID string) string {
+	resp := ts.HandleRequestSuccess(ts.mkReq("issue/"+prefix, jsonobj{"task-id": taskID}))
+	return resp.Data["secret-id"].(string)
+}
+
+// loginWithSecretID makes a login request with a secret ID.
+func (ts *SecretIDTests) loginWithSecretID(taskID string, secret string) error {
+	_, err := ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": taskID, "secret-id": secret}))
+	return err
+}
+
+// Issuing a secret ID stores a hash of it with an expiry.
+func (ts *SecretIDTests) Test_issue() {
+	ts.SetupBackend()
+
+	resp := ts.HandleRequestSuccess(ts.mkReq("issue/task", jsonobj{"task-id": "task.abc-123", "ttl": "2m"}))
+	secret := resp.Data["secret-id"].(string)
+	ts.Len(secret, 2*secretIDSize)
+	ts.Equal(resp.Data["task-id"], "task.abc-123")
+
+	var si secretID
+	ts.Require().NoError(ts.GetStored("secret-ids/task.abc-123").DecodeJSON(&si))
+	ts.Equal(si.Hash, hashSecretID(secret))
+	ts.NotContains(si.Hash, secret)
+	ts.WithinDuration(time.Now().Add(2*time.Minute), si.Expires, 5*time.Second)
+	ts.Equal(resp.Data["expires"], si.Expires.UTC().Format(time.RFC3339Nano))
+}
+
+// Task IDs that don't match the path's prefix and unreasonable TTLs are
+// rejected.
+func (ts *SecretIDTests) Test_issue_invalid() {
+	ts.SetupBackend()
+
+	resp := ts.HandleRequest(ts.mkReq("issue/task", jsonobj{"task-id": "no-prefix"}))
+	ts.Equal(resp, logical.ErrorResponse(`malformed task-id: "no-prefix"`))
+
+	resp = ts.HandleRequest(ts.mkReq("issue/task", jsonobj{"task-id": "other.abc-123"}))
+	ts.Equal(resp, logical.ErrorResponse(`task-id "other.abc-123" does not have prefix "task"`))
+
+	resp = ts.HandleRequest(ts.mkReq("issue/task", jsonobj{"task-id": "task.abc-123", "ttl": "25h"}))
+	ts.Equal(resp, logical.ErrorResponse("ttl must be positive and no more than 24h0m0s"))
+	ts.Nil(ts.GetStored("secret-ids/task.abc-123"))
+}
+
+// A task whose prefix requires a secret ID can't log in without one.
+func (ts *SecretIDTests) Test_login_required() {
+	ts.setupSecretIDTask(jsonobj{"require-secret-id": true})
+
+	err := ts.loginWithSecretID("task.abc-123", "")
+	ts.EqualError(err, "permission denied: bad-secret-id: no secret ID has been issued for this task")
+}
+
+// A secret ID lets a task log in, and is used up by the login.
+func (ts *SecretIDTests) Test_login_secret_id() {
+	ts.setupSecretIDTask(jsonobj{"require-secret-id": true})
+	secret := ts.issue("task", "task.abc-123")
+
+	ts.NoError(ts.loginWithSecretID("task.abc-123", secret))
+	ts.Nil(ts.GetStored("secret-ids/task.abc-123"))
+}
+
+// A login that loses a race with another login for the same task doesn't
+// use up the secret ID, so the task can still use it once it's free to log in
+// again.
+func (ts *SecretIDTests) Test_login_race_keeps_secret_id() {
+	ts.setupSecretIDTask(jsonobj{"require-secret-id": true})
+	secret := ts.issue("task", "task.abc-123")
+
+	err := ts.LoginLosingRace(siKey("task.abc-123"), jsonobj{"task-id": "task.abc-123", "secret-id": secret})
+	ts.EqualError(err, "permission denied: already-logged-in: task has already logged in")
+	ts.NotNil(ts.GetStored("secret-ids/task.abc-123"))
+
+	ts.DeleteStored(tiKey("task"))
+	ts.NoError(ts.loginWithSecretID("task.abc-123", secret))
+}
+
+// Once a secret ID has been issued, it's needed even if the prefix doesn't
+// require one, and a wrong one doesn't use it up.
+func (ts *SecretIDTests) Test_login_wrong_secret_id() {
+	ts.setupSecretIDTask(jsonobj{})
+	secret := ts.issue("task", "task.abc-123")
+
+	err := ts.loginWithSecretID("task.abc-123", "")
+	ts.EqualError(err, "permission denied: bad-secret-id: missing or invalid secret ID")
+	err = ts.loginWithSecretID("task.abc-123", secret+"0")
+	ts.EqualError(err, "permission denied: bad-secret-id: missing or invalid secret ID")
+
+	ts.NoError(ts.loginWithSecretID("task.abc-123", secret))
+}
+
+// A secret ID is bound to the task ID it was issued for.
+func (ts *SecretIDTests) Test_login_other_task() {
+	ts.setupSecretIDTask(jsonobj{"require-secret-id": true})
+	ts.AddTask(mkTask("task", "task.abc-124", mesos.TASK_RUNNING))
+	secret := ts.issue("task", "task.abc-123")
+
+	err := ts.loginWithSecretID("task.abc-124", secret)
+	ts.EqualError(err, "permission denied: bad-secret-id: no secret ID has been issued for this task")
+}
+
+// An expired secret ID doesn't let a task log in.
+func (ts *SecretIDTests) Test_login_expired() {
+	ts.setupSecretIDTask(jsonobj{})
+	ts.PutStored("secret-ids/task.abc-123", secretID{
+		Hash:    hashSecretID("secret"),
+		Expires: time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC),
+	})
+
+	err := ts.loginWithSecretID("task.abc-123", "secret")
+	ts.EqualError(err, "permission denied: bad-secret-id: secret ID expired at 2018-07-01T12:00:00Z")
+}
+
+// A login check shows the secret ID step without using it up.
+func (ts *SecretIDTests) Test_login_check() {
+	ts.setupSecretIDTask(jsonobj{"require-secret-id": true})
+	secret := ts.issue("task", "task.abc-123")
+
+	req := ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "secret-id": secret})
+	data := ts.HandleRequest(req).Data
+	ts.Equal(data["allowed"], true)
+	ts.Contains(data["steps"], jsonobj{"step": "secret-id", "result": "ok", "detail": "secret ID is valid"})
+	ts.NotNil(ts.GetStored("secret-ids/task.abc-123"))
+}
+
+// Expired secret IDs are tidied up in the background.
+func (ts *SecretIDTests) Test_periodic_tidy() {
+	ts.SetupBackend()
+	ts.PutStored("secret-ids/old.abc-123", secretID{Expires: time.Now().Add(-time.Second)})
+	ts.PutStored("secret-ids/new.abc-123", secretID{Expires: time.Now().Add(time.Minute)})
+
+	req := &logical.Request{Storage: ts.storage}
+	ts.Require().NoError(ts.backend.periodic(context.Background(), req))
+	ts.Nil(ts.GetStored("secret-ids/old.abc-123"))
+	ts.NotNil(ts.GetStored("secret-ids/new.abc-123"))
+}
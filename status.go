@@ -0,0 +1,189 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+
+	"github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient"
+	"github.com/praekeltfoundation/vault-plugin-auth-mesos/version"
+)
+
+// pathStatus returns the "status" path struct. It is a function rather than a
+// method because we never call it once the backend struct is built and we
+// don't want name collisions with any request handler methods.
+func pathStatus(b *mesosBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "status",
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathStatusRead,
+		},
+	}
+}
+
+// mesosStatus keeps track of what we've seen of Mesos so that we can report it
+// in status requests. It is shared by all requests to a backend.
+type mesosStatus struct {
+	lock               sync.Mutex
+	lastGetTasks       time.Time
+	lastGetTasksTook   time.Duration
+	tasksSeen          int
+	backgroundErrors   map[string]string
+	backgroundErrorsAt map[string]time.Time
+}
+
+// newMesosStatus builds an empty mesosStatus.
+func newMesosStatus() *mesosStatus {
+	return &mesosStatus{
+		backgroundErrors:   map[string]string{},
+		backgroundErrorsAt: map[string]time.Time{},
+	}
+}
+
+// recordGetTasks records a successful GET_TASKS call.
+func (ms *mesosStatus) recordGetTasks(start time.Time, took time.Duration, rgt *master.Response_GetTasks) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	ms.lastGetTasks = start
+	ms.lastGetTasksTook = took
+	ms.tasksSeen = len(rgt.Tasks) + len(rgt.CompletedTasks) + len(rgt.UnreachableTasks)
+}
+
+// recordBackgroundError records the result of a background job run. A nil
+// error clears any error previously recorded for the job.
+func (ms *mesosStatus) recordBackgroundError(job string, err error) {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	if err == nil {
+		delete(ms.backgroundErrors, job)
+		delete(ms.backgroundErrorsAt, job)
+		return
+	}
+	ms.backgroundErrors[job] = err.Error()
+	ms.backgroundErrorsAt[job] = time.Now()
+}
+
+// data returns the recorded status in a form suitable for a read response.
+func (ms *mesosStatus) data() jsonobj {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	lastGetTasks := ""
+	if !ms.lastGetTasks.IsZero() {
+		lastGetTasks = ms.lastGetTasks.UTC().Format(time.RFC3339Nano)
+	}
+	backgroundErrors := jsonobj{}
+	for job, err := range ms.backgroundErrors {
+		backgroundErrors[job] = jsonobj{
+			"error": err,
+			"time":  ms.backgroundErrorsAt[job].UTC().Format(time.RFC3339Nano),
+		}
+	}
+	return jsonobj{
+		"last-get-tasks":         lastGetTasks,
+		"last-get-tasks-latency": ms.lastGetTasksTook.String(),
+		"tasks-seen":             ms.tasksSeen,
+		"background-errors":      backgroundErrors,
+	}
+}
+
+// getTasks makes a GET_TASKS call and records it for status requests.
+func (b *mesosBackend) getTasks(ctx context.Context, mc *mesosclient.Client) (*master.Response_GetTasks, error) {
+	start := time.Now()
+	rgt, err := mc.GetTasks(ctx)
+	if err == nil {
+		b.status.recordGetTasks(start, time.Since(start), rgt)
+	}
+	return rgt, err
+}
+
+// pathStatusRead is the "status" read request handler. It reports on our
+// connection to Mesos, but never fails just because Mesos is unreachable.
+func (b *mesosBackend) pathStatusRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
+
+	cfg, err := rh.getConfigOrNil()
+	if err != nil {
+		return nil, err
+	}
+
+	instances, err := rh.countTaskInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	b.setGauge(metricTaskInstTotal, float32(instances), nil)
+
+	data := b.status.data()
+	data["version"] = pluginVersion()
+	data["git-commit"] = version.GitCommit
+	data["task-instances"] = instances
+	data["configured-master"] = ""
+	data["leader"] = ""
+	data["mesos-error"] = ""
+
+	if cfg == nil {
+		data["mesos-error"] = "backend not configured"
+		return &logical.Response{Data: data}, nil
+	}
+	// We only know the master we're configured to talk to. The leader is
+	// whichever master that one says is leading, which may be another one.
+	data["configured-master"] = cfg.BaseURL
+
+	rgm, err := b.mesosClient(cfg).GetMaster(ctx)
+	if err != nil {
+		data["mesos-error"] = err.Error()
+	} else {
+		data["leader"] = masterAddress(rgm.MasterInfo)
+	}
+
+	return &logical.Response{Data: data}, nil
+}
+
+// countTaskInstances counts the task IDs we have recorded as logged in.
+func (rh *requestHelper) countTaskInstances() (int, error) {
+	prefixes, err := rh.storage.List(rh.ctx, tiKey(""))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, prefix := range prefixes {
+		instances, err := rh.getTaskInstances(prefix)
+		if err != nil {
+			return 0, err
+		}
+		count += len(instances)
+	}
+	return count, nil
+}
+
+// pluginVersion returns the plugin version, including any pre-release marker.
+func pluginVersion() string {
+	if version.VersionPrerelease != "" {
+		return version.Version + "-" + version.VersionPrerelease
+	}
+	return version.Version
+}
+
+// masterAddress builds a host:port address for a Mesos master, preferring the
+// newer address fields to the deprecated ones.
+func masterAddress(mi *mesos.MasterInfo) string {
+	if mi == nil {
+		return ""
+	}
+	if addr := mi.Address; addr != nil {
+		switch {
+		case addr.Hostname != nil:
+			return fmt.Sprintf("%s:%d", *addr.Hostname, addr.Port)
+		case addr.IP != nil:
+			return fmt.Sprintf("%s:%d", *addr.IP, addr.Port)
+		}
+	}
+	return fmt.Sprintf("%s:%d", mi.GetHostname(), mi.GetPort())
+}
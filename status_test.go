@@ -0,0 +1,112 @@
+package mesosauth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+
+	"github.com/praekeltfoundation/vault-plugin-auth-mesos/version"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// StatusTests is a testify test suite object that we can attach helper
+// methods to.
+type StatusTests struct{ TestSuite }
+
+// Test_Status is a standard Go test function that runs our test suite's tests.
+func Test_Status(t *testing.T) { suite.Run(t, new(StatusTests)) }
+
+// readStatus reads the status through the API.
+func (ts *StatusTests) readStatus() jsonobj {
+	return ts.HandleRequestSuccess(ts.mkReadReq("status")).Data
+}
+
+// An unconfigured backend still reports its status.
+func (ts *StatusTests) Test_unconfigured() {
+	ts.SetupBackend()
+
+	ts.Equal(ts.readStatus(), jsonobj{
+		"version":                version.Version,
+		"git-commit":             version.GitCommit,
+		"configured-master":      "",
+		"leader":                 "",
+		"mesos-error":            "backend not configured",
+		"last-get-tasks":         "",
+		"last-get-tasks-latency": "0s",
+		"tasks-seen":             0,
+		"task-instances":         0,
+		"background-errors":      jsonobj{},
+	})
+}
+
+// A configured backend reports the leader and what it has seen of Mesos.
+func (ts *StatusTests) Test_configured() {
+	ts.SetupBackendWithMesos()
+	ts.AddTask(
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("other", "other.abc-123", mesos.TASK_FINISHED))
+	ts.SetTaskPolicies("task", "insurance")
+	ts.Login("task.abc-123")
+
+	status := ts.readStatus()
+	ts.Equal(status["configured-master"], ts.fakeMesos.GetBaseURL())
+	ts.Equal("http://"+status["leader"].(string), ts.fakeMesos.GetBaseURL())
+	ts.Equal(status["mesos-error"], "")
+	ts.NotEqual(status["last-get-tasks"], "")
+	ts.Equal(status["tasks-seen"], 2)
+	ts.Equal(status["task-instances"], 1)
+}
+
+// If Mesos is unreachable, we say so instead of failing.
+func (ts *StatusTests) Test_mesos_unreachable() {
+	ts.SetupBackendWithMesos()
+	ts.ConfigureBackend(ts.fakeMesos.GetBaseURL() + "/bad")
+
+	status := ts.readStatus()
+	ts.Equal(status["leader"], "")
+	ts.True(strings.Contains(status["mesos-error"].(string), "404"))
+}
+
+// Background job errors are reported until the job succeeds.
+func (ts *StatusTests) Test_background_errors() {
+	ms := newMesosStatus()
+	ms.recordBackgroundError("sweep", errors.New("oops"))
+	errs := ms.data()["background-errors"].(jsonobj)
+	ts.Equal(errs["sweep"].(jsonobj)["error"], "oops")
+
+	ms.recordBackgroundError("sweep", nil)
+	ts.Equal(ms.data()["background-errors"], jsonobj{})
+}
+
+// Failures to ask the master about its agents are reported as background
+// errors, because they affect every login in agent verification mode.
+func (ts *StatusTests) Test_agent_refresh_error() {
+	ts.SetupBackendWithMesos()
+	ts.ConfigureBackend(ts.fakeMesos.GetBaseURL() + "/bad")
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"skip-verify": true, "verification-mode": "agent"}))
+	ts.SetTaskPolicies("task", "insurance")
+
+	_, err := ts.HandleRequestRaw(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}))
+	ts.Error(err)
+	errs := ts.readStatus()["background-errors"].(jsonobj)
+	ts.Contains(errs["agent-refresh"].(jsonobj)["error"], "404")
+}
+
+// Master addresses prefer the newer fields.
+func (ts *StatusTests) Test_masterAddress() {
+	port := uint32(5050)
+	ts.Equal(masterAddress(nil), "")
+	ts.Equal(masterAddress(&mesos.MasterInfo{Hostname: strptr("old"), Port: &port}), "old:5050")
+	ts.Equal(masterAddress(&mesos.MasterInfo{
+		Hostname: strptr("old"),
+		Port:     &port,
+		Address:  &mesos.Address{IP: strptr("10.0.0.1"), Port: 5051},
+	}), "10.0.0.1:5051")
+	ts.Equal(masterAddress(&mesos.MasterInfo{
+		Address: &mesos.Address{Hostname: strptr("new"), IP: strptr("10.0.0.1"), Port: 5051},
+	}), "new:5051")
+}
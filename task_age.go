@@ -0,0 +1,51 @@
+package mesosauth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+)
+
+// checkTaskAge checks that the task started running long enough ago, but not
+// too long ago, to log in. We measure from the earliest TASK_RUNNING status,
+// because health checks can add more.
+func (ld *loginDecision) checkTaskAge(tp *taskPolicies) error {
+	runningSince, ok := taskRunningSince(ld.task)
+	if !ok {
+		return ld.fail("task-age", denyTaskAge,
+			"task has no TASK_RUNNING status with a timestamp", logical.ErrPermissionDenied)
+	}
+	age := time.Since(runningSince).Truncate(time.Second)
+	if age < tp.MinTaskAge {
+		return ld.fail("task-age", denyTaskAge,
+			fmt.Sprintf("task has been running for %s, less than min-task-age %s", age, tp.MinTaskAge),
+			logical.ErrPermissionDenied)
+	}
+	if tp.MaxTaskAge > 0 && age > tp.MaxTaskAge {
+		return ld.fail("task-age", denyTaskAge,
+			fmt.Sprintf("task has been running for %s, more than max-task-age %s", age, tp.MaxTaskAge),
+			logical.ErrPermissionDenied)
+	}
+	ld.pass("task-age", fmt.Sprintf("task has been running for %s", age))
+	return nil
+}
+
+// taskRunningSince returns the time of a task's earliest TASK_RUNNING status,
+// if it has one with a timestamp.
+func taskRunningSince(task *mesos.Task) (time.Time, bool) {
+	var since time.Time
+	for _, status := range task.Statuses {
+		if status.State == nil || *status.State != mesos.TASK_RUNNING || status.Timestamp == nil {
+			continue
+		}
+		// Mesos timestamps are seconds since the epoch.
+		seconds := *status.Timestamp
+		ts := time.Unix(0, int64(seconds*float64(time.Second)))
+		if since.IsZero() || ts.Before(since) {
+			since = ts
+		}
+	}
+	return since, !since.IsZero()
+}
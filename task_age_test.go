@@ -0,0 +1,125 @@
+package mesosauth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// TaskAgeTests is a testify test suite object that we can attach helper
+// methods to.
+type TaskAgeTests struct{ TestSuite }
+
+// Test_TaskAge is a standard Go test function that runs our test suite's
+// tests.
+func Test_TaskAge(t *testing.T) { suite.Run(t, new(TaskAgeTests)) }
+
+// setupAgedTask sets up a backend with a task that started running the given
+// time ago and the given task age settings.
+func (ts *TaskAgeTests) setupAgedTask(runningFor time.Duration, settings jsonobj) {
+	ts.SetupLoginTasks(jsonobj{}, mkTask("task", "task.abc-123", mesos.TASK_STARTING))
+	ts.UpdateTask(mctesting.UpdateStateAt(mesos.TASK_RUNNING, time.Now().Add(-runningFor)), "task.abc-123")
+	ts.SetTaskTokenPolicies("task", settings, "insurance")
+}
+
+// Task ages can be read back, and must be non-negative and in order.
+func (ts *TaskAgeTests) Test_config() {
+	ts.SetupBackendWithMesos()
+
+	ts.SetTaskTokenPolicies("task", jsonobj{"min-task-age": "30s", "max-task-age": "1h"}, "insurance")
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": "task"}
+	data := ts.HandleRequest(req).Data
+	ts.Equal(data["min-task-age"], "30s")
+	ts.Equal(data["max-task-age"], "1h0m0s")
+
+	for _, bad := range []struct {
+		settings jsonobj
+		errmsg   string
+	}{
+		{jsonobj{"min-task-age": -1}, "task ages must not be negative"},
+		{jsonobj{"max-task-age": -1}, "task ages must not be negative"},
+		{jsonobj{"min-task-age": "2h", "max-task-age": "1h"}, "min-task-age must not exceed max-task-age"},
+	} {
+		bad.settings["task-id-prefix"] = "task"
+		bad.settings["policies"] = "insurance"
+		resp := ts.HandleRequest(ts.mkReq("task-policies", bad.settings))
+		ts.Equalf(resp, logical.ErrorResponse(bad.errmsg), "%#v", bad)
+	}
+
+	// A min-task-age without a max-task-age has no upper limit.
+	ts.SetTaskTokenPolicies("task", jsonobj{"min-task-age": "2h"}, "insurance")
+	data = ts.HandleRequest(req).Data
+	ts.Equal(data["min-task-age"], "2h0m0s")
+	ts.Equal(data["max-task-age"], "0s")
+}
+
+// A task with only a min-task-age can log in however long it has been
+// running.
+func (ts *TaskAgeTests) Test_no_max_age() {
+	ts.setupAgedTask(30*24*time.Hour, jsonobj{"min-task-age": "2h"})
+	ts.Login("task.abc-123")
+}
+
+// A task that has been running for long enough, but not too long, can log in.
+func (ts *TaskAgeTests) Test_within_window() {
+	ts.setupAgedTask(10*time.Minute, jsonobj{"min-task-age": "1m", "max-task-age": "1h"})
+	ts.Login("task.abc-123")
+}
+
+// A task that started running too recently can't log in.
+func (ts *TaskAgeTests) Test_too_young() {
+	ts.setupAgedTask(10*time.Second, jsonobj{"min-task-age": "1m"})
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-age: task has been running for 10s, less than min-task-age 1m0s")
+}
+
+// A task that started running too long ago can't log in.
+func (ts *TaskAgeTests) Test_too_old() {
+	ts.setupAgedTask(2*time.Hour, jsonobj{"max-task-age": "1h"})
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-age: task has been running for 2h0m0s, more than max-task-age 1h0m0s")
+}
+
+// Later TASK_RUNNING statuses (from health checks, for example) don't reset
+// the task's age.
+func (ts *TaskAgeTests) Test_earliest_running_status() {
+	ts.setupAgedTask(2*time.Hour, jsonobj{"max-task-age": "1h"})
+	ts.UpdateTask(mctesting.UpdateStateAt(mesos.TASK_RUNNING, time.Now()), "task.abc-123")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-123"}),
+		"permission denied: task-age: task has been running for 2h0m0s, more than max-task-age 1h0m0s")
+}
+
+// A task without a timestamped TASK_RUNNING status can't log in if there are
+// task age limits, but can if there aren't.
+func (ts *TaskAgeTests) Test_no_timestamp() {
+	ts.SetupLoginTasks(jsonobj{},
+		mkTask("task", "task.abc-123", mesos.TASK_RUNNING),
+		mkTask("task", "task.abc-124", mesos.TASK_RUNNING))
+
+	ts.Login("task.abc-123")
+
+	ts.SetTaskTokenPolicies("task", jsonobj{"max-task-age": "1h"}, "insurance")
+	ts.HandleRequestError(ts.mkReq("login", jsonobj{"task-id": "task.abc-124"}),
+		"permission denied: task-age: task has no TASK_RUNNING status with a timestamp")
+}
+
+// A login check reports the task's age.
+func (ts *TaskAgeTests) Test_login_check() {
+	ts.setupAgedTask(10*time.Minute, jsonobj{"min-task-age": "1m"})
+
+	data := ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data
+	ts.Equal(data["allowed"], true)
+	ts.Contains(data["steps"], jsonobj{"step": "task-age", "result": "ok", "detail": "task has been running for 10m0s"})
+
+	ts.SetTaskTokenPolicies("task", jsonobj{"max-task-age": "5m"}, "insurance")
+	data = ts.HandleRequest(ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123"})).Data
+	ts.Equal(data["denial-reason"], "task-age")
+}
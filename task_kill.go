@@ -0,0 +1,70 @@
+package mesosauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// responseTimeout limits how long we wait for other services (schedulers and
+// Vault itself) when responding to a duplicate login.
+const responseTimeout = 10 * time.Second
+
+// killTask asks the scheduler of a running task to kill it. The Mesos operator
+// API has no call to kill a task, so only its scheduler can. We know how to ask
+// Marathon, which tells Mesos where to find it in its web UI URL.
+func (b *mesosBackend) killTask(ctx context.Context, cfg *config, taskID string) error {
+	// A duplicate login is denied before we look the task up, so we have to
+	// look it up here.
+	mc := b.mesosClient(cfg)
+	rgt, err := b.getTasks(ctx, mc)
+	if err != nil {
+		return err
+	}
+	task := b.findRunningTask(taskID, rgt)
+	if task == nil {
+		return fmt.Errorf("task is not running")
+	}
+	fw, err := b.getFramework(ctx, mc, task.FrameworkID.Value)
+	if err != nil {
+		return err
+	}
+	if fw == nil || !strings.HasPrefix(fw.Name, "marathon") || fw.GetWebUiURL() == "" {
+		return fmt.Errorf("don't know how to ask framework %s to kill tasks", task.FrameworkID.Value)
+	}
+
+	url := strings.TrimSuffix(fw.GetWebUiURL(), "/") + "/v2/tasks/delete"
+	return postJSON(ctx, url, nil, jsonobj{"ids": []string{taskID}})
+}
+
+// postJSON makes a POST request with a JSON body and the given headers, and
+// fails if the response isn't a success.
+func postJSON(ctx context.Context, url string, headers map[string]string, body jsonobj) error {
+	bs, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: responseTimeout}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // #nosec G307
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
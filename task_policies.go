@@ -2,6 +2,10 @@ package mesosauth
 
 import (
 	"context"
+	"fmt"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/hashicorp/vault/logical/framework"
@@ -11,12 +15,41 @@ import (
 // rather than a method because we never call it once the backend struct is
 // built and we don't want name collisions with any request handler methods.
 func pathTaskPolicies(b *mesosBackend) *framework.Path {
+	fields := map[string]*framework.FieldSchema{
+		"task-id-prefix": {Type: framework.TypeString},
+		"policies":       {Type: framework.TypeCommaStringSlice},
+		"images": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "Container images tasks are allowed to run. Each may be an exact name, a glob or a digest.",
+		},
+		"require-preauth": {
+			Type:        framework.TypeBool,
+			Description: "Only allow tasks to log in if their task ID has been pre-authorized.",
+		},
+		"login-cidrs": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "CIDRs that tasks must log in from, as well as any in the config.",
+		},
+		"min-task-age": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long a task must have been running before it may log in.",
+		},
+		"max-task-age": {
+			Type:        framework.TypeDurationSecond,
+			Description: "How long after a task starts running it may still log in. Zero means no limit.",
+		},
+		"require-secret-id": {
+			Type:        framework.TypeBool,
+			Description: "Only allow tasks to log in with a secret ID issued for their task ID.",
+		},
+	}
+	for name, schema := range tokenSettingsFields() {
+		fields[name] = schema
+	}
+
 	return &framework.Path{
 		Pattern: "task-policies",
-		Fields: map[string]*framework.FieldSchema{
-			"task-id-prefix": {Type: framework.TypeString},
-			"policies":       {Type: framework.TypeCommaStringSlice},
-		},
+		Fields:  fields,
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.UpdateOperation: b.pathTaskPoliciesUpdate,
 			logical.ReadOperation:   b.pathTaskPoliciesRead,
@@ -27,6 +60,22 @@ func pathTaskPolicies(b *mesosBackend) *framework.Path {
 // taskPolicies is used to store policies for a task.
 type taskPolicies struct {
 	Policies []string
+	// Images optionally restricts the container images a task may run.
+	Images []string
+	// RequirePreauth makes logins fail unless the task ID has a
+	// pre-authorization, which the login uses up.
+	RequirePreauth bool
+	// RequireSecretID makes logins fail unless the task presents a secret ID
+	// issued for its task ID, which the login uses up.
+	RequireSecretID bool
+	// LoginCIDRs, if not empty, restricts the remote addresses that tasks
+	// may log in from.
+	LoginCIDRs []string
+	// MinTaskAge and MaxTaskAge, if set, limit logins to a window measured
+	// from when the task started running.
+	MinTaskAge time.Duration
+	MaxTaskAge time.Duration
+	tokenSettings
 }
 
 // mkTaskPolicies gives us a less verbose way to build a taskPolicies value.
@@ -41,7 +90,7 @@ func tpKey(taskPrefix string) string {
 
 // pathTaskPoliciesUpdate is the "task-policies" update request handler.
 func (b *mesosBackend) pathTaskPoliciesUpdate(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	taskIDPrefix := d.Get("task-id-prefix").(string)
 	if len(taskIDPrefix) == 0 {
@@ -53,15 +102,51 @@ func (b *mesosBackend) pathTaskPoliciesUpdate(ctx context.Context, req *logical.
 		return logical.ErrorResponse("missing or invalid policies"), nil
 	}
 
-	b.Logger().Info("TASK POLICIES", "task-id-prefix", taskIDPrefix, "policies", policies)
+	tp := mkTaskPolicies(policies)
+
+	if images, ok := d.GetOk("images"); ok {
+		tp.Images = images.([]string)
+		for _, image := range tp.Images {
+			if err := validateImagePattern(image); err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+	}
+
+	if loginCIDRs, ok := d.GetOk("login-cidrs"); ok {
+		var err error
+		if tp.LoginCIDRs, err = normaliseCIDRs(loginCIDRs.([]string)); err != nil {
+			return logical.ErrorResponse("login-cidrs: " + err.Error()), nil
+		}
+	}
 
-	err := rh.store(tpKey(taskIDPrefix), mkTaskPolicies(policies))
+	tp.MinTaskAge = time.Duration(d.Get("min-task-age").(int)) * time.Second
+	tp.MaxTaskAge = time.Duration(d.Get("max-task-age").(int)) * time.Second
+	if tp.MinTaskAge < 0 || tp.MaxTaskAge < 0 {
+		return logical.ErrorResponse("task ages must not be negative"), nil
+	}
+	if tp.MaxTaskAge > 0 && tp.MinTaskAge > tp.MaxTaskAge {
+		return logical.ErrorResponse("min-task-age must not exceed max-task-age"), nil
+	}
+
+	tp.RequirePreauth = d.Get("require-preauth").(bool)
+	tp.RequireSecretID = d.Get("require-secret-id").(bool)
+
+	tokenSettings, err := parseTokenSettings(d)
+	if err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+	tp.tokenSettings = tokenSettings
+
+	b.Logger().Info("TASK POLICIES", "task-id-prefix", taskIDPrefix, "policies", policies, "images", tp.Images)
+
+	err = rh.store(tpKey(taskIDPrefix), tp)
 	return &logical.Response{}, err
 }
 
 // pathTaskPoliciesRead is the "task-policies" read request handler.
 func (b *mesosBackend) pathTaskPoliciesRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
-	rh := requestHelper{ctx: ctx, storage: req.Storage}
+	rh := requestHelper{ctx: ctx, storage: req.Storage, cache: b.cache}
 
 	taskIDPrefix := d.Get("task-id-prefix").(string)
 	if len(taskIDPrefix) == 0 {
@@ -79,10 +164,49 @@ func (b *mesosBackend) pathTaskPoliciesRead(ctx context.Context, req *logical.Re
 	err := rh.fetch(tpKey(taskIDPrefix), decode)
 	// A fetch failure will leave us with a valid but empty taskPolicies value,
 	// and any response we return alongside an error will be ignored.
-	resp := &logical.Response{
-		Data: jsonobj{
-			"policies": tp.Policies,
-		},
+	data := tp.tokenSettings.data()
+	data["policies"] = tp.Policies
+	data["images"] = tp.Images
+	data["require-preauth"] = tp.RequirePreauth
+	data["require-secret-id"] = tp.RequireSecretID
+	data["login-cidrs"] = tp.LoginCIDRs
+	data["min-task-age"] = tp.MinTaskAge.String()
+	data["max-task-age"] = tp.MaxTaskAge.String()
+	return &logical.Response{Data: data}, err
+}
+
+// validateImagePattern checks that an image pattern is well-formed. Digests
+// and exact names are always valid, so we only need to check globs.
+func validateImagePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid image pattern: \"%s\"", pattern)
+	}
+	return nil
+}
+
+// imageAllowed checks an image against a list of allowed image patterns. Each
+// pattern may be a digest (like "sha256:abc...") that must match the digest
+// the image is pinned to, or a name that may contain glob characters. An
+// empty list of patterns allows any image, including none at all.
+func imageAllowed(image string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if image == "" {
+		return false
+	}
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "sha256:") {
+			if strings.HasSuffix(image, "@"+pattern) {
+				return true
+			}
+			continue
+		}
+		// We've already validated the pattern on write, so we can ignore
+		// the error here.
+		if ok, _ := path.Match(pattern, image); ok { // #nosec G104
+			return true
+		}
 	}
-	return resp, err
+	return false
 }
@@ -2,6 +2,7 @@ package mesosauth
 
 import (
 	"testing"
+	"time"
 
 	"github.com/hashicorp/vault/logical"
 	"github.com/stretchr/testify/suite"
@@ -92,7 +93,7 @@ func (ts *TaskPoliciesTests) Test_read_missing_task() {
 	req := ts.mkReadReq("task-policies")
 	req.Data = jsonobj{"task-id-prefix": "missing-task"}
 	ts.Equal(ts.HandleRequest(req), &logical.Response{
-		Data: jsonobj{"policies": ([]string)(nil)},
+		Data: tpReadData(nil, nil, tokenSettings{}),
 	})
 }
 
@@ -104,6 +105,146 @@ func (ts *TaskPoliciesTests) Test_read_task_policies() {
 	req := ts.mkReadReq("task-policies")
 	req.Data = jsonobj{"task-id-prefix": "my-task"}
 	ts.Equal(ts.HandleRequest(req), &logical.Response{
-		Data: jsonobj{"policies": []string{"insurance"}},
+		Data: tpReadData([]string{"insurance"}, nil, tokenSettings{}),
 	})
 }
+
+// A task-policies update can restrict the allowed container images.
+func (ts *TaskPoliciesTests) Test_update_images() {
+	ts.SetupBackend()
+
+	params := tpParams("my-task", "insurance")
+	params["images"] = "nginx:1.15,registry.example.com/team/*"
+	ts.Equal(ts.HandleRequest(ts.mkReq("task-policies", params)), &logical.Response{})
+
+	ts.StoredEqual(tpKey("my-task"), taskPolicies{
+		Policies: []string{"insurance"},
+		Images:   []string{"nginx:1.15", "registry.example.com/team/*"},
+	})
+
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": "my-task"}
+	ts.Equal(ts.HandleRequest(req), &logical.Response{
+		Data: tpReadData(
+			[]string{"insurance"},
+			[]string{"nginx:1.15", "registry.example.com/team/*"},
+			tokenSettings{}),
+	})
+}
+
+// A task-policies update with a malformed image glob fails.
+func (ts *TaskPoliciesTests) Test_update_invalid_image() {
+	ts.SetupBackend()
+
+	params := tpParams("my-task", "insurance")
+	params["images"] = "nginx:[1.15"
+	resp := ts.HandleRequest(ts.mkReq("task-policies", params))
+	ts.EqualError(resp.Error(), `invalid image pattern: "nginx:[1.15"`)
+	ts.Nil(ts.GetStored(tpKey("my-task")))
+}
+
+// A task-policies update can set token parameters, which we can read back.
+func (ts *TaskPoliciesTests) Test_update_token_settings() {
+	ts.SetupBackend()
+
+	params := tpParams("my-task", "insurance")
+	params["ttl"] = "10m"
+	params["max-ttl"] = "1h"
+	params["explicit-max-ttl"] = "2h"
+	params["period"] = "5m"
+	params["num-uses"] = 3
+	params["bound-cidrs"] = "10.0.0.0/8,192.168.1.1"
+	params["token-type"] = "service"
+	ts.Equal(ts.HandleRequest(ts.mkReq("task-policies", params)), &logical.Response{})
+
+	settings := tokenSettings{
+		TTL:            10 * time.Minute,
+		MaxTTL:         time.Hour,
+		ExplicitMaxTTL: 2 * time.Hour,
+		Period:         5 * time.Minute,
+		NumUses:        3,
+		BoundCIDRs:     []string{"10.0.0.0/8", "192.168.1.1"},
+		TokenType:      "service",
+	}
+	ts.StoredEqual(tpKey("my-task"), taskPolicies{
+		Policies:      []string{"insurance"},
+		tokenSettings: settings,
+	})
+
+	req := ts.mkReadReq("task-policies")
+	req.Data = jsonobj{"task-id-prefix": "my-task"}
+	ts.Equal(ts.HandleRequest(req), &logical.Response{
+		Data: tpReadData([]string{"insurance"}, nil, settings),
+	})
+}
+
+var invalidTokenSettingsData = []struct {
+	params jsonobj
+	err    string
+}{
+	{jsonobj{"ttl": "-1s"}, "durations must not be negative"},
+	{jsonobj{"period": "-1s"}, "durations must not be negative"},
+	{jsonobj{"ttl": "2h", "max-ttl": "1h"}, "ttl must not exceed max-ttl"},
+	{jsonobj{"num-uses": -1}, "num-uses must not be negative"},
+	{jsonobj{"token-type": "default"}, "invalid token-type: default"},
+	{jsonobj{"token-type": "batch"}, "batch tokens require a ttl"},
+	{jsonobj{"token-type": "batch", "ttl": "10m", "period": "5m"}, "batch tokens can't have a period"},
+}
+
+// A task-policies update with invalid token settings fails.
+func (ts *TaskPoliciesTests) Test_update_invalid_token_settings() {
+	ts.SetupBackend()
+	for _, itsd := range invalidTokenSettingsData {
+		params := tpParams("my-task", "insurance")
+		for k, v := range itsd.params {
+			params[k] = v
+		}
+		resp := ts.HandleRequest(ts.mkReq("task-policies", params))
+		ts.EqualError(resp.Error(), itsd.err)
+	}
+
+	params := tpParams("my-task", "insurance")
+	params["bound-cidrs"] = "not-an-address"
+	resp := ts.HandleRequest(ts.mkReq("task-policies", params))
+	ts.Contains(resp.Error().Error(), "invalid bound-cidrs")
+
+	ts.Nil(ts.GetStored(tpKey("my-task")))
+}
+
+var imageAllowedData = []struct {
+	image    string
+	patterns []string
+	allowed  bool
+}{
+	{"", nil, true},
+	{"nginx:1.15", nil, true},
+	{"", []string{"nginx:1.15"}, false},
+	{"nginx:1.15", []string{"nginx:1.15"}, true},
+	{"nginx:1.14", []string{"nginx:1.15"}, false},
+	{"nginx:1.14", []string{"redis", "nginx:*"}, true},
+	{"registry.example.com/team/app:v2", []string{"registry.example.com/team/*"}, true},
+	{"registry.example.com/other/app:v2", []string{"registry.example.com/team/*"}, false},
+	{"nginx@sha256:0123abcd", []string{"sha256:0123abcd"}, true},
+	{"nginx:1.15", []string{"sha256:0123abcd"}, false},
+	{"nginx@sha256:0123abcdef", []string{"sha256:0123abcd"}, false},
+}
+
+// Images are matched against exact names, globs and digests.
+func (ts *TaskPoliciesTests) Test_imageAllowed() {
+	for _, iad := range imageAllowedData {
+		ts.Equalf(imageAllowed(iad.image, iad.patterns), iad.allowed, "%#v", iad)
+	}
+}
+
+// tpReadData builds the data we expect in a task-policies read response.
+func tpReadData(policies []string, images []string, settings tokenSettings) jsonobj {
+	data := settings.data()
+	data["policies"] = policies
+	data["images"] = images
+	data["require-preauth"] = false
+	data["require-secret-id"] = false
+	data["login-cidrs"] = ([]string)(nil)
+	data["min-task-age"] = "0s"
+	data["max-task-age"] = "0s"
+	return data
+}
@@ -0,0 +1,298 @@
+package mesosauth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+
+	"github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient"
+)
+
+// Verification modes determine whom we ask about a task. The master knows
+// about every task in the cluster, but an agent only knows about its own, so
+// asking the agent a request came from is much cheaper for agent-local
+// sidecars. It also means tasks can only log in from their own agent.
+const (
+	verifyMaster = "master"
+	verifyAgent  = "agent"
+)
+
+var verificationModes = []string{verifyMaster, verifyAgent}
+
+// agentCacheTTL is how long we remember the master's list of agents for.
+const agentCacheTTL = time.Minute
+
+// agentRefreshInterval is how often we ask the master for its agents again
+// when a request comes from an address that isn't one of them.
+const agentRefreshInterval = 5 * time.Second
+
+// defaultAgentPort is the port agents listen on unless they tell us otherwise.
+const defaultAgentPort = 5051
+
+// taskSource is where we look up a task, and the framework and agent it
+// belongs to, when verifying a login or renewal.
+type taskSource interface {
+	getTasks(ctx context.Context) (*master.Response_GetTasks, error)
+	getFramework(ctx context.Context, frameworkID string) (*mesos.FrameworkInfo, error)
+	getAgent(ctx context.Context, agentID string) (*mesos.AgentInfo, error)
+}
+
+// taskSource returns the task source for the configured verification mode.
+// In agent mode, it returns nil if there's neither an agent nor a task
+// container at the remote address.
+func (b *mesosBackend) taskSource(ctx context.Context, cfg *config, mc *mesosclient.Client, remoteAddr string) (taskSource, error) {
+	if cfg.VerificationMode != verifyAgent {
+		return &masterSource{b: b, mc: mc}, nil
+	}
+	ip := parseRemoteIP(remoteAddr)
+	agents, err := b.agents.get(ctx, cfg.BaseURL, mc, false)
+	if err != nil {
+		return nil, err
+	}
+	local := agentsAt(ip, agents)
+	if len(local) == 0 && ip != nil {
+		// The agent may have registered since we last asked the master.
+		if agents, err = b.agents.get(ctx, cfg.BaseURL, mc, true); err != nil {
+			return nil, err
+		}
+		local = agentsAt(ip, agents)
+	}
+	if len(local) == 0 {
+		return b.containerSource(ctx, mc, ip)
+	}
+	return &agentSource{b: b, masterURL: cfg.BaseURL, mc: mc, agents: local}, nil
+}
+
+// containerSource returns a task source for requests from tasks that have
+// their own IP addresses (on an overlay or CNI network, for example), and so
+// don't come from their agent's address. Only the master can tell us which
+// tasks those are, so we ask it, but we only accept tasks whose containers
+// have the remote address. It returns nil if there aren't any.
+func (b *mesosBackend) containerSource(ctx context.Context, mc *mesosclient.Client, ip net.IP) (taskSource, error) {
+	if ip == nil {
+		return nil, nil
+	}
+	rgt, err := b.getTasks(ctx, mc)
+	if err != nil {
+		return nil, err
+	}
+	cs := &containerSource{masterSource: masterSource{b: b, mc: mc}, tasks: &master.Response_GetTasks{}}
+	for _, task := range rgt.Tasks {
+		if taskHasAddress(&task, ip) {
+			cs.tasks.Tasks = append(cs.tasks.Tasks, task)
+		}
+	}
+	if len(cs.tasks.Tasks) == 0 {
+		return nil, nil
+	}
+	return cs, nil
+}
+
+// taskHasAddress checks whether any of a task's containers has an IP address.
+func taskHasAddress(task *mesos.Task, ip net.IP) bool {
+	for _, addr := range taskAddresses(task) {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// masterSource asks the master about every task in the cluster.
+type masterSource struct {
+	b  *mesosBackend
+	mc *mesosclient.Client
+}
+
+func (ms *masterSource) getTasks(ctx context.Context) (*master.Response_GetTasks, error) {
+	return ms.b.getTasks(ctx, ms.mc)
+}
+
+func (ms *masterSource) getFramework(ctx context.Context, frameworkID string) (*mesos.FrameworkInfo, error) {
+	return ms.b.getFramework(ctx, ms.mc, frameworkID)
+}
+
+func (ms *masterSource) getAgent(ctx context.Context, agentID string) (*mesos.AgentInfo, error) {
+	return ms.b.getAgent(ctx, ms.mc, agentID)
+}
+
+// containerSource presents the tasks the master told us have a request's
+// remote address. We ask the master about their frameworks and agents.
+type containerSource struct {
+	masterSource
+	tasks *master.Response_GetTasks
+}
+
+func (cs *containerSource) getTasks(ctx context.Context) (*master.Response_GetTasks, error) {
+	return cs.tasks, nil
+}
+
+// agentSource asks the agents at a request's remote address about their own
+// tasks. There's normally only one of them, but nothing stops agents sharing
+// an address.
+type agentSource struct {
+	b         *mesosBackend
+	masterURL string
+	mc        *mesosclient.Client
+	agents    []master.Response_GetAgents_Agent
+	// frameworks are the ones the agents told us about along with their
+	// tasks, so we don't have to ask the master.
+	frameworks []mesos.FrameworkInfo
+}
+
+// getTasks asks each agent for its state and presents its tasks as if they
+// came from the master.
+func (as *agentSource) getTasks(ctx context.Context) (*master.Response_GetTasks, error) {
+	start := time.Now()
+	rgt := &master.Response_GetTasks{}
+	as.frameworks = nil
+	for i := range as.agents {
+		rgs, err := as.mc.AgentClient(agentBaseURL(as.masterURL, &as.agents[i])).GetState(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if tasks := rgs.GetTasks; tasks != nil {
+			rgt.PendingTasks = append(append(rgt.PendingTasks, tasks.PendingTasks...), tasks.QueuedTasks...)
+			rgt.Tasks = append(rgt.Tasks, tasks.LaunchedTasks...)
+			rgt.CompletedTasks = append(append(rgt.CompletedTasks, tasks.TerminatedTasks...), tasks.CompletedTasks...)
+		}
+		if rgs.GetFrameworks != nil {
+			for _, fw := range rgs.GetFrameworks.Frameworks {
+				as.frameworks = append(as.frameworks, fw.FrameworkInfo)
+			}
+		}
+	}
+	as.b.status.recordGetTasks(start, time.Since(start), rgt)
+	return rgt, nil
+}
+
+func (as *agentSource) getFramework(ctx context.Context, frameworkID string) (*mesos.FrameworkInfo, error) {
+	for i, fw := range as.frameworks {
+		if fw.ID != nil && fw.ID.Value == frameworkID {
+			return &as.frameworks[i], nil
+		}
+	}
+	return nil, nil
+}
+
+func (as *agentSource) getAgent(ctx context.Context, agentID string) (*mesos.AgentInfo, error) {
+	for i, agent := range as.agents {
+		if agent.AgentInfo.ID != nil && agent.AgentInfo.ID.Value == agentID {
+			return &as.agents[i].AgentInfo, nil
+		}
+	}
+	return nil, nil
+}
+
+// agentCache remembers the agents the master told us about, so that agent
+// verification doesn't have to ask the master on every request.
+type agentCache struct {
+	lock    sync.Mutex
+	baseURL string
+	fetched time.Time
+	agents  []master.Response_GetAgents_Agent
+	// status is where we report failures to ask the master, if anywhere.
+	status *mesosStatus
+}
+
+// get returns the agents known to the master at the given base URL, asking it
+// if we haven't done so recently. We hold the lock while we ask so that a
+// burst of logins only asks once.
+//
+// A refresh asks the master even if we have recently, unless we asked very
+// recently, so that requests from addresses that aren't agents can't make us
+// ask the master every time.
+func (ac *agentCache) get(ctx context.Context, baseURL string, mc *mesosclient.Client, refresh bool) ([]master.Response_GetAgents_Agent, error) {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+	ttl := agentCacheTTL
+	if refresh {
+		ttl = agentRefreshInterval
+	}
+	if ac.baseURL == baseURL && time.Since(ac.fetched) < ttl {
+		return ac.agents, nil
+	}
+	rga, err := mc.GetAgents(ctx)
+	if ac.status != nil {
+		ac.status.recordBackgroundError("agent-refresh", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ac.baseURL = baseURL
+	ac.fetched = time.Now()
+	ac.agents = rga.Agents
+	return ac.agents, nil
+}
+
+// agentsAt returns the agents with the given IP address.
+func agentsAt(ip net.IP, agents []master.Response_GetAgents_Agent) []master.Response_GetAgents_Agent {
+	local := []master.Response_GetAgents_Agent{}
+	if ip == nil {
+		return local
+	}
+	for i := range agents {
+		for _, agentIP := range agentIPs(&agents[i]) {
+			if agentIP.Equal(ip) {
+				local = append(local, agents[i])
+				break
+			}
+		}
+	}
+	return local
+}
+
+// agentIPs returns the IP addresses an agent is known by: its hostname (if
+// the hostname is an IP) and the address in its PID.
+func agentIPs(agent *master.Response_GetAgents_Agent) []net.IP {
+	ips := []net.IP{}
+	if ip := net.ParseIP(agent.AgentInfo.Hostname); ip != nil {
+		ips = append(ips, ip)
+	}
+	if host, _, ok := pidHostPort(agent); ok {
+		if ip := net.ParseIP(host); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// pidHostPort extracts the host and port from an agent's PID, which looks
+// like "slave(1)@10.0.0.1:5051".
+func pidHostPort(agent *master.Response_GetAgents_Agent) (string, string, bool) {
+	if agent.PID == nil {
+		return "", "", false
+	}
+	at := strings.LastIndexByte(*agent.PID, '@')
+	if at < 0 {
+		return "", "", false
+	}
+	host, port, err := net.SplitHostPort((*agent.PID)[at+1:])
+	return host, port, err == nil
+}
+
+// agentBaseURL returns the base URL of an agent's API. We prefer the address
+// in the agent's PID to its hostname, because the hostname may not resolve
+// from here. Agents use the same scheme as the master.
+func agentBaseURL(masterURL string, agent *master.Response_GetAgents_Agent) string {
+	scheme := "http"
+	if strings.HasPrefix(masterURL, "https:") {
+		scheme = "https"
+	}
+	host, port, ok := pidHostPort(agent)
+	if !ok {
+		host = agent.AgentInfo.Hostname
+		port = strconv.Itoa(defaultAgentPort)
+		if agent.AgentInfo.Port != nil {
+			port = strconv.Itoa(int(*agent.AgentInfo.Port))
+		}
+	}
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, port))
+}
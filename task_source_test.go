@@ -0,0 +1,266 @@
+package mesosauth
+
+import (
+	"testing"
+
+	"github.com/hashicorp/vault/logical"
+	mesos "github.com/mesos/mesos-go/api/v1/lib"
+	"github.com/mesos/mesos-go/api/v1/lib/master"
+	"github.com/stretchr/testify/suite"
+
+	mctesting "github.com/praekeltfoundation/vault-plugin-auth-mesos/mesosclient/testing"
+)
+
+// See helper_for_test.go for common infrastructure and tools.
+
+// TaskSourceTests is a testify test suite object that we can attach helper
+// methods to.
+type TaskSourceTests struct{ TestSuite }
+
+// Test_TaskSource is a standard Go test function that runs our test suite's
+// tests.
+func Test_TaskSource(t *testing.T) { suite.Run(t, new(TaskSourceTests)) }
+
+// mkAgentTask builds a simple task value on the given agent, belonging to the
+// "fw-1" framework.
+func mkAgentTask(name, id string, state mesos.TaskState, agentID string) mesos.Task {
+	task := mkTask(name, id, state)
+	task.AgentID = mesos.AgentID{Value: agentID}
+	task.FrameworkID = mesos.FrameworkID{Value: "fw-1"}
+	return task
+}
+
+// setupAgentMode sets up a backend in agent verification mode (plus the given
+// config settings) with a fake agent (listening on 127.0.0.1) and a remote
+// agent that we can't talk to.
+func (ts *TaskSourceTests) setupAgentMode(cfg jsonobj) {
+	cfg["verification-mode"] = "agent"
+	ts.SetupLoginTasks(cfg,
+		mkAgentTask("task", "task.abc-123", mesos.TASK_RUNNING, "agent-1"),
+		mkAgentTask("task", "task.abc-124", mesos.TASK_RUNNING, "agent-1"),
+		mkAgentTask("task", "task.abc-125", mesos.TASK_RUNNING, "agent-2"))
+	ts.StartAgent("agent-1")
+	ts.AddAgent(mesos.AgentInfo{ID: &mesos.AgentID{Value: "agent-2"}, Hostname: "10.0.0.2"})
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+}
+
+// loginFrom makes a login request from the given remote address.
+func (ts *TaskSourceTests) loginFrom(addr string, taskID string) (*logical.Response, error) {
+	req := ts.mkReq("login", jsonobj{"task-id": taskID})
+	req.Connection.RemoteAddr = addr
+	return ts.HandleRequestRaw(req)
+}
+
+// The verification mode defaults to master and can only be master or agent.
+func (ts *TaskSourceTests) Test_config() {
+	ts.SetupBackendWithMesos()
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("config")).Data["verification-mode"], "master")
+
+	ts.HandleRequestSuccess(ts.mkReq("config", jsonobj{"skip-verify": true, "verification-mode": "agent"}))
+	ts.Equal(ts.HandleRequest(ts.mkReadReq("config")).Data["verification-mode"], "agent")
+
+	resp := ts.HandleRequest(ts.mkReq("config", jsonobj{"skip-verify": true, "verification-mode": "bogus"}))
+	ts.Equal(resp, logical.ErrorResponse("invalid verification-mode: bogus"))
+}
+
+// In agent mode, a login asks only the agent it came from about the task and
+// its framework, and the master's agents are cached.
+func (ts *TaskSourceTests) Test_login() {
+	ts.setupAgentMode(jsonobj{})
+
+	resp := ts.WithoutError(ts.loginFrom("127.0.0.1:12345", "task.abc-123")).(*logical.Response)
+	ts.Equal(resp.Auth.Policies, []string{"insurance"})
+	ts.WithoutError(ts.loginFrom("127.0.0.1", "task.abc-124"))
+
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_AGENTS"))
+	ts.Equal(2, ts.MetricCount("mesos.agent.call;call=GET_STATE"))
+	ts.Equal(0, ts.MetricCount("mesos.call;call=GET_TASKS"))
+	ts.Equal(0, ts.MetricCount("mesos.call;call=GET_FRAMEWORKS"))
+}
+
+// In agent mode, a login from somewhere that isn't an agent is denied.
+func (ts *TaskSourceTests) Test_unknown_agent() {
+	ts.setupAgentMode(jsonobj{})
+
+	_, err := ts.loginFrom("10.0.0.1", "task.abc-123")
+	ts.EqualError(err, `permission denied: unknown-agent: no Mesos agent at address "10.0.0.1"`)
+	_, err = ts.loginFrom("", "task.abc-123")
+	ts.EqualError(err, `permission denied: unknown-agent: no Mesos agent at address ""`)
+}
+
+// In agent mode, we ask the master about its agents again when a request
+// comes from an address we don't know, so newly registered agents can log
+// in. Denials for unknown agents don't count towards a lockout.
+func (ts *TaskSourceTests) Test_new_agent() {
+	ts.SetupLoginTasks(jsonobj{
+		"verification-mode": "agent",
+		"lockout-threshold": 1,
+		"lockout-window":    "1m",
+		"lockout-duration":  "1h",
+	}, mkAgentTask("task", "task.abc-123", mesos.TASK_RUNNING, "agent-1"))
+	ts.AddFramework(mkFramework("marathon", "fw-1", ""))
+
+	for i := 0; i < 2; i++ {
+		_, err := ts.loginFrom("127.0.0.1", "task.abc-123")
+		ts.EqualError(err, `permission denied: unknown-agent: no Mesos agent at address "127.0.0.1"`)
+	}
+	// We've only just asked the master, so we don't ask it again for every
+	// request from an unknown address.
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_AGENTS"))
+
+	ts.StartAgent("agent-1")
+	ts.backend.agents.fetched = ts.backend.agents.fetched.Add(-agentRefreshInterval)
+	ts.WithoutError(ts.loginFrom("127.0.0.1", "task.abc-123"))
+	ts.Equal(2, ts.MetricCount("mesos.call;call=GET_AGENTS"))
+}
+
+// In agent mode, alias lookahead asks the agent the request came from, just
+// like the login.
+func (ts *TaskSourceTests) Test_lookahead() {
+	ts.setupAgentMode(jsonobj{"alias-source": "framework-task-name"})
+
+	req := ts.mkReq("login", jsonobj{"task-id": "task.abc-123"})
+	req.Operation = logical.AliasLookaheadOperation
+	req.Connection.RemoteAddr = "127.0.0.1"
+	ts.Equal(ts.HandleRequest(req).Auth, &logical.Auth{Alias: &logical.Alias{Name: "marathon/task"}})
+
+	req.Connection.RemoteAddr = "10.0.0.1"
+	ts.HandleRequestError(req, "permission denied")
+
+	// We only ask the master whether any task has its own address there.
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_TASKS"))
+	ts.Equal(0, ts.MetricCount("mesos.call;call=GET_FRAMEWORKS"))
+}
+
+// In agent mode, a task can't log in from another agent, even if it's
+// running, and a task that isn't running can't log in at all.
+func (ts *TaskSourceTests) Test_not_on_agent() {
+	ts.setupAgentMode(jsonobj{})
+
+	_, err := ts.loginFrom("127.0.0.1", "task.abc-125")
+	ts.EqualError(err, "permission denied: task-not-running: task is not running")
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_FINISHED), "task.abc-124")
+	_, err = ts.loginFrom("127.0.0.1", "task.abc-124")
+	ts.EqualError(err, "permission denied: task-not-running: task is not running")
+}
+
+// In agent mode, renewals also ask the agent they came from.
+func (ts *TaskSourceTests) Test_renewal() {
+	ts.setupAgentMode(jsonobj{})
+	resp := ts.WithoutError(ts.loginFrom("127.0.0.1", "task.abc-123")).(*logical.Response)
+
+	req := ts.mkRenew(resp.Auth)
+	req.Connection.RemoteAddr = "127.0.0.1"
+	ts.WithoutError(ts.HandleRequestRaw(req))
+
+	req.Connection.RemoteAddr = "10.0.0.1"
+	ts.HandleRequestError(req, `no Mesos agent at address "10.0.0.1"`)
+
+	ts.UpdateTask(mctesting.UpdateState(mesos.TASK_KILLED), "task.abc-123")
+	req.Connection.RemoteAddr = "127.0.0.1"
+	ts.HandleRequestError(req, "task task.abc-123 not found during renewal")
+
+	// Only the renewal from 10.0.0.1 asked the master, to see whether any
+	// task has its own address there.
+	ts.Equal(1, ts.MetricCount("mesos.call;call=GET_TASKS"))
+}
+
+// In agent mode, a task with its own IP address can log in and renew from
+// that address, even though it isn't its agent's. Only the task with that
+// address can, though.
+func (ts *TaskSourceTests) Test_container_address() {
+	ts.setupAgentMode(jsonobj{})
+	containerIP := "192.168.0.5"
+	ts.UpdateTask(func(task *mesos.Task) {
+		task.Statuses = []mesos.TaskStatus{{
+			TaskID: task.TaskID,
+			State:  task.State,
+			ContainerStatus: &mesos.ContainerStatus{NetworkInfos: []mesos.NetworkInfo{{
+				IPAddresses: []mesos.NetworkInfo_IPAddress{{IPAddress: &containerIP}},
+			}}},
+		}}
+	}, "task.abc-125")
+
+	resp := ts.WithoutError(ts.loginFrom("192.168.0.5:12345", "task.abc-125")).(*logical.Response)
+	ts.Equal(resp.Auth.Policies, []string{"insurance"})
+	ts.Equal(resp.Auth.Metadata["agent-hostname"], "10.0.0.2")
+
+	req := ts.mkRenew(resp.Auth)
+	req.Connection.RemoteAddr = "192.168.0.5"
+	ts.WithoutError(ts.HandleRequestRaw(req))
+
+	_, err := ts.loginFrom("192.168.0.5", "task.abc-124")
+	ts.EqualError(err, "permission denied: task-not-running: task is not running")
+}
+
+// In agent mode, status reports the last agent GET_TASKS.
+func (ts *TaskSourceTests) Test_status() {
+	ts.setupAgentMode(jsonobj{})
+	ts.WithoutError(ts.loginFrom("127.0.0.1", "task.abc-123"))
+
+	data := ts.HandleRequest(ts.mkReadReq("status")).Data
+	ts.NotEmpty(data["last-get-tasks"])
+	ts.Equal(data["tasks-seen"], 2)
+}
+
+// A login check can say whether a login from a given agent would work.
+func (ts *TaskSourceTests) Test_login_check() {
+	ts.setupAgentMode(jsonobj{})
+
+	req := ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "remote-addr": "127.0.0.1"})
+	ts.Equal(ts.HandleRequest(req).Data["allowed"], true)
+
+	req = ts.mkReq("login-check", jsonobj{"task-id": "task.abc-123", "remote-addr": "10.0.0.1"})
+	ts.Equal(ts.HandleRequest(req).Data["denial-reason"], "unknown-agent")
+}
+
+var agentAddressData = []struct {
+	masterURL string
+	agent     master.Response_GetAgents_Agent
+	ips       []string
+	baseURL   string
+}{
+	{
+		"http://master.mesos:5050",
+		master.Response_GetAgents_Agent{AgentInfo: mesos.AgentInfo{Hostname: "10.0.0.1"}},
+		[]string{"10.0.0.1"},
+		"http://10.0.0.1:5051",
+	},
+	{
+		"https://master.mesos:5050",
+		master.Response_GetAgents_Agent{AgentInfo: mesos.AgentInfo{Hostname: "agent1.mesos"}},
+		[]string{},
+		"https://agent1.mesos:5051",
+	},
+	{
+		"http://master.mesos:5050",
+		master.Response_GetAgents_Agent{
+			AgentInfo: mesos.AgentInfo{Hostname: "agent1.mesos"},
+			PID:       strptr("slave(1)@10.0.0.1:5052"),
+		},
+		[]string{"10.0.0.1"},
+		"http://10.0.0.1:5052",
+	},
+	{
+		"http://master.mesos:5050",
+		master.Response_GetAgents_Agent{
+			AgentInfo: mesos.AgentInfo{Hostname: "2001:db8::1"},
+			PID:       strptr("garbage"),
+		},
+		[]string{"2001:db8::1"},
+		"http://[2001:db8::1]:5051",
+	},
+}
+
+// We find an agent's addresses and API URL from its hostname and PID.
+func (ts *TaskSourceTests) Test_agent_addresses() {
+	for _, aad := range agentAddressData {
+		ips := []string{}
+		for _, ip := range agentIPs(&aad.agent) {
+			ips = append(ips, ip.String())
+		}
+		ts.Equalf(aad.ips, ips, "%#v", aad)
+		ts.Equalf(aad.baseURL, agentBaseURL(aad.masterURL, &aad.agent), "%#v", aad)
+	}
+}
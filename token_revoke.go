@@ -0,0 +1,31 @@
+package mesosauth
+
+import (
+	"context"
+	"strings"
+)
+
+// revokeQuarantinedToken revokes a token that a quarantined task tried to
+// renew. Vault doesn't let auth plugins revoke tokens, but it does tell us a
+// token's accessor when it's renewed, so we ask Vault's API to revoke it using
+// the token in the config. We don't know the accessors of tokens that are
+// never renewed, so those stay valid until their TTL runs out.
+//
+// Vault is waiting for us to deny the renewal, so we do this in the
+// background to avoid asking it to revoke a token it's busy renewing.
+func (b *mesosBackend) revokeQuarantinedToken(cfg *config, taskID string, accessor string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), responseTimeout)
+		defer cancel()
+
+		url := strings.TrimSuffix(cfg.VaultAddr, "/") + "/v1/auth/token/revoke-accessor"
+		headers := map[string]string{"X-Vault-Token": cfg.VaultToken}
+		err := postJSON(ctx, url, headers, jsonobj{"accessor": accessor})
+		if err != nil {
+			b.Logger().Error("TOKEN NOT REVOKED", "task-id", taskID, "accessor", accessor, "error", err)
+		} else {
+			b.Logger().Warn("TOKEN REVOKED", "task-id", taskID, "accessor", accessor)
+		}
+		b.status.recordBackgroundError("token-revoke", err)
+	}()
+}
@@ -0,0 +1,179 @@
+package mesosauth
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/vault/helper/parseutil"
+	"github.com/hashicorp/vault/logical"
+	"github.com/hashicorp/vault/logical/framework"
+)
+
+// These constants are the valid values for the "token-type" task-policies
+// setting.
+const (
+	// tokenTypeService tokens are renewable, and periodic unless they have a
+	// TTL of their own.
+	tokenTypeService = "service"
+	// tokenTypeBatch tokens are short-lived and can't be renewed, so they must
+	// have a TTL and can't have a period. (The Vault versions we support don't
+	// have real batch tokens, so these are service tokens without the
+	// renewal.)
+	tokenTypeBatch = "batch"
+)
+
+// tokenSettingsFields returns the field schemas for the token settings, so
+// they can be added to any path that stores them.
+func tokenSettingsFields() map[string]*framework.FieldSchema {
+	return map[string]*framework.FieldSchema{
+		"ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Token TTL. If set (and period isn't), tokens are not periodic.",
+		},
+		"max-ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Maximum lifetime of a token, enforced on renewal.",
+		},
+		"explicit-max-ttl": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Hard maximum lifetime of a token, even if it is periodic.",
+		},
+		"period": {
+			Type:        framework.TypeDurationSecond,
+			Description: "Token renewal period. Overrides the configured default period.",
+		},
+		"num-uses": {
+			Type:        framework.TypeInt,
+			Description: "Number of times a token may be used. Zero means unlimited.",
+		},
+		"bound-cidrs": {
+			Type:        framework.TypeCommaStringSlice,
+			Description: "CIDR blocks that tokens may be used from.",
+		},
+		"token-type": {
+			Type:        framework.TypeString,
+			Description: "Type of token to issue: service (the default) or batch. Batch tokens require a ttl and can't have a period.",
+		},
+	}
+}
+
+// tokenSettings holds per-prefix token parameters. Zero values mean "use the
+// default".
+type tokenSettings struct {
+	TTL            time.Duration
+	MaxTTL         time.Duration
+	ExplicitMaxTTL time.Duration
+	Period         time.Duration
+	NumUses        int
+	BoundCIDRs     []string
+	TokenType      string
+}
+
+// parseTokenSettings reads the token settings from request data. Any error it
+// returns is the caller's fault.
+func parseTokenSettings(d *framework.FieldData) (tokenSettings, error) {
+	ts := tokenSettings{
+		TTL:            time.Duration(d.Get("ttl").(int)) * time.Second,
+		MaxTTL:         time.Duration(d.Get("max-ttl").(int)) * time.Second,
+		ExplicitMaxTTL: time.Duration(d.Get("explicit-max-ttl").(int)) * time.Second,
+		Period:         time.Duration(d.Get("period").(int)) * time.Second,
+		NumUses:        d.Get("num-uses").(int),
+	}
+
+	if ts.TTL < 0 || ts.MaxTTL < 0 || ts.ExplicitMaxTTL < 0 || ts.Period < 0 {
+		return ts, fmt.Errorf("durations must not be negative")
+	}
+	if ts.MaxTTL > 0 && ts.TTL > ts.MaxTTL {
+		return ts, fmt.Errorf("ttl must not exceed max-ttl")
+	}
+	if ts.NumUses < 0 {
+		return ts, fmt.Errorf("num-uses must not be negative")
+	}
+
+	if cidrs, ok := d.GetOk("bound-cidrs"); ok {
+		ts.BoundCIDRs = cidrs.([]string)
+		if _, err := parseutil.ParseAddrs(ts.BoundCIDRs); err != nil {
+			return ts, fmt.Errorf("invalid bound-cidrs: %s", err)
+		}
+	}
+
+	if tokenType, ok := d.GetOk("token-type"); ok {
+		ts.TokenType = tokenType.(string)
+		if ts.TokenType != tokenTypeService && ts.TokenType != tokenTypeBatch {
+			return ts, fmt.Errorf("invalid token-type: %s", ts.TokenType)
+		}
+	}
+	if ts.TokenType == tokenTypeBatch {
+		if ts.TTL == 0 {
+			return ts, fmt.Errorf("batch tokens require a ttl")
+		}
+		if ts.Period > 0 {
+			return ts, fmt.Errorf("batch tokens can't have a period")
+		}
+	}
+
+	return ts, nil
+}
+
+// data returns the token settings in a form suitable for a read response.
+func (ts *tokenSettings) data() jsonobj {
+	tokenType := ts.TokenType
+	if tokenType == "" {
+		tokenType = tokenTypeService
+	}
+	return jsonobj{
+		"ttl":              ts.TTL.String(),
+		"max-ttl":          ts.MaxTTL.String(),
+		"explicit-max-ttl": ts.ExplicitMaxTTL.String(),
+		"period":           ts.Period.String(),
+		"num-uses":         ts.NumUses,
+		"bound-cidrs":      ts.BoundCIDRs,
+		"token-type":       tokenType,
+	}
+}
+
+// apply sets the token parameters on an auth struct for login or renewal.
+// Service tokens with neither a TTL nor a period of their own get the given
+// default period.
+func (ts *tokenSettings) apply(auth *logical.Auth, defaultPeriod time.Duration) error {
+	boundCIDRs, err := parseutil.ParseAddrs(ts.BoundCIDRs)
+	if err != nil {
+		return err
+	}
+	// ParseAddrs returns an empty slice for no addresses, but we'd rather have
+	// nil so that we don't add noise to the auth struct.
+	auth.BoundCIDRs = nil
+	if len(boundCIDRs) > 0 {
+		auth.BoundCIDRs = boundCIDRs
+	}
+
+	auth.MaxTTL = ts.MaxTTL
+	auth.ExplicitMaxTTL = ts.ExplicitMaxTTL
+	auth.NumUses = ts.NumUses
+
+	switch {
+	case ts.TokenType == tokenTypeBatch:
+		auth.TTL = ts.TTL
+		auth.Period = 0
+		auth.Renewable = false
+	case ts.Period == 0 && ts.TTL > 0:
+		auth.TTL = ts.TTL
+		auth.Period = 0
+		auth.Renewable = true
+	default:
+		auth.Period = ts.Period
+		if auth.Period == 0 {
+			auth.Period = defaultPeriod
+		}
+		auth.Renewable = true
+	}
+	return nil
+}
+
+// verifyMaxTTL checks that a token being renewed hasn't outlived its max TTL.
+func (ts *tokenSettings) verifyMaxTTL(auth *logical.Auth) error {
+	if ts.MaxTTL > 0 && !auth.IssueTime.IsZero() && time.Since(auth.IssueTime) > ts.MaxTTL {
+		return fmt.Errorf("max-ttl of %s exceeded", ts.MaxTTL)
+	}
+	return nil
+}
@@ -25,6 +25,7 @@ type jsonobj = map[string]interface{}
 type requestHelper struct {
 	ctx     context.Context
 	storage logical.Storage
+	cache   *storageCache
 }
 
 // store is a helper function to construct and store a Vault storage entry so
@@ -34,6 +35,17 @@ func (rh *requestHelper) store(key string, value interface{}) error {
 	if err == nil {
 		err = rh.storage.Put(rh.ctx, storageEntry)
 	}
+	// Even a failed write may have changed something, so we always drop the
+	// cached entry.
+	rh.invalidate(key)
+	return err
+}
+
+// delete is a helper function to delete a Vault storage entry and drop any
+// cached copy.
+func (rh *requestHelper) delete(key string) error {
+	err := rh.storage.Delete(rh.ctx, key)
+	rh.invalidate(key)
 	return err
 }
 
@@ -41,13 +53,38 @@ func (rh *requestHelper) store(key string, value interface{}) error {
 // Go's poor support for building abstractions, it takes a callback for
 // decoding the fetched value (which may be nil).
 func (rh *requestHelper) fetch(key string, decode func(*logical.StorageEntry) error) error {
-	se, err := rh.storage.Get(rh.ctx, key)
+	se, err := rh.get(key)
 	if err == nil {
 		err = decode(se)
 	}
 	return err
 }
 
+// get fetches a Vault storage entry from the cache if we have one, or from
+// storage (populating the cache) if we don't. A requestHelper without a cache
+// always reads from storage.
+func (rh *requestHelper) get(key string) (*logical.StorageEntry, error) {
+	if rh.cache == nil {
+		return rh.storage.Get(rh.ctx, key)
+	}
+	se, ok, generation := rh.cache.get(key)
+	if ok {
+		return se, nil
+	}
+	se, err := rh.storage.Get(rh.ctx, key)
+	if err == nil {
+		rh.cache.put(key, se, generation)
+	}
+	return se, err
+}
+
+// invalidate drops a cached storage entry after we've written to it.
+func (rh *requestHelper) invalidate(key string) {
+	if rh.cache != nil {
+		rh.cache.invalidate(key)
+	}
+}
+
 // getConfig fetches the plugin config from Vault, returning nil if there is no
 // config.
 func (rh *requestHelper) getConfigOrNil() (*config, error) {